@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const yandexAPIUrl = "https://cloud-api.yandex.net/v1/disk"
+
+// apiURL is the base url of API requests, the global --api-url flag or
+// YDU_API_URL point ydu at a mock server or a proxy re-hosting the API.
+var apiURL = yandexAPIUrl
+
+// setAPIURL sets apiURL from the value of --api-url.
+func setAPIURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --api-url %q, expected an http or https url", value)
+	}
+	apiURL = strings.TrimSuffix(value, "/")
+	return nil
+}
+
+// Error codes the Yandex Disk API returns in the "error" field.
+const (
+	errDiskPathDoesntExists      = "DiskPathDoesntExistsError"
+	errDiskResourceAlreadyExists = "DiskResourceAlreadyExistsError"
+	errUnauthorized              = "UnauthorizedError"
+)
+
+// apiError is returned for Yandex Disk API responses with an unexpected
+// status code. Code, Description and Message are parsed from the JSON
+// error body when there is one.
+type apiError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	// RequestID is the correlation id ydu sent with the request.
+	RequestID string
+
+	Code        string `json:"error"`
+	Description string `json:"description"`
+	Message     string `json:"message"`
+}
+
+// newAPIError builds the apiError of a response with body.
+func newAPIError(resp *http.Response, body []byte) *apiError {
+	apiErr := &apiError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+	}
+	if resp.Request != nil {
+		apiErr.RequestID = resp.Request.Header.Get(requestIDHeader)
+	}
+
+	// not every error body is JSON, the raw body is kept either way
+	json.Unmarshal(body, apiErr)
+	return apiErr
+}
+
+func (e *apiError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf(
+			"yandex disk api error: %s, body: %s",
+			e.Status,
+			e.Body,
+		)
+	}
+
+	message := e.Message
+	if message == "" {
+		message = e.Description
+	}
+	return fmt.Sprintf(
+		"%s (%s, %s)",
+		message,
+		e.Code,
+		e.Status,
+	)
+}
+
+// apiErrorAttrs returns the log attributes of the api error err wraps:
+// its code and the id of the failed request.
+func apiErrorAttrs(err error) []any {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+
+	var attrs []any
+	if apiErr.Code != "" {
+		attrs = append(attrs, slog.String("code", apiErr.Code))
+	}
+	if apiErr.RequestID != "" {
+		attrs = append(attrs, slog.String("request id", apiErr.RequestID))
+	}
+	return attrs
+}
+
+// isAPIError reports whether err is or wraps an api error with code.
+func isAPIError(err error, code string) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// apiLink is the link object returned by endpoints such as download or
+// async operations.
+type apiLink struct {
+	Href      string `json:"href"`
+	Method    string `json:"method"`
+	Templated bool   `json:"templated"`
+}
+
+// resource is a file or folder on yandex disk.
+type resource struct {
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Created    time.Time `json:"created"`
+	Modified   time.Time `json:"modified"`
+	MD5        string    `json:"md5,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	MediaType  string    `json:"media_type,omitempty"`
+	MimeType   string    `json:"mime_type,omitempty"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	PublicURL  string    `json:"public_url,omitempty"`
+	ResourceID string    `json:"resource_id,omitempty"`
+	Revision   int64     `json:"revision,omitempty"`
+
+	CustomProperties map[string]any `json:"custom_properties,omitempty"`
+	Embedded         *resourceList  `json:"_embedded,omitempty"`
+}
+
+type resourceList struct {
+	Items  []resource `json:"items"`
+	Limit  int        `json:"limit"`
+	Offset int        `json:"offset"`
+	Total  int        `json:"total"`
+}
+
+// resourceFields are the attributes of resource. Metadata requests ask
+// for them with the fields parameter, so listings leave out the
+// previews, exif data and download links ydu never reads.
+var resourceFields = []string{
+	"path",
+	"name",
+	"type",
+	"size",
+	"created",
+	"modified",
+	"md5",
+	"sha256",
+	"media_type",
+	"mime_type",
+	"public_key",
+	"public_url",
+	"resource_id",
+	"revision",
+	"custom_properties",
+}
+
+// walkFields are the attributes walking a tree needs besides the ones a
+// command asks for.
+var walkFields = []string{"path", "name", "type"}
+
+// fieldsParam returns the fields parameter requesting fields of a
+// resource and of the items of its listing.
+func fieldsParam(fields []string) string {
+	param := slices.Clone(fields)
+	for _, field := range fields {
+		param = append(param, "_embedded.items."+field)
+	}
+	param = append(param, "_embedded.limit", "_embedded.offset", "_embedded.total")
+	return strings.Join(param, ",")
+}
+
+// listFieldsParam returns the fields parameter requesting fields of the
+// items of a flat list of files.
+func listFieldsParam(fields []string) string {
+	var param []string
+	for _, field := range fields {
+		param = append(param, "items."+field)
+	}
+	param = append(param, "limit", "offset")
+	return strings.Join(param, ",")
+}
+
+// parseFields parses the value of a --fields flag, comma separated
+// attributes of resourceFields.
+func parseFields(value string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(resourceFields, field) {
+			return nil, fmt.Errorf(
+				"unknown field %q, expected some of %s",
+				field,
+				strings.Join(resourceFields, ","),
+			)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// diskPath normalizes a user supplied remote path to the "disk:/..."
+// form the API returns in resource metadata. "app:/" paths are left
+// untouched.
+func diskPath(p string) string {
+	if strings.HasPrefix(p, "disk:") || strings.HasPrefix(p, "app:") {
+		return strings.TrimSuffix(p, "/")
+	}
+	return "disk:" + path.Join("/", p)
+}
+
+// resolveRemotePath prefixes a remote path without "disk:" or "app:"
+// with the root the token has access to, "app:" for tokens restricted
+// to the application folder and "disk:" otherwise.
+func resolveRemotePath(
+	httpClient *http.Client,
+	p, token string,
+) (string, error) {
+	if strings.HasPrefix(p, "disk:") || strings.HasPrefix(p, "app:") {
+		return p, nil
+	}
+
+	access, err := tokenAccess(httpClient, token)
+	if err != nil {
+		return "", err
+	}
+	return access + ":" + path.Join("/", p), nil
+}
+
+// isBelow reports whether remotePath is root or inside of it.
+func isBelow(remotePath, root string) bool {
+	root = strings.TrimSuffix(root, "/")
+	return remotePath == root ||
+		strings.HasPrefix(remotePath, root+"/") ||
+		root == "disk:" || root == "app:"
+}
+
+// listPageSize is the page size used when walking folder listings.
+const listPageSize = 100
+
+// getResource fetches resource metadata from endpoint. For folders all
+// pages of the listing are fetched and merged into Embedded.Items.
+// Metadata of the own disk is fetched once per process, see memo.
+func getResource(
+	httpClient *http.Client,
+	endpoint string,
+	params url.Values,
+	token string,
+) (*resource, error) {
+	memoized := endpoint == "/resources"
+	if memoized {
+		if res, found := memo.Get(endpoint, params, token); found {
+			return res, nil
+		}
+	}
+
+	var result *resource
+
+	for offset := 0; ; offset += listPageSize {
+		pageParams := url.Values{}
+		for key, values := range params {
+			pageParams[key] = values
+		}
+		pageParams.Set("limit", strconv.Itoa(listPageSize))
+		pageParams.Set("offset", strconv.Itoa(offset))
+
+		var page resource
+		err := apiRequest(
+			httpClient,
+			http.MethodGet,
+			endpoint,
+			pageParams,
+			token,
+			&page,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if result == nil {
+			result = &page
+		} else {
+			result.Embedded.Items = append(
+				result.Embedded.Items,
+				page.Embedded.Items...,
+			)
+		}
+
+		if page.Embedded == nil ||
+			len(page.Embedded.Items) < listPageSize {
+			if memoized {
+				memo.Put(endpoint, params, token, result)
+			}
+			return result, nil
+		}
+	}
+}
+
+// apiRequest calls a Yandex Disk API endpoint, e.g. "/resources", and
+// decodes the JSON response into out unless out is nil.
+func apiRequest(
+	httpClient *http.Client,
+	method, endpoint string,
+	params url.Values,
+	token string,
+	out any,
+) error {
+	return apiRequestWithBody(
+		httpClient,
+		method,
+		endpoint,
+		params,
+		token,
+		nil,
+		out,
+	)
+}
+
+// apiRequestWithBody is apiRequest sending in as JSON request body.
+func apiRequestWithBody(
+	httpClient *http.Client,
+	method, endpoint string,
+	params url.Values,
+	token string,
+	in, out any,
+) error {
+	err := checkWritable(method, endpoint)
+	if err != nil {
+		return err
+	}
+
+	err = sendAPIRequest(httpClient, method, endpoint, params, token, in, out)
+	if method != http.MethodGet && method != http.MethodHead {
+		auditAPIRequest(
+			method,
+			endpoint,
+			params.Get("path"),
+			params.Get("from"),
+			token,
+			err,
+		)
+	}
+	return err
+}
+
+// sendAPIRequest sends the request of apiRequestWithBody. Rate limited
+// requests are retried, idempotent ones also after network and server
+// errors, as the retry policy allows.
+func sendAPIRequest(
+	httpClient *http.Client,
+	method, endpoint string,
+	params url.Values,
+	token string,
+	in, out any,
+) error {
+	u, err := url.Parse(apiURL + endpoint)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = params.Encode()
+
+	var reqBody io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(
+		method,
+		u.String(),
+		reqBody,
+	)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// public resources can be requested anonymously
+	if token != "" {
+		req.Header.Add(
+			"Authorization",
+			fmt.Sprintf("OAuth %s", token),
+		)
+	}
+
+	idempotent := method != http.MethodPost && method != http.MethodDelete
+	for attempt := 1; ; attempt++ {
+		apiPacer.Wait()
+
+		var body []byte
+		resp, err := httpClient.Do(req)
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil {
+			apiPacer.Observe(resp)
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = newAPIError(resp, body)
+			}
+		}
+
+		if err != nil {
+			// a rate limited request was not carried out, others may
+			// have been
+			var apiErr *apiError
+			rateLimited := errors.As(err, &apiErr) &&
+				apiErr.StatusCode == http.StatusTooManyRequests
+			delay, retry := retries().next(err, attempt)
+			if !retry || (!idempotent && !rateLimited) {
+				return err
+			}
+
+			time.Sleep(delay)
+			if req.GetBody != nil {
+				req.Body, err = req.GetBody()
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// requesting an upload link is how uploads change a folder
+		if method != http.MethodGet || endpoint == "/resources/upload" {
+			listings.Invalidate(params.Get("path"), token)
+			listings.Invalidate(params.Get("from"), token)
+			memo.Invalidate(params.Get("path"))
+			memo.Invalidate(params.Get("from"))
+		}
+
+		if out == nil || len(body) == 0 {
+			return nil
+		}
+
+		return json.Unmarshal(body, out)
+	}
+}
+
+// createRemoteDir creates a folder on yandex disk, an already existing
+// folder is not an error.
+func createRemoteDir(
+	httpClient *http.Client,
+	remotePath, token string,
+) error {
+	params := url.Values{}
+	params.Add("path", remotePath)
+
+	err := apiRequest(
+		httpClient,
+		http.MethodPut,
+		"/resources",
+		params,
+		token,
+		nil,
+	)
+
+	// a missing parent is reported as a conflict as well
+	if apiErr, ok := err.(*apiError); ok &&
+		apiErr.StatusCode == http.StatusConflict &&
+		apiErr.Code != errDiskPathDoesntExists {
+		return nil
+	}
+
+	return err
+}
+
+// remoteDirs creates the remote folders of a directory upload on demand
+// and remembers the ones that already exist.
+type remoteDirs struct {
+	httpClient *http.Client
+	token      string
+
+	// mu is held while folders are created, parallel uploads into a new
+	// folder create it once
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+func newRemoteDirs(
+	httpClient *http.Client,
+	root, token string,
+) *remoteDirs {
+	return &remoteDirs{
+		httpClient: httpClient,
+		token:      token,
+		known: map[string]bool{
+			path.Dir(root): true,
+		},
+	}
+}
+
+// ensure creates dir and its missing parents below the upload root.
+func (d *remoteDirs) ensure(dir string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.create(dir)
+}
+
+func (d *remoteDirs) create(dir string) error {
+	parent := path.Dir(dir)
+	if d.known[dir] || parent == dir {
+		return nil
+	}
+
+	err := d.create(parent)
+	if err != nil {
+		return err
+	}
+
+	err = createRemoteDir(d.httpClient, dir, d.token)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to create remote folder %s: %w",
+			dir,
+			err,
+		)
+	}
+
+	d.known[dir] = true
+	return nil
+}
+
+// operationID returns the id of the async operation link points to, or
+// an empty string when the request was completed synchronously.
+func operationID(link apiLink) string {
+	_, id, found := strings.Cut(link.Href, "/operations/")
+	if !found {
+		return ""
+	}
+	id, _, _ = strings.Cut(id, "?")
+	return id
+}
+
+// operationStatus returns the status of an async operation: success,
+// failed or in-progress.
+func operationStatus(
+	httpClient *http.Client,
+	id, token string,
+) (string, error) {
+	var operation struct {
+		Status string `json:"status"`
+	}
+
+	err := apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/operations/"+url.PathEscape(id),
+		nil,
+		token,
+		&operation,
+	)
+	return operation.Status, err
+}
+
+// waitOperation polls an async operation until it finishes.
+func waitOperation(
+	httpClient *http.Client,
+	id, token string,
+	interval time.Duration,
+) error {
+	for {
+		status, err := operationStatus(httpClient, id, token)
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case "success":
+			return nil
+		case "failed":
+			return fmt.Errorf("operation %s failed", id)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// remoteExists reports whether a file or folder exists at remotePath.
+func remoteExists(
+	httpClient *http.Client,
+	remotePath, token string,
+) (bool, error) {
+	params := url.Values{}
+	params.Add("path", remotePath)
+	params.Add("fields", "path")
+
+	err := apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/resources",
+		params,
+		token,
+		nil,
+	)
+
+	if apiErr, ok := err.(*apiError); ok &&
+		apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// operationPollInterval is how often async operations started as part of
+// other commands are polled.
+const operationPollInterval = time.Second
+
+// moveResource moves from to path on the server side and waits for the
+// operation to complete.
+func moveResource(
+	httpClient *http.Client,
+	from, to, token string,
+	overwrite bool,
+) error {
+	params := url.Values{}
+	params.Add("from", from)
+	params.Add("path", to)
+	params.Add("overwrite", strconv.FormatBool(overwrite))
+
+	var link apiLink
+	err := apiRequest(
+		httpClient,
+		http.MethodPost,
+		"/resources/move",
+		params,
+		token,
+		&link,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to move %s to %s: %w",
+			from,
+			to,
+			err,
+		)
+	}
+
+	if id := trackOperation(link, "move "+from+" -> "+to); id != "" {
+		return waitOperation(httpClient, id, token, operationPollInterval)
+	}
+	return nil
+}
+
+// getDiskResource fetches metadata of a resource on the own disk, for
+// folders including the complete listing.
+func getDiskResource(
+	httpClient *http.Client,
+	remotePath, token string,
+) (*resource, error) {
+	return getDiskResourceFields(httpClient, remotePath, token, resourceFields)
+}
+
+// getDiskResourceFields is getDiskResource fetching only the attributes
+// fields of the resource and its items.
+func getDiskResourceFields(
+	httpClient *http.Client,
+	remotePath, token string,
+	fields []string,
+) (*resource, error) {
+	// the listing cache keeps complete listings only
+	complete := slices.Equal(fields, resourceFields)
+	if complete {
+		if res, found := listings.Get(remotePath, token); found {
+			return res, nil
+		}
+	}
+
+	params := url.Values{}
+	params.Add("path", remotePath)
+	params.Add("fields", fieldsParam(fields))
+
+	res, err := getResource(
+		httpClient,
+		"/resources",
+		params,
+		token,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if complete {
+		listings.Put(remotePath, token, res)
+	}
+	return res, nil
+}
+
+// walkRemote calls visit for every file and folder below remotePath with
+// its slash separated path relative to remotePath. When remotePath is a
+// file visit is called once with the file name. Listings of subfolders
+// are fetched concurrently ahead of the walk, visit is still called
+// from one goroutine in listing order.
+func walkRemote(
+	httpClient *http.Client,
+	remotePath, token string,
+	visit func(rel string, res resource) error,
+) error {
+	return walkRemoteFields(httpClient, remotePath, token, resourceFields, visit)
+}
+
+// walkRemoteFields is walkRemote fetching only the attributes fields,
+// and the ones the walk needs, of the resources.
+func walkRemoteFields(
+	httpClient *http.Client,
+	remotePath, token string,
+	fields []string,
+	visit func(rel string, res resource) error,
+) error {
+	for _, field := range walkFields {
+		if !slices.Contains(fields, field) {
+			fields = append(slices.Clip(fields), field)
+		}
+	}
+
+	res, err := getDiskResourceFields(httpClient, remotePath, token, fields)
+	if err != nil {
+		return err
+	}
+
+	if res.Type != "dir" {
+		return visit(res.Name, *res)
+	}
+
+	// the listings fetched ahead are abandoned when the walk fails
+	var stop atomic.Bool
+	defer stop.Store(true)
+
+	return walkRemoteDir(httpClient, remotePath, "", res, token, fields, &stop, visit)
+}
+
+func walkRemoteDir(
+	httpClient *http.Client,
+	remotePath, rel string,
+	dir *resource,
+	token string,
+	fields []string,
+	stop *atomic.Bool,
+	visit func(rel string, res resource) error,
+) error {
+	var subdirs []string
+	for _, item := range dir.Embedded.Items {
+		if item.Type == "dir" && item.Name != remoteLockName {
+			subdirs = append(subdirs, path.Join(remotePath, rel, item.Name))
+		}
+	}
+	listings := prefetchListings(httpClient, subdirs, token, fields, stop)
+
+	for _, item := range dir.Embedded.Items {
+		if item.Name == remoteLockName {
+			continue
+		}
+		itemRel := path.Join(rel, item.Name)
+
+		err := visit(itemRel, item)
+		if err != nil {
+			return err
+		}
+
+		if item.Type != "dir" {
+			continue
+		}
+
+		sub, err := listings[0].wait()
+		listings = listings[1:]
+		if err != nil {
+			return err
+		}
+
+		err = walkRemoteDir(httpClient, remotePath, itemRel, sub, token, fields, stop, visit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteResource deletes remotePath, to the trash unless permanently is
+// set, and waits for the operation to complete.
+func deleteResource(
+	httpClient *http.Client,
+	remotePath, token string,
+	permanently bool,
+) error {
+	params := url.Values{}
+	params.Add("path", remotePath)
+	params.Add("permanently", strconv.FormatBool(permanently))
+
+	var link apiLink
+	err := apiRequest(
+		httpClient,
+		http.MethodDelete,
+		"/resources",
+		params,
+		token,
+		&link,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to delete %s: %w",
+			remotePath,
+			err,
+		)
+	}
+
+	if id := trackOperation(link, "delete "+remotePath); id != "" {
+		return waitOperation(httpClient, id, token, operationPollInterval)
+	}
+	return nil
+}
+
+// publishResource publishes remotePath and returns its public url.
+func publishResource(
+	httpClient *http.Client,
+	remotePath, token string,
+) (string, error) {
+	params := url.Values{}
+	params.Add("path", remotePath)
+
+	err := apiRequest(
+		httpClient,
+		http.MethodPut,
+		"/resources/publish",
+		params,
+		token,
+		nil,
+	)
+	if err != nil {
+		return "", fmt.Errorf(
+			"failed to publish %s: %w",
+			remotePath,
+			err,
+		)
+	}
+
+	params.Add("fields", "public_url")
+
+	var res resource
+	err = apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/resources",
+		params,
+		token,
+		&res,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return res.PublicURL, nil
+}
+
+// copyResource copies from to path on the server side and waits for the
+// operation to complete.
+func copyResource(
+	httpClient *http.Client,
+	from, to, token string,
+	overwrite bool,
+) error {
+	params := url.Values{}
+	params.Add("from", from)
+	params.Add("path", to)
+	params.Add("overwrite", strconv.FormatBool(overwrite))
+
+	var link apiLink
+	err := apiRequest(
+		httpClient,
+		http.MethodPost,
+		"/resources/copy",
+		params,
+		token,
+		&link,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to copy %s to %s: %w",
+			from,
+			to,
+			err,
+		)
+	}
+
+	if id := trackOperation(link, "copy "+from+" -> "+to); id != "" {
+		return waitOperation(httpClient, id, token, operationPollInterval)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// planDrift is why operations of a plan no longer match the state they
+// were planned for, by their index in the plan.
+type planDrift struct {
+	Moves   map[int]string
+	Uploads map[int]string
+	Deletes map[int]string
+}
+
+func (d planDrift) count() int {
+	return len(d.Moves) + len(d.Uploads) + len(d.Deletes)
+}
+
+// findPlanDrift compares the local files and the remote tree below
+// plan.Target with the state plan was made for.
+func findPlanDrift(
+	httpClient *http.Client,
+	plan *uploadPlan,
+	token string,
+) (planDrift, error) {
+	drift := planDrift{
+		Moves:   map[int]string{},
+		Uploads: map[int]string{},
+		Deletes: map[int]string{},
+	}
+
+	files := map[string]resource{}
+	dirs := map[string]bool{}
+	err := walkRemote(
+		httpClient,
+		plan.Target,
+		token,
+		func(rel string, res resource) error {
+			if res.Type == "dir" {
+				dirs[diskPath(res.Path)] = true
+			} else {
+				files[diskPath(res.Path)] = logicalResource(res)
+			}
+			return nil
+		},
+	)
+	if err != nil && !isAPIError(err, errDiskPathDoesntExists) {
+		return drift, err
+	}
+
+	for i, move := range plan.Moves {
+		from, found := files[diskPath(move.From)]
+		info, statErr := os.Stat(move.LocalPath)
+		switch {
+		case !found:
+			drift.Moves[i] = "remote file is gone"
+		case from.Size != move.Size || from.MD5 != move.MD5:
+			drift.Moves[i] = "remote file changed"
+		case statErr != nil:
+			drift.Moves[i] = "local file is gone"
+		case info.Size() != move.Size:
+			drift.Moves[i] = "local file changed"
+		}
+		if _, found := files[diskPath(move.To)]; found {
+			drift.Moves[i] = "target exists"
+		}
+	}
+
+	for i, upload := range plan.Uploads {
+		info, statErr := os.Stat(upload.LocalPath)
+		res, found := files[diskPath(upload.RemotePath)]
+		switch {
+		case statErr != nil:
+			drift.Uploads[i] = "local file is gone"
+		case info.Size() != upload.Size || !info.ModTime().Equal(upload.Modified):
+			drift.Uploads[i] = "local file changed"
+		case upload.Replaces == nil && found:
+			drift.Uploads[i] = "remote file appeared"
+		case upload.Replaces != nil && !found:
+			drift.Uploads[i] = "remote file is gone"
+		case upload.Replaces != nil &&
+			(res.Size != upload.Replaces.Size || res.MD5 != upload.Replaces.MD5):
+			drift.Uploads[i] = "remote file changed"
+		}
+	}
+
+	for i, del := range plan.Deletes {
+		p := diskPath(del.Path)
+		if del.Type != "dir" {
+			res, found := files[p]
+			if !found {
+				drift.Deletes[i] = "remote file is gone"
+			} else if res.Size != del.Size || res.MD5 != del.MD5 {
+				drift.Deletes[i] = "remote file changed"
+			}
+			continue
+		}
+
+		if !dirs[p] {
+			drift.Deletes[i] = "remote folder is gone"
+			continue
+		}
+		count, size := 0, int64(0)
+		for filePath, res := range files {
+			if strings.HasPrefix(filePath, p+"/") {
+				count++
+				size += res.Size
+			}
+		}
+		if count != del.Files || size != del.Size {
+			drift.Deletes[i] = "remote folder changed"
+		}
+	}
+
+	return drift, nil
+}
+
+// logDrift logs the drifted operations of plan in plan order.
+func logDrift(logger *slog.Logger, plan *uploadPlan, drift planDrift) {
+	for i, move := range plan.Moves {
+		if reason := drift.Moves[i]; reason != "" {
+			logger.Warn(
+				"planned move drifted",
+				slog.String("from", move.From),
+				slog.String("to", move.To),
+				slog.String("reason", reason),
+			)
+		}
+	}
+	for i, upload := range plan.Uploads {
+		if reason := drift.Uploads[i]; reason != "" {
+			logger.Warn(
+				"planned upload drifted",
+				slog.String("file", upload.LocalPath),
+				slog.String("target yandex disk path", upload.RemotePath),
+				slog.String("reason", reason),
+			)
+		}
+	}
+	for i, del := range plan.Deletes {
+		if reason := drift.Deletes[i]; reason != "" {
+			logger.Warn(
+				"planned delete drifted",
+				slog.String("path", del.Path),
+				slog.String("reason", reason),
+			)
+		}
+	}
+}
+
+// runApply implements `ydu apply plan.json` which executes the
+// operations of a plan written by --dry-run --output. Operations whose
+// files changed since the plan was made are skipped, and nothing is
+// done when more of them changed than --max-drift allows.
+func runApply(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	var maxDrift deleteLimit
+	flags.Var(
+		&maxDrift,
+		"max-drift",
+		"refuse to apply when more operations than this count or percentage no longer match the planned state",
+	)
+	locking := addLockFlags(flags, true)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: ydu apply [--max-drift 0|10|5%] <plan.json>")
+	}
+
+	plan, err := readPlan(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.protectedPath(plan.Target) != "" {
+		return fmt.Errorf("%s is a protected path, upload to it to stage the changes", plan.Target)
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+
+	runTarget = plan.Target
+	lock, err := acquireLock(logger, httpClient, plan.Target, token, *locking)
+	if err != nil {
+		return err
+	}
+	defer lock.release(logger)
+
+	drift, err := findPlanDrift(httpClient, plan, token)
+	if err != nil {
+		return err
+	}
+
+	total := len(plan.Moves) + len(plan.Uploads) + len(plan.Deletes)
+	drifted := drift.count()
+	logDrift(logger, plan, drift)
+	exceeded := drifted > maxDrift.Count
+	if maxDrift.Percent > 0 {
+		exceeded = float64(drifted) > float64(total)*maxDrift.Percent/100
+	}
+	if exceeded {
+		return fmt.Errorf(
+			"%d of %d planned operations no longer match the planned state, more than --max-drift %s allows, plan again",
+			drifted, total, maxDrift.String(),
+		)
+	}
+
+	err = remoteRevisions.Open()
+	if err != nil {
+		logger.Warn(
+			"Error during loading remote revisions",
+			slog.String("message", err.Error()),
+		)
+	}
+	defer saveRemoteRevisions(logger)
+
+	dirs := newRemoteDirs(httpClient, plan.Target, token)
+	failed := 0
+
+	for i, move := range plan.Moves {
+		if drift.Moves[i] != "" {
+			continue
+		}
+
+		err := dirs.ensure(path.Dir(move.To))
+		if err == nil {
+			err = moveResource(httpClient, move.From, move.To, token, false)
+		}
+		if err != nil {
+			failed++
+			logger.Error(
+				"Error during moving renamed file",
+				slog.String("from", move.From),
+				slog.String("to", move.To),
+				slog.String("message", err.Error()),
+			)
+			continue
+		}
+		logger.Info(
+			"renamed file moved",
+			slog.String("from", move.From),
+			slog.String("to", move.To),
+		)
+	}
+
+	options := uploadOptions{
+		Overwrite:  plan.Overwrite,
+		OnConflict: plan.OnConflict,
+		// the replaced files were checked against the plan
+		ForceOverwrite: true,
+	}
+	for i, upload := range plan.Uploads {
+		if drift.Uploads[i] != "" {
+			continue
+		}
+
+		item := uploadItem{
+			LocalPath:  upload.LocalPath,
+			RemotePath: upload.RemotePath,
+			Size:       upload.Size,
+			ModTime:    upload.Modified,
+		}
+		err := uploadQueueItem(logger, httpClient, dirs, &item, token, options)
+		if err != nil {
+			failed++
+			logger.Error(
+				"Error during upload file",
+				append(
+					[]any{
+						slog.String("file", item.LocalPath),
+						slog.String("message", err.Error()),
+					},
+					apiErrorAttrs(err)...,
+				)...,
+			)
+			continue
+		}
+		logger.Info(
+			"file uploaded successfully",
+			slog.String("file", item.LocalPath),
+		)
+	}
+
+	for i, del := range plan.Deletes {
+		if drift.Deletes[i] != "" {
+			continue
+		}
+
+		logger.Info(
+			"deleting remote extra",
+			slog.String("path", del.Path),
+			slog.Bool("permanently", plan.Permanent),
+		)
+		err := deleteResource(httpClient, del.Path, token, plan.Permanent)
+		if err != nil {
+			failed++
+			logger.Error(
+				"Error during deleting remote extra",
+				slog.String("path", del.Path),
+				slog.String("message", err.Error()),
+			)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d planned operations failed", failed, total)
+	}
+
+	logger.Info(
+		"plan applied",
+		slog.Int("moves", len(plan.Moves)-len(drift.Moves)),
+		slog.Int("uploads", len(plan.Uploads)-len(drift.Uploads)),
+		slog.Int("deletes", len(plan.Deletes)-len(drift.Deletes)),
+		slog.Int("drifted", drifted),
+	)
+	return nil
+}
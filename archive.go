@@ -0,0 +1,589 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A read of a remote archive fetches at least archiveBlockSize bytes, so
+// the headers of consecutive small members share a range request. While
+// an archive is read sequentially, e.g. the central directory of a zip,
+// every fetch doubles up to archiveMaxBlockSize.
+const (
+	archiveBlockSize    = 4 << 10
+	archiveMaxBlockSize = 8 << 20
+)
+
+// remoteArchive reads a file on the disk at arbitrary offsets with range
+// requests. It is not safe for concurrent use.
+type remoteArchive struct {
+	httpClient *http.Client
+	path, href string
+	size       int64
+
+	// block is the last fetched part of the file, starting at
+	// blockOffset, fetched the bytes read in total.
+	blockOffset int64
+	block       []byte
+	fetched     int64
+}
+
+// openRemoteArchive prepares reading the file remotePath.
+func openRemoteArchive(
+	httpClient *http.Client,
+	remotePath, token string,
+) (*remoteArchive, error) {
+	res, err := getDiskResource(httpClient, remotePath, token)
+	if err != nil {
+		return nil, err
+	}
+	if res.Type == "dir" {
+		return nil, fmt.Errorf("%s is a folder", remotePath)
+	}
+
+	href, err := downloadURL(httpClient, remotePath, token)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteArchive{
+		httpClient: httpClient,
+		path:       remotePath,
+		href:       href,
+		size:       res.Size,
+	}, nil
+}
+
+func (a *remoteArchive) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= a.size {
+			return n, io.EOF
+		}
+		end := a.blockOffset + int64(len(a.block))
+		if off < a.blockOffset || off >= end {
+			length := archiveBlockSize
+			if off == end {
+				length = min(2*len(a.block), archiveMaxBlockSize)
+			}
+			err := a.fetch(off, max(len(p)-n, length))
+			if err != nil {
+				return n, err
+			}
+		}
+
+		copied := copy(p[n:], a.block[off-a.blockOffset:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// fetch reads length bytes at off into the block, retrying network and
+// server errors.
+func (a *remoteArchive) fetch(off int64, length int) error {
+	block := make([]byte, min(int64(length), a.size-off))
+	for attempt := 1; ; attempt++ {
+		err := a.readRange(block, off)
+		if err == nil {
+			a.blockOffset, a.block = off, block
+			a.fetched += int64(len(block))
+			return nil
+		}
+		if errors.Is(err, errRangesUnsupported) {
+			return err
+		}
+
+		delay, retry := retries().next(err, attempt)
+		if !retry {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+func (a *remoteArchive) readRange(block []byte, off int64) error {
+	body, ranged, err := openDownloadRange(a.httpClient, a.href, off, off+int64(len(block))-1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if !ranged {
+		return errRangesUnsupported
+	}
+	_, err = io.ReadFull(body, block)
+	return err
+}
+
+// archiveEntry is a member of an archive. Link is the target of a
+// symbolic link, HardLink the member a hard link links to.
+type archiveEntry struct {
+	Name     string
+	Size     int64
+	Mode     fs.FileMode
+	Modified time.Time
+	Link     string
+	HardLink string
+
+	// open returns the content of the member, only while it is visited.
+	open func() (io.ReadCloser, error)
+}
+
+// sniffArchive returns the format of the archive starting with header:
+// zip, tar, gzip, bzip2, zstd, xz or "" when it is none of them.
+func sniffArchive(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(header, []byte("\x1f\x8b")):
+		return "gzip"
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return "bzip2"
+	case bytes.HasPrefix(header, []byte("\x28\xb5\x2f\xfd")):
+		return "zstd"
+	case bytes.HasPrefix(header, []byte("\xfd7zXZ\x00")):
+		return "xz"
+	case len(header) >= 263 && string(header[257:262]) == "ustar":
+		return "tar"
+	}
+	return ""
+}
+
+// walkArchive calls visit for every member of the archive a. Zip and
+// uncompressed tar archives are read with range requests, only their
+// central directory respectively member headers and the content of the
+// members that are opened are fetched. Gzip, bzip2 and zstd compressed
+// tar archives have no index and are read completely.
+func walkArchive(
+	logger *slog.Logger,
+	a *remoteArchive,
+	visit func(archiveEntry) error,
+) error {
+	header := make([]byte, 512)
+	n, err := a.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	switch format := sniffArchive(header[:n]); format {
+	case "zip":
+		r, err := zip.NewReader(a, a.size)
+		if err != nil {
+			return fmt.Errorf("error during reading %s: %w", a.path, err)
+		}
+		for _, file := range r.File {
+			entry := archiveEntry{
+				Name:     file.Name,
+				Size:     int64(file.UncompressedSize64),
+				Mode:     file.Mode(),
+				Modified: file.Modified,
+				open:     file.Open,
+			}
+			// zip stores the target of a symbolic link as its content
+			if entry.Mode&fs.ModeSymlink != 0 {
+				entry.Link, err = readZipLink(file)
+				if err != nil {
+					return fmt.Errorf("error during reading %s: %w", a.path, err)
+				}
+			}
+
+			err = visit(entry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "tar":
+		return walkTar(a.path, tar.NewReader(io.NewSectionReader(a, 0, a.size)), visit)
+	case "gzip", "bzip2", "zstd":
+		logger.Warn(
+			"compressed tar archives have no index, reading the whole archive",
+			slog.String("path", a.path),
+			slog.String("size", humanize.Bytes(uint64(a.size))),
+		)
+
+		body, err := openDownload(a.httpClient, a.href)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		var r io.Reader
+		switch format {
+		case "gzip":
+			r, err = gzip.NewReader(body)
+		case "bzip2":
+			r = bzip2.NewReader(body)
+		case "zstd":
+			var decoder *zstd.Decoder
+			decoder, err = zstd.NewReader(body)
+			if err == nil {
+				defer decoder.Close()
+			}
+			r = decoder
+		}
+		if err != nil {
+			return fmt.Errorf("error during reading %s: %w", a.path, err)
+		}
+		a.fetched = a.size
+		return walkTar(a.path, tar.NewReader(r), visit)
+	case "xz":
+		return fmt.Errorf("%s is xz compressed, only tar, tar.gz, tar.bz2, tar.zst and zip archives can be read", a.path)
+	}
+	return fmt.Errorf("%s is not a tar or zip archive", a.path)
+}
+
+// walkTar calls visit for every member read from r.
+func walkTar(
+	archivePath string,
+	r *tar.Reader,
+	visit func(archiveEntry) error,
+) error {
+	for {
+		header, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error during reading %s: %w", archivePath, err)
+		}
+
+		entry := archiveEntry{
+			Name:     header.Name,
+			Size:     header.Size,
+			Mode:     header.FileInfo().Mode(),
+			Modified: header.ModTime,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(r), nil
+			},
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			entry.Link = header.Linkname
+		case tar.TypeLink:
+			entry.HardLink = header.Linkname
+		}
+
+		err = visit(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readZipLink(file *zip.File) (string, error) {
+	r, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	link, err := io.ReadAll(io.LimitReader(r, 4096))
+	return string(link), err
+}
+
+// memberName returns the name of an archive member without a leading
+// "./" or "/" and trailing slash.
+func memberName(name string) string {
+	name = strings.TrimPrefix(name, "./")
+	return strings.Trim(name, "/")
+}
+
+// extractMember writes entry to its path below targetDir. extracted maps
+// the names of the members extracted so far to their local paths, for
+// hard links.
+func extractMember(
+	logger *slog.Logger,
+	targetDir string,
+	entry archiveEntry,
+	extracted map[string]string,
+) error {
+	name := memberName(entry.Name)
+	for _, part := range strings.Split(name, "/") {
+		err := safeLocalName(part)
+		if err != nil {
+			return err
+		}
+	}
+	localPath := filepath.Join(targetDir, filepath.FromSlash(name))
+	err := checkMemberParents(targetDir, name)
+	if err != nil {
+		return err
+	}
+
+	if entry.Mode.IsDir() {
+		return os.MkdirAll(localPath, 0o755)
+	}
+	err = os.MkdirAll(filepath.Dir(localPath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry.HardLink != "":
+		linked, ok := extracted[memberName(entry.HardLink)]
+		if !ok {
+			logger.Warn(
+				"hard link target not extracted, skipping link",
+				slog.String("member", entry.Name),
+				slog.String("target", entry.HardLink),
+			)
+			return nil
+		}
+		os.Remove(localPath)
+		err = os.Link(linked, localPath)
+	case entry.Mode&fs.ModeSymlink != 0:
+		os.Remove(localPath)
+		err = os.Symlink(entry.Link, localPath)
+	case entry.Mode.IsRegular():
+		err = extractFile(localPath, entry)
+	default:
+		logger.Warn(
+			"skipping special file",
+			slog.String("member", entry.Name),
+			slog.String("mode", entry.Mode.String()),
+		)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	extracted[name] = localPath
+	logger.Info(
+		"extracted",
+		slog.String("member", entry.Name),
+		slog.String("local path", localPath),
+	)
+	return nil
+}
+
+// checkMemberParents refuses to extract the member name when one of its
+// parent folders below targetDir is a symbolic link, which an earlier
+// member may have created to point outside of targetDir.
+func checkMemberParents(targetDir, name string) error {
+	parent := targetDir
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("member %s is below the symbolic link %s", name, parent)
+		}
+	}
+	return nil
+}
+
+// extractFile writes the content of the regular file entry to
+// localPath, through a partial file renamed into place once complete.
+func extractFile(localPath string, entry archiveEntry) error {
+	content, err := entry.open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	partialPath := localPath + partialSuffix
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(file, pausableReader{
+		r:    throttledReader{r: content, limiter: &bandwidth},
+		gate: &transfers,
+	})
+	if err == nil && written != entry.Size {
+		err = fmt.Errorf("%s has %d bytes instead of %d", entry.Name, written, entry.Size)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(partialPath, entry.Mode.Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(partialPath, entry.Modified, entry.Modified)
+	}
+	if err == nil {
+		err = os.Rename(partialPath, localPath)
+	}
+	if err != nil {
+		os.Remove(partialPath)
+	}
+	return err
+}
+
+// runArchive implements `ydu archive ls <archive>` which lists the
+// members of a tar or zip archive on the disk without downloading it,
+// and `ydu archive get <archive> <member>...` which extracts only the
+// given members, a folder member with everything below it.
+func runArchive(logger *slog.Logger, args []string) error {
+	const usage = "usage: ydu archive ls <archive> | get [--target-dir dir] <archive> <member>..."
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	flags := flag.NewFlagSet("archive "+args[0], flag.ExitOnError)
+	targetDir := flags.String(
+		"target-dir",
+		".",
+		"local folder get extracts the members to",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args[1:])
+
+	switch {
+	case args[0] == "ls" && flags.NArg() == 1:
+	case args[0] == "get" && flags.NArg() >= 2:
+	default:
+		return errors.New(usage)
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	if args[0] == "get" {
+		handlePauseSignals(logger)
+	}
+
+	remotePath, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+	a, err := openRemoteArchive(httpClient, remotePath, token)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "get" {
+		return getMembers(logger, a, flags.Args()[1:], *targetDir)
+	}
+	return listMembers(logger, a)
+}
+
+// listMembers prints the members of the archive a.
+func listMembers(logger *slog.Logger, a *remoteArchive) error {
+	members := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	err := walkArchive(logger, a, func(entry archiveEntry) error {
+		members++
+
+		size := "-"
+		if !entry.Mode.IsDir() {
+			size = humanize.Bytes(uint64(entry.Size))
+		}
+		name := entry.Name
+		if entry.Link != "" {
+			name += " -> " + entry.Link
+		}
+		if entry.HardLink != "" {
+			name += " link to " + entry.HardLink
+		}
+		_, err := fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\n",
+			entry.Mode,
+			entry.Modified.Local().Format(time.DateTime),
+			size,
+			name,
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"archive listed",
+		slog.String("path", a.path),
+		slog.Int("members", members),
+		slog.String("size", humanize.Bytes(uint64(a.size))),
+		slog.String("read", humanize.Bytes(uint64(a.fetched))),
+	)
+	return nil
+}
+
+// getMembers extracts the members of the archive a named by names, and
+// everything below those that are folders, to targetDir.
+func getMembers(
+	logger *slog.Logger,
+	a *remoteArchive,
+	names []string,
+	targetDir string,
+) error {
+	found := map[string]bool{}
+	extracted := map[string]string{}
+	var size int64
+	err := walkArchive(logger, a, func(entry archiveEntry) error {
+		name := memberName(entry.Name)
+		for _, requested := range names {
+			requested = memberName(requested)
+			if name != requested && !strings.HasPrefix(name, requested+"/") {
+				continue
+			}
+
+			found[requested] = true
+			size += entry.Size
+			return extractMember(logger, targetDir, entry, extracted)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, requested := range names {
+		if !found[memberName(requested)] {
+			missing = append(missing, requested)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("not in %s: %s", a.path, strings.Join(missing, ", "))
+	}
+
+	logger.Info(
+		"archive members extracted",
+		slog.String("path", a.path),
+		slog.Int("members", len(extracted)),
+		slog.String("extracted size", humanize.Bytes(uint64(size))),
+		slog.String("size", humanize.Bytes(uint64(a.size))),
+		slog.String("read", humanize.Bytes(uint64(a.fetched))),
+	)
+	return nil
+}
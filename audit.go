@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// auditRecord is an entry of the audit log: a change ydu made or tried
+// to make on yandex disk.
+type auditRecord struct {
+	Time  time.Time `json:"time"`
+	RunID string    `json:"run_id"`
+	User  string    `json:"user"`
+	Host  string    `json:"host"`
+	// Account identifies the token without revealing it.
+	Account string `json:"account"`
+	Action  string `json:"action"`
+	Path    string `json:"path,omitempty"`
+	From    string `json:"from,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	// Error is empty for successful changes.
+	Error string `json:"error,omitempty"`
+}
+
+// auditActions names the mutating API calls, others are recorded as
+// "<method> <endpoint>".
+var auditActions = map[string]string{
+	"DELETE /resources":                   "delete",
+	"PUT /resources":                      "mkdir",
+	"PATCH /resources":                    "set-properties",
+	"POST /resources/copy":                "copy",
+	"POST /resources/move":                "move",
+	"PUT /resources/publish":              "publish",
+	"PUT /resources/unpublish":            "unpublish",
+	"POST /resources/upload":              "upload-from-url",
+	"DELETE /trash/resources":             "trash-delete",
+	"PUT /trash/resources/restore":        "trash-restore",
+	"POST /public/resources/save-to-disk": "save-public",
+}
+
+// auditMu serializes appends of the concurrent transfers of a run.
+var auditMu sync.Mutex
+
+// auditFile returns the path of the audit log, YDU_AUDIT_LOG or
+// audit.jsonl in the ydu config directory. It is kept out of the cache
+// directory because cleaning caches must not lose the audit trail.
+func auditFile() (string, error) {
+	if p := os.Getenv("YDU_AUDIT_LOG"); p != "" {
+		return p, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "ydu", "audit.jsonl"), nil
+}
+
+// auditAPIRequest records a mutating API request with its outcome.
+func auditAPIRequest(method, endpoint, remotePath, from, token string, err error) {
+	action, found := auditActions[method+" "+endpoint]
+	if !found {
+		action = method + " " + endpoint
+	}
+	audit(auditRecord{
+		Action:  action,
+		Path:    remotePath,
+		From:    from,
+		Account: accountKey(token),
+	}, err)
+}
+
+// auditUpload records the upload of size bytes to remotePath.
+func auditUpload(remotePath, token string, size int64, err error) {
+	audit(auditRecord{
+		Action:  "upload",
+		Path:    remotePath,
+		Size:    size,
+		Account: accountKey(token),
+	}, err)
+}
+
+// audit appends record to the audit log. The log is append-only, ydu
+// never rewrites or truncates it. Failing to write it is reported on
+// stderr but does not fail the change that already happened.
+func audit(record auditRecord, err error) {
+	record.Time = time.Now().UTC()
+	record.RunID = runID
+	record.Host, _ = os.Hostname()
+	if u, userErr := user.Current(); userErr == nil {
+		record.User = u.Username
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	line, _ := json.Marshal(record)
+	line = append(line, '\n')
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	auditPath, writeErr := auditFile()
+	if writeErr == nil {
+		writeErr = appendLine(auditPath, line)
+	}
+	if writeErr != nil {
+		fmt.Fprintf(os.Stderr, "ydu: error during writing audit log: %v\n", writeErr)
+	}
+}
+
+// appendLine appends line to the file at filePath, creating it only
+// readable by the user.
+func appendLine(filePath string, line []byte) error {
+	err := os.MkdirAll(filepath.Dir(filePath), 0o700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(
+		filePath,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0o600,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(line)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readAuditRecords returns the records of the audit log, oldest first.
+func readAuditRecords() ([]auditRecord, error) {
+	auditPath, err := auditFile()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(auditPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record auditRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// runAudit implements `ydu audit ls` which prints the audit log of the
+// changes ydu made on yandex disk.
+func runAudit(logger *slog.Logger, args []string) error {
+	const usage = "usage: ydu audit ls [--since 24h] [--failed] [--json]"
+	if len(args) == 0 || args[0] != "ls" {
+		return errors.New(usage)
+	}
+
+	flags := flag.NewFlagSet("audit ls", flag.ExitOnError)
+	since := flags.String(
+		"since",
+		"",
+		"only show changes of this recent period, e.g. 24h or 7d",
+	)
+	failedOnly := flags.Bool(
+		"failed",
+		false,
+		"only show failed changes",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print the records as JSON lines",
+	)
+	parseFlags(flags, args[1:])
+
+	if flags.NArg() != 0 {
+		return errors.New(usage)
+	}
+
+	var cutoff time.Time
+	if *since != "" {
+		age, err := parseAge(*since)
+		if err != nil {
+			return err
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	records, err := readAuditRecords()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, record := range records {
+		if record.Time.Before(cutoff) || (*failedOnly && record.Error == "") {
+			continue
+		}
+
+		if *jsonOutput {
+			err := encoder.Encode(record)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		result := "ok"
+		if record.Error != "" {
+			result = "failed: " + record.Error
+		}
+		target := record.Path
+		if record.From != "" {
+			target = record.From + " -> " + record.Path
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s@%s\t%s\t%s\t%s\n",
+			record.Time.Local().Format(time.DateTime),
+			record.User,
+			record.Host,
+			record.Action,
+			target,
+			result,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshot folder names sort chronologically, the second layout is used
+// for further snapshots on the same day.
+const (
+	snapshotLayout     = "2006-01-02"
+	snapshotTimeLayout = "2006-01-02-150405"
+)
+
+// expandBackupRoot replaces the {hostname} placeholder of a backup root.
+func expandBackupRoot(root string) (string, error) {
+	if !strings.Contains(root, "{hostname}") {
+		return root, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(root, "{hostname}", hostname), nil
+}
+
+// listSnapshots returns the names of the complete snapshots below root,
+// oldest first. A missing root has no snapshots.
+func listSnapshots(
+	httpClient *http.Client,
+	root, token string,
+) ([]string, error) {
+	dir, err := getDiskResource(httpClient, root, token)
+	if apiErr, ok := err.(*apiError); ok &&
+		apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dir.Type != "dir" {
+		return nil, fmt.Errorf("%s is not a folder", root)
+	}
+
+	var names []string
+	for _, item := range dir.Embedded.Items {
+		if item.Type != "dir" || strings.HasSuffix(item.Name, partialSuffix) {
+			continue
+		}
+		if _, err := time.Parse(snapshotLayout, item.Name); err != nil {
+			if _, err := time.Parse(snapshotTimeLayout, item.Name); err != nil {
+				continue
+			}
+		}
+		names = append(names, item.Name)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// runBackup implements `ydu backup <dir> <remote-root>` which creates a
+// date stamped snapshot of dir below remote-root. Files unchanged since
+// the previous snapshot are copied on the server side, only changed
+// files are uploaded.
+func runBackup(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	rehash := flags.Bool(
+		"rehash",
+		false,
+		"ignore cached checksums of local files and hash them again",
+	)
+	hashers := flags.Int(
+		"hashers",
+		defaultHashers,
+		"number of files hashed concurrently",
+	)
+	unicodeNormalize := unicodeNone
+	flags.Var(
+		&unicodeNormalize,
+		"unicode-normalize",
+		"compare and create file names in this unicode form: nfc, nfd or none",
+	)
+	preservePerms := flags.Bool(
+		"preserve-perms",
+		false,
+		"record the mode, owner and group of files for restore --preserve-perms",
+	)
+	sparse := flags.Bool(
+		"sparse",
+		false,
+		"upload sparse files without their zero blocks, restore expands them again",
+	)
+	hardLinks := flags.Bool(
+		"hard-links",
+		false,
+		"store hard links of files in the snapshot as copies that restore links again",
+	)
+	concurrency := flags.Int(
+		"concurrency",
+		defaultTransferConcurrency,
+		"number of files uploaded at once, the upper bound with --adaptive",
+	)
+	adaptive := flags.Bool(
+		"adaptive",
+		false,
+		"adapt the number of files uploaded at once to the throughput and rate limiting",
+	)
+	var bwlimit bandwidthSchedule
+	flags.Var(
+		&bwlimit,
+		"bwlimit",
+		"limit transfer speed in bytes per second, e.g. 2M, or per time of day: 08:00-18:00=2M,18:00-08:00=unlimited",
+	)
+	excluding := addExcludeFlags(flags)
+	locking := addLockFlags(flags, true)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: ydu backup <dir> <remote-root>")
+	}
+	localDir := flags.Arg(0)
+
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", localDir)
+	}
+
+	root, err := expandBackupRoot(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	excludePatterns, err := excluding.excludes()
+	if err != nil {
+		return err
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+	bandwidth.SetSchedule(bwlimit)
+
+	root, err = resolveRemotePath(httpClient, root, token)
+	if err != nil {
+		return err
+	}
+	runTarget = root
+
+	lock, err := acquireLock(logger, httpClient, root, token, *locking)
+	if err != nil {
+		return err
+	}
+	defer lock.release(logger)
+
+	err = localHashes.Open(*rehash)
+	if err != nil {
+		return err
+	}
+	defer saveHashCache(logger)
+
+	snapshots, err := listSnapshots(httpClient, root, token)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	name := now.Format(snapshotLayout)
+	previous := map[string]resource{}
+	last := ""
+
+	if len(snapshots) > 0 {
+		last = snapshots[len(snapshots)-1]
+		if last >= name {
+			name = now.Format(snapshotTimeLayout)
+		}
+
+		err = walkRemote(
+			httpClient,
+			path.Join(root, last),
+			token,
+			func(rel string, res resource) error {
+				if res.Type != "dir" && rel != manifestName {
+					previous[unicodeNormalize.apply(rel)] = logicalResource(res)
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		logger.Info(
+			"previous snapshot",
+			slog.String("path", path.Join(root, last)),
+			slog.Int("files", len(previous)),
+		)
+	}
+
+	snapshot := path.Join(root, name)
+
+	// the snapshot only gets its final name once it is complete, so an
+	// interrupted backup is never used as the base of the next one
+	partial := snapshot + partialSuffix
+
+	queue, unreadable, err := buildUploadQueue(localDir, partial)
+	if err != nil {
+		return err
+	}
+	// a snapshot missing a file would be taken as complete
+	for _, entry := range unreadable {
+		if !excludePatterns.match(entry.RelPath) {
+			return entry.Err
+		}
+	}
+	queue, _ = excludeQueue(queue, excludePatterns)
+	normalizeQueue(queue, unicodeNormalize)
+
+	dirs := newRemoteDirs(httpClient, root, token)
+	err = dirs.ensure(partial)
+	if err != nil {
+		return err
+	}
+
+	// only files that may be unchanged need a checksum
+	var candidates []string
+	for _, item := range queue {
+		if prev, found := previous[item.RelPath]; found && prev.Size == item.Size {
+			candidates = append(candidates, item.LocalPath)
+		}
+	}
+	checksums := startHashPipeline(candidates, *hashers)
+
+	var links map[int]int
+	if *hardLinks {
+		links = findHardLinks(queue)
+	}
+
+	// unchanged files are copied from the previous snapshot right away,
+	// the others uploaded in parallel and hard links made once the files
+	// they link to are in place
+	uploaded, copied, linked := 0, 0, 0
+	var uploads, linkItems []int
+	for i, item := range queue {
+		if _, found := links[i]; found {
+			linkItems = append(linkItems, i)
+			continue
+		}
+
+		prev, found := previous[item.RelPath]
+		if found && prev.Size == item.Size {
+			checksum, err := checksums.MD5(item.LocalPath)
+			if err != nil {
+				return err
+			}
+
+			if checksum == prev.MD5 {
+				err := dirs.ensure(path.Dir(item.RemotePath))
+				if err != nil {
+					return err
+				}
+
+				err = copyResource(
+					httpClient,
+					prev.Path,
+					item.RemotePath,
+					token,
+					true,
+				)
+				if err != nil {
+					return err
+				}
+
+				// the copy carries the properties of the previous snapshot
+				if recordedHardLink(prev) != "" {
+					_, err = setCustomProperties(
+						httpClient,
+						item.RemotePath,
+						token,
+						map[string]any{hardLinkProperty: nil},
+					)
+					if err != nil {
+						return err
+					}
+				}
+				if *preservePerms {
+					properties, err := permProperties(item.LocalPath)
+					if err != nil {
+						return err
+					}
+					if !recordsProperties(prev, properties) {
+						_, err = setCustomProperties(httpClient, item.RemotePath, token, properties)
+						if err != nil {
+							return err
+						}
+					}
+				}
+				copied++
+				continue
+			}
+		}
+
+		uploads = append(uploads, i)
+	}
+
+	// the first failed upload stops the others from starting
+	var mu sync.Mutex
+	var uploadErr error
+	runLimited(
+		newConcurrencyLimiter(max(1, *concurrency), *adaptive),
+		len(uploads),
+		func(k int) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return uploadErr == nil
+		},
+		func(k int) (int64, error) {
+			item := queue[uploads[k]]
+			err := uploadQueueItem(
+				logger,
+				httpClient,
+				dirs,
+				&item,
+				token,
+				uploadOptions{Overwrite: true, Sparse: *sparse},
+			)
+			if err == nil && *preservePerms {
+				err = recordPermissions(httpClient, item, token)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				uploadErr = cmp.Or(uploadErr, err)
+				return 0, err
+			}
+			logger.Info(
+				"file uploaded successfully",
+				slog.String("file", item.LocalPath),
+			)
+			uploaded++
+			return item.Size, nil
+		},
+	)
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	for _, i := range linkItems {
+		item, j := queue[i], links[i]
+		err := linkRemoteFile(
+			httpClient,
+			dirs,
+			queue[j].RemotePath,
+			item.RemotePath,
+			partial,
+			token,
+			true,
+		)
+		if err != nil {
+			return err
+		}
+		logger.Info(
+			"file linked",
+			slog.String("file", item.LocalPath),
+			slog.String("link of", queue[j].LocalPath),
+		)
+		linked++
+	}
+
+	// the manifest describes the snapshot as it is on the disk
+	manifest := backupManifest{
+		Created:  now.UTC(),
+		Source:   localDir,
+		Snapshot: name,
+		Previous: last,
+		Uploaded: uploaded,
+		Copied:   copied,
+		Linked:   linked,
+	}
+	if abs, err := filepath.Abs(localDir); err == nil {
+		manifest.Source = abs
+	}
+	err = buildManifest(httpClient, partial, token, &manifest)
+	if err != nil {
+		return err
+	}
+	err = uploadManifest(httpClient, partial, token, &manifest)
+	if err != nil {
+		return err
+	}
+
+	err = moveResource(httpClient, partial, snapshot, token, false)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"snapshot created",
+		slog.String("path", snapshot),
+		slog.Int("uploaded", uploaded),
+		slog.Int("copied", copied),
+		slog.Int("linked", linked),
+	)
+	return nil
+}
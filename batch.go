@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// batchOperation is a single entry of a batch file.
+type batchOperation struct {
+	Op          string `yaml:"op"`
+	Path        string `yaml:"path"`
+	From        string `yaml:"from"`
+	To          string `yaml:"to"`
+	Overwrite   bool   `yaml:"overwrite"`
+	Permanently bool   `yaml:"permanently"`
+}
+
+type batchFile struct {
+	Operations []batchOperation `yaml:"operations"`
+}
+
+func (op batchOperation) String() string {
+	switch op.Op {
+	case "upload", "move", "copy":
+		return fmt.Sprintf("%s %s -> %s", op.Op, op.From, op.To)
+	default:
+		return fmt.Sprintf("%s %s", op.Op, op.Path)
+	}
+}
+
+// validate checks that op is known and has the fields it needs.
+func (op batchOperation) validate() error {
+	switch op.Op {
+	case "upload", "move", "copy":
+		if op.From == "" || op.To == "" {
+			return fmt.Errorf("%s needs from and to", op.Op)
+		}
+	case "mkdir", "delete", "publish":
+		if op.Path == "" {
+			return fmt.Errorf("%s needs path", op.Op)
+		}
+	default:
+		return fmt.Errorf(
+			"unknown operation %q, use upload, mkdir, move, copy, delete or publish",
+			op.Op,
+		)
+	}
+	return nil
+}
+
+// resolve resolves the remote paths of op, see resolveRemotePath. The
+// from of an upload is a local path.
+func (op *batchOperation) resolve(httpClient *http.Client, token string) error {
+	var remote []*string
+	switch op.Op {
+	case "upload":
+		remote = []*string{&op.To}
+	case "move", "copy":
+		remote = []*string{&op.From, &op.To}
+	default:
+		remote = []*string{&op.Path}
+	}
+
+	for _, p := range remote {
+		resolved, err := resolveRemotePath(httpClient, *p, token)
+		if err != nil {
+			return err
+		}
+		*p = resolved
+	}
+	return nil
+}
+
+func runBatchOperation(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	op batchOperation,
+	token string,
+) (string, error) {
+	err := op.resolve(httpClient, token)
+	if err != nil {
+		return "", err
+	}
+
+	switch op.Op {
+	case "upload":
+		queue, unreadable, err := buildUploadQueue(op.From, op.To)
+		if err != nil {
+			return "", err
+		}
+		if len(unreadable) > 0 {
+			return "", unreadable[0].Err
+		}
+
+		dirs := newRemoteDirs(httpClient, op.To, token)
+		for _, item := range queue {
+			err := uploadQueueItem(
+				logger,
+				httpClient,
+				dirs,
+				&item,
+				token,
+				uploadOptions{
+					Overwrite:  op.Overwrite,
+					OnConflict: "fail",
+				},
+			)
+			if err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%d files", len(queue)), nil
+	case "mkdir":
+		return "", newRemoteDirs(httpClient, path.Dir(op.Path), token).ensure(op.Path)
+	case "move":
+		return "", moveResource(httpClient, op.From, op.To, token, op.Overwrite)
+	case "copy":
+		return "", copyResource(httpClient, op.From, op.To, token, op.Overwrite)
+	case "delete":
+		return "", deleteResource(httpClient, op.Path, token, op.Permanently)
+	case "publish":
+		return publishResource(httpClient, op.Path, token)
+	}
+
+	return "", op.validate()
+}
+
+// runBatch implements `ydu batch ops.yaml` which executes the operations
+// of a batch file in order and reports the status of each.
+func runBatch(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	keepGoing := flags.Bool(
+		"keep-going",
+		false,
+		"continue with the next operations after a failure",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: ydu batch [--keep-going] <ops.yaml>")
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var batch batchFile
+	err = yaml.Unmarshal(data, &batch)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to parse %s: %v",
+			flags.Arg(0),
+			err,
+		)
+	}
+
+	// refuse to start a half valid batch
+	for i, op := range batch.Operations {
+		err := op.validate()
+		if err != nil {
+			return fmt.Errorf("operation %d: %v", i+1, err)
+		}
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	failed := 0
+
+	for i, op := range batch.Operations {
+		if failed > 0 && !*keepGoing {
+			fmt.Fprintf(w, "%d\tskipped\t%s\t\n", i+1, op)
+			continue
+		}
+
+		started := time.Now()
+		detail, err := runBatchOperation(logger, httpClient, op, token)
+
+		status := "ok"
+		if err != nil {
+			failed++
+			status = "failed"
+			detail = err.Error()
+		}
+
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s\t%s\n",
+			i+1,
+			status,
+			op,
+			time.Since(started).Round(time.Millisecond),
+			detail,
+		)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf(
+			"%d of %d operations failed",
+			failed,
+			len(batch.Operations),
+		)
+	}
+	return nil
+}
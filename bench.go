@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// benchResult is the outcome of uploading one batch of synthetic files.
+type benchResult struct {
+	Concurrency int
+	Bytes       int64
+	Duration    time.Duration
+	// Latency is the average time to obtain an upload link, the API
+	// round trip every file pays before its data is sent.
+	Latency time.Duration
+}
+
+// parseConcurrencyLevels parses a comma separated list of positive
+// integers like "1,2,4,8".
+func parseConcurrencyLevels(s string) ([]int, error) {
+	var levels []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid concurrency level %q", field)
+		}
+		levels = append(levels, n)
+	}
+	return levels, nil
+}
+
+// benchUpload uploads size bytes of random data to dir as concurrency
+// files of equal size in parallel.
+func benchUpload(
+	httpClient *http.Client,
+	dir, token string,
+	size int64,
+	concurrency int,
+) (benchResult, error) {
+	result := benchResult{Concurrency: concurrency}
+	fileSize := size / int64(concurrency)
+
+	var mu sync.Mutex
+	var firstErr error
+	var latency time.Duration
+	var wg sync.WaitGroup
+
+	started := time.Now()
+	for i := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			remotePath := path.Join(dir, fmt.Sprintf("%d-%d.bin", concurrency, i))
+
+			requested := time.Now()
+			uploadURL, err := createRequestOnUpload(
+				httpClient,
+				remotePath,
+				token,
+				true,
+			)
+			linkLatency := time.Since(requested)
+
+			if err == nil {
+				data := io.LimitReader(
+					rand.NewChaCha8([32]byte{byte(i)}),
+					fileSize,
+				)
+				err = uploadStream(httpClient, uploadURL, data, fileSize)
+				auditUpload(remotePath, token, fileSize, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			latency += linkLatency
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	result.Duration = time.Since(started)
+	result.Bytes = fileSize * int64(concurrency)
+	result.Latency = latency / time.Duration(concurrency)
+	return result, firstErr
+}
+
+// runBench implements `ydu bench` which uploads synthetic data to a
+// temporary folder at several concurrency levels, prints the achieved
+// throughput and deletes the folder again.
+func runBench(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	size := flags.String(
+		"size",
+		"256M",
+		"amount of data uploaded per concurrency level",
+	)
+	concurrency := flags.String(
+		"concurrency",
+		"1,2,4,8",
+		"comma separated numbers of parallel uploads to measure",
+	)
+	dir := flags.String(
+		"dir",
+		"",
+		"new remote folder to upload to and delete afterwards, by default ydu-bench-<time> in the root of the disk",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: ydu bench [--size 1G] [--concurrency 1,2,4,8] [--dir path]")
+	}
+
+	sizeBytes, err := humanize.ParseBytes(*size)
+	if err != nil {
+		return fmt.Errorf("invalid --size: %w", err)
+	}
+
+	levels, err := parseConcurrencyLevels(*concurrency)
+	if err != nil {
+		return err
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	if *dir == "" {
+		*dir = "ydu-bench-" + time.Now().Format("20060102-150405")
+	}
+	benchDir, err := resolveRemotePath(httpClient, *dir, token)
+	if err != nil {
+		return err
+	}
+
+	// the folder is permanently deleted afterwards, so it must not hold
+	// anything but the benchmark data
+	params := url.Values{}
+	params.Add("path", benchDir)
+	err = apiRequest(httpClient, http.MethodPut, "/resources", params, token, nil)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) &&
+		apiErr.StatusCode == http.StatusConflict &&
+		apiErr.Code != errDiskPathDoesntExists {
+		return fmt.Errorf("%s already exists, --dir must name a new folder", benchDir)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := deleteResource(httpClient, benchDir, token, true)
+		if err != nil {
+			logger.Warn(
+				"Error during deleting benchmark folder",
+				slog.String("path", benchDir),
+				slog.String("message", err.Error()),
+			)
+		}
+	}()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONCURRENCY\tSIZE\tTIME\tTHROUGHPUT\tLINK LATENCY")
+
+	for _, level := range levels {
+		logger.Info(
+			"benchmarking",
+			slog.Int("concurrency", level),
+			slog.String("size", humanize.Bytes(sizeBytes)),
+		)
+
+		result, err := benchUpload(
+			httpClient,
+			benchDir,
+			token,
+			int64(sizeBytes),
+			level,
+		)
+		if err != nil {
+			w.Flush()
+			return err
+		}
+
+		throughput := float64(result.Bytes) / result.Duration.Seconds()
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s/s\t%s\n",
+			result.Concurrency,
+			humanize.Bytes(uint64(result.Bytes)),
+			result.Duration.Round(time.Millisecond),
+			humanize.Bytes(uint64(throughput)),
+			result.Latency.Round(time.Millisecond),
+		)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// runBudget stops a run between files once the transferred bytes or the
+// elapsed time reach their limit, or the deadline passed. Zero limits
+// are unlimited.
+type runBudget struct {
+	MaxBytes    uint64
+	MaxDuration time.Duration
+	Deadline    time.Time
+
+	started     time.Time
+	transferred uint64
+}
+
+func newRunBudget(maxBytes uint64, maxDuration time.Duration, deadline time.Time) *runBudget {
+	return &runBudget{
+		MaxBytes:    maxBytes,
+		MaxDuration: maxDuration,
+		Deadline:    deadline,
+		started:     time.Now(),
+	}
+}
+
+// parseDeadline parses the --deadline time of day "HH:MM" into its next
+// occurrence after now.
+func parseDeadline(value string, now time.Time) (time.Time, error) {
+	minutes, err := parseClock(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	deadline := time.Date(now.Year(), now.Month(), now.Day(), minutes/60, minutes%60, 0, 0, now.Location())
+	if !deadline.After(now) {
+		deadline = deadline.AddDate(0, 0, 1)
+	}
+	return deadline, nil
+}
+
+// pastDeadline reports whether the deadline of the budget passed.
+func (b *runBudget) pastDeadline() bool {
+	return !b.Deadline.IsZero() && !time.Now().Before(b.Deadline)
+}
+
+// exceededBy returns why transferring item would exceed the budget, or
+// an empty string when it fits.
+func (b *runBudget) exceededBy(item uploadItem) string {
+	if b.pastDeadline() {
+		return fmt.Sprintf(
+			"--deadline %s reached",
+			b.Deadline.Format("15:04"),
+		)
+	}
+
+	if b.MaxDuration > 0 && time.Since(b.started) >= b.MaxDuration {
+		return fmt.Sprintf(
+			"--max-duration %s reached",
+			b.MaxDuration,
+		)
+	}
+
+	if b.MaxBytes > 0 && b.transferred+uint64(item.Size) > b.MaxBytes {
+		return fmt.Sprintf(
+			"--max-transfer %s reached after %s",
+			humanize.Bytes(b.MaxBytes),
+			humanize.Bytes(b.transferred),
+		)
+	}
+
+	return ""
+}
+
+// add accounts an item when its transfer starts, so parallel transfers
+// cannot overrun the budget together.
+func (b *runBudget) add(item uploadItem) {
+	b.transferred += uint64(item.Size)
+}
+
+// release takes back the accounting of an item whose transfer failed.
+func (b *runBudget) release(item uploadItem) {
+	b.transferred -= uint64(item.Size)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// bandwidthWindow limits transfers to Rate bytes per second between
+// Start and End, minutes since midnight. A window with End before Start
+// wraps around midnight, a Rate of 0 is unlimited.
+type bandwidthWindow struct {
+	Start, End int
+	Rate       uint64
+}
+
+func (w bandwidthWindow) contains(minute int) bool {
+	if w.Start <= w.End {
+		return minute >= w.Start && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
+
+// bandwidthSchedule is the value of --bwlimit: either a single rate such
+// as "2M" or time of day windows like "08:00-18:00=2M,18:00-08:00=off".
+type bandwidthSchedule []bandwidthWindow
+
+func (s *bandwidthSchedule) String() string {
+	var windows []string
+	for _, w := range *s {
+		rate := "unlimited"
+		if w.Rate > 0 {
+			rate = humanize.Bytes(w.Rate)
+		}
+		// the end of the day is written as 00:00 so Set reads it back
+		end := w.End % (24 * 60)
+		windows = append(windows, fmt.Sprintf(
+			"%02d:%02d-%02d:%02d=%s",
+			w.Start/60, w.Start%60,
+			end/60, end%60,
+			rate,
+		))
+	}
+	return strings.Join(windows, ",")
+}
+
+func (s *bandwidthSchedule) Set(value string) error {
+	var schedule bandwidthSchedule
+
+	for _, entry := range strings.Split(value, ",") {
+		window, rate, found := strings.Cut(entry, "=")
+		if !found {
+			rate, window = entry, "00:00-00:00"
+		}
+
+		start, end, found := strings.Cut(window, "-")
+		if !found {
+			return fmt.Errorf("expected HH:MM-HH:MM=rate, got %q", entry)
+		}
+
+		var w bandwidthWindow
+		var err error
+		w.Start, err = parseClock(start)
+		if err != nil {
+			return err
+		}
+		w.End, err = parseClock(end)
+		if err != nil {
+			return err
+		}
+		if w.Start == w.End {
+			// the whole day
+			w.Start, w.End = 0, 24*60
+		}
+
+		if rate != "unlimited" && rate != "off" {
+			w.Rate, err = humanize.ParseBytes(rate)
+			if err != nil {
+				return fmt.Errorf("invalid rate %q: %v", rate, err)
+			}
+		}
+
+		schedule = append(schedule, w)
+	}
+
+	*s = schedule
+	return nil
+}
+
+// share returns s with every rate split evenly among n processes
+// transferring at the same time.
+func (s bandwidthSchedule) share(n int) bandwidthSchedule {
+	shared := make(bandwidthSchedule, len(s))
+	for i, w := range s {
+		if w.Rate > 0 {
+			w.Rate = max(1, w.Rate/uint64(n))
+		}
+		shared[i] = w
+	}
+	return shared
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// rate returns the limit in bytes per second at t, 0 is unlimited. The
+// first matching window wins.
+func (s bandwidthSchedule) rate(t time.Time) uint64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s {
+		if w.contains(minute) {
+			return w.Rate
+		}
+	}
+	return 0
+}
+
+// bandwidthLimiter spreads the reads of all transfers of the process so
+// that together they stay below the scheduled rate.
+type bandwidthLimiter struct {
+	mu       sync.Mutex
+	schedule bandwidthSchedule
+	next     time.Time
+}
+
+// bandwidth limits every file transfer of the process.
+var bandwidth bandwidthLimiter
+
+// SetSchedule replaces the schedule of the limiter.
+func (l *bandwidthLimiter) SetSchedule(schedule bandwidthSchedule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.schedule = schedule
+}
+
+// Wait blocks until n more bytes may be transferred.
+func (l *bandwidthLimiter) Wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.schedule.rate(now)
+	if rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.limiter.Wait(n)
+	return n, err
+}
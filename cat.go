@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// runCat implements `ydu cat <remote-path>...` which streams remote
+// files to stdout.
+func runCat(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() == 0 {
+		return errors.New("usage: ydu cat <remote-path>...")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	for _, arg := range flags.Args() {
+		remotePath, err := resolveRemotePath(httpClient, arg, token)
+		if err != nil {
+			return err
+		}
+
+		href, err := downloadURL(httpClient, remotePath, token)
+		if err != nil {
+			return err
+		}
+
+		body, err := openDownload(httpClient, href)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(os.Stdout, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf(
+				"error during streaming %s: %v",
+				remotePath,
+				err,
+			)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// chaos is set by the hidden global --chaos flag and injects faults at
+// the transport layer, so retries and resumption can be exercised end
+// to end before trusting big transfers to them.
+var chaos struct {
+	// ErrorRate is the share of requests answered with a 503 without
+	// reaching the server.
+	ErrorRate float64
+	// DropRate is the share of requests failing with a reset
+	// connection.
+	DropRate float64
+	// MaxDelay delays every request by a random duration up to it.
+	MaxDelay time.Duration
+}
+
+// chaosEnabled reports whether --chaos injects any faults.
+func chaosEnabled() bool {
+	return chaos.ErrorRate > 0 || chaos.DropRate > 0 || chaos.MaxDelay > 0
+}
+
+// setChaos configures chaos from the value of --chaos, e.g.
+// "5xx=0.1,drop=0.05,slow=2s".
+func setChaos(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		key, setting, _ := strings.Cut(entry, "=")
+
+		var err error
+		switch key {
+		case "5xx":
+			chaos.ErrorRate, err = parseRate(setting)
+		case "drop":
+			chaos.DropRate, err = parseRate(setting)
+		case "slow":
+			chaos.MaxDelay, err = time.ParseDuration(setting)
+		default:
+			err = fmt.Errorf("unknown fault %q, use 5xx, drop or slow", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid --chaos %q: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+// parseRate parses a probability between 0 and 1.
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("expected a rate between 0 and 1, got %q", s)
+	}
+	return rate, nil
+}
+
+// chaosTransport injects the faults configured in chaos into the
+// requests it passes on to next.
+type chaosTransport struct {
+	next http.RoundTripper
+}
+
+func (t chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if chaos.MaxDelay > 0 {
+		time.Sleep(rand.N(chaos.MaxDelay))
+	}
+
+	if rand.Float64() < chaos.DropRate {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("chaos: %w", syscall.ECONNRESET)
+	}
+
+	if rand.Float64() < chaos.ErrorRate {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		body := `{"error":"ChaosInjected","description":"fault injected by --chaos","message":"fault injected by --chaos"}`
+		return &http.Response{
+			Status:        "503 Service Unavailable",
+			StatusCode:    http.StatusServiceUnavailable,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(bytes.NewBufferString(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+)
+
+// checkReport is the difference between a local and a remote folder.
+// Paths are slash separated and relative to the compared folders.
+type checkReport struct {
+	OnlyLocal  []string `json:"only_local"`
+	OnlyRemote []string `json:"only_remote"`
+	Differing  []string `json:"differing"`
+}
+
+func (r checkReport) differences() int {
+	return len(r.OnlyLocal) + len(r.OnlyRemote) + len(r.Differing)
+}
+
+// runCheck implements `ydu check <local-dir> <remote-dir>` which compares
+// a local folder with a remote one without transferring anything.
+func runCheck(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print the report as JSON",
+	)
+	rehash := flags.Bool(
+		"rehash",
+		false,
+		"ignore cached checksums of local files and hash them again",
+	)
+	hashers := flags.Int(
+		"hashers",
+		defaultHashers,
+		"number of files hashed concurrently",
+	)
+	compare := compareSizeMtime
+	flags.Var(
+		&compare,
+		"compare",
+		"compare files by size, size+mtime or checksum",
+	)
+	unicodeNormalize := unicodeNone
+	flags.Var(
+		&unicodeNormalize,
+		"unicode-normalize",
+		"compare and create file names in this unicode form: nfc, nfd or none",
+	)
+	excluding := addExcludeFlags(flags)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: ydu check [--json] <local-dir> <remote-dir>")
+	}
+	localDir, remoteDir := flags.Arg(0), flags.Arg(1)
+
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", localDir)
+	}
+
+	excludePatterns, err := excluding.excludes()
+	if err != nil {
+		return err
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	remoteDir, err = resolveRemotePath(httpClient, remoteDir, token)
+	if err != nil {
+		return err
+	}
+
+	err = localHashes.Open(*rehash)
+	if err != nil {
+		return err
+	}
+	defer saveHashCache(logger)
+
+	queue, unreadable, err := buildUploadQueue(localDir, remoteDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range unreadable {
+		if !excludePatterns.match(entry.RelPath) {
+			return entry.Err
+		}
+	}
+	queue, _ = excludeQueue(queue, excludePatterns)
+	normalizeQueue(queue, unicodeNormalize)
+
+	remote := map[string]resource{}
+	err = walkRemote(
+		httpClient,
+		remoteDir,
+		token,
+		func(rel string, res resource) error {
+			if res.Type != "dir" && !excludePatterns.match(rel) {
+				remote[unicodeNormalize.apply(rel)] = logicalResource(res)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	report := checkReport{
+		OnlyLocal:  []string{},
+		OnlyRemote: []string{},
+		Differing:  []string{},
+	}
+
+	// hash ahead only the files whose comparison needs a checksum
+	var candidates []string
+	for _, item := range queue {
+		res, found := remote[item.RelPath]
+		if !found {
+			continue
+		}
+		compare.match(
+			item.Size,
+			item.ModTime,
+			res,
+			func() (string, error) {
+				candidates = append(candidates, item.LocalPath)
+				return "", nil
+			},
+		)
+	}
+	checksums := startHashPipeline(candidates, *hashers)
+
+	for _, item := range queue {
+		res, found := remote[item.RelPath]
+		if !found {
+			report.OnlyLocal = append(report.OnlyLocal, item.RelPath)
+			continue
+		}
+		delete(remote, item.RelPath)
+
+		same, err := compare.match(
+			item.Size,
+			item.ModTime,
+			res,
+			func() (string, error) { return checksums.MD5(item.LocalPath) },
+		)
+		if err != nil {
+			return err
+		}
+		if !same {
+			report.Differing = append(report.Differing, item.RelPath)
+		}
+	}
+
+	for rel := range remote {
+		report.OnlyRemote = append(report.OnlyRemote, rel)
+	}
+
+	sort.Strings(report.OnlyLocal)
+	sort.Strings(report.OnlyRemote)
+	sort.Strings(report.Differing)
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		for _, section := range []struct {
+			mark  string
+			paths []string
+		}{
+			{"+", report.OnlyLocal},
+			{"-", report.OnlyRemote},
+			{"~", report.Differing},
+		} {
+			for _, rel := range section.paths {
+				_, err = fmt.Printf("%s %s\n", section.mark, rel)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if n := report.differences(); n > 0 {
+		return fmt.Errorf("%d differences found", n)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+// Content defined chunking splits a stream at positions chosen by the
+// content itself, so inserting or removing bytes only changes the chunks
+// around the edit and the rest is deduplicated against earlier
+// snapshots.
+const (
+	chunkMinSize = 512 << 10
+	chunkAvgBits = 20 // 1 MiB
+	chunkMaxSize = 8 << 20
+)
+
+// gearTable holds the random values of the gear rolling hash. It is
+// derived from fixed seeds because chunk boundaries, and thereby
+// deduplication, depend on it and must never change.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte("ydu-gear-" + strconv.Itoa(i)))
+		table[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// chunker reads content defined chunks from r.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	// data is the unconsumed part of buf
+	data []byte
+	eof  bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, 2*chunkMaxSize),
+	}
+}
+
+// fill reads until at least chunkMaxSize bytes are buffered or the
+// reader is exhausted.
+func (c *chunker) fill() error {
+	if c.eof || len(c.data) >= chunkMaxSize {
+		return nil
+	}
+
+	n := copy(c.buf, c.data)
+	c.data = c.buf[:n]
+
+	for len(c.data) < chunkMaxSize {
+		m, err := c.r.Read(c.buf[len(c.data):])
+		c.data = c.buf[:len(c.data)+m]
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Next returns the next chunk or io.EOF. The chunk is only valid until
+// the next call.
+func (c *chunker) Next() ([]byte, error) {
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.data) == 0 {
+		return nil, io.EOF
+	}
+
+	size := cutPoint(c.data)
+	chunk := c.data[:size]
+	c.data = c.data[size:]
+	return chunk, nil
+}
+
+// cutPoint returns the length of the chunk at the start of data.
+func cutPoint(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+
+	limit := min(len(data), chunkMaxSize)
+	mask := uint64(1)<<chunkAvgBits - 1
+
+	var hash uint64
+	for i := chunkMinSize; i < limit; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
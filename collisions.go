@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// validCollisionPolicy reports whether s is a known --case-collisions
+// value: warn uploads colliding files as they are, fail refuses to
+// start the upload and rename uploads all but the first file of a
+// collision under a distinct name.
+func validCollisionPolicy(s string) bool {
+	switch s {
+	case "warn", "fail", "rename":
+		return true
+	}
+	return false
+}
+
+// findCaseCollisions returns the groups of queue indexes whose remote
+// paths differ only by case. Such files overwrite each other when
+// restored onto a case-insensitive filesystem like those of macOS and
+// Windows.
+func findCaseCollisions(queue []uploadItem) [][]int {
+	groups := map[string][]int{}
+	var order []string
+	for i, item := range queue {
+		key := strings.ToLower(item.RemotePath)
+		if len(groups[key]) == 1 {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	var collisions [][]int
+	for _, key := range order {
+		collisions = append(collisions, groups[key])
+	}
+	return collisions
+}
+
+// renameCaseCollision returns the path of the n-th file of a collision,
+// "name~n.ext".
+func renameCaseCollision(p string, n int) string {
+	ext := path.Ext(p)
+	return fmt.Sprintf("%s~%d%s", strings.TrimSuffix(p, ext), n, ext)
+}
+
+// resolveCaseCollisions applies the rename policy to the collisions of
+// the queue. The first file of each collision keeps its name.
+func resolveCaseCollisions(queue []uploadItem, collisions [][]int) {
+	for _, collision := range collisions {
+		for n, i := range collision[1:] {
+			item := &queue[i]
+			if item.OriginalPath == "" {
+				item.OriginalPath = item.RelPath
+			}
+			item.RemotePath = renameCaseCollision(item.RemotePath, n+2)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// compareMode is the value of --compare and decides when a local file
+// is considered to have the content of a remote one.
+type compareMode string
+
+const (
+	// compareSize only compares sizes.
+	compareSize compareMode = "size"
+	// compareSizeMtime trusts equal sizes and modification times and
+	// falls back to checksums when the times differ.
+	compareSizeMtime compareMode = "size+mtime"
+	// compareChecksum always compares md5 checksums, for filesystems
+	// with unreliable timestamps.
+	compareChecksum compareMode = "checksum"
+)
+
+func (m *compareMode) String() string {
+	return string(*m)
+}
+
+func (m *compareMode) Set(value string) error {
+	switch mode := compareMode(value); mode {
+	case compareSize, compareSizeMtime, compareChecksum:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf(
+		"expected %s, %s or %s, got %q",
+		compareSize, compareSizeMtime, compareChecksum, value,
+	)
+}
+
+// match reports whether a local file of size bytes last modified at
+// modified has the content of the remote file res. hash is only called
+// when the mode needs the checksum of the local file.
+func (m compareMode) match(
+	size int64,
+	modified time.Time,
+	res resource,
+	hash func() (string, error),
+) (bool, error) {
+	if size != res.Size {
+		return false, nil
+	}
+
+	switch m {
+	case compareSize:
+		return true, nil
+	case compareSizeMtime:
+		// yandex disk stores modification times with second precision
+		if modified.Truncate(time.Second).Equal(recordedModTime(res).Truncate(time.Second)) {
+			return true, nil
+		}
+	}
+
+	// without a remote checksum equal sizes are trusted, unless the
+	// checksum was asked for explicitly: such files are taken as
+	// different rather than unchanged without any check
+	if res.MD5 == "" {
+		return m != compareChecksum, nil
+	}
+
+	checksum, err := hash()
+	if err != nil {
+		return false, err
+	}
+	return checksum == res.MD5, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultTransferConcurrency is the number of files pull and backup
+// transfer at once, the upper bound with --adaptive.
+const defaultTransferConcurrency = 4
+
+// throttled reports whether err is a rate limiting or server error
+// response that may succeed when retried later.
+func throttled(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusTooManyRequests ||
+			apiErr.StatusCode >= 500)
+}
+
+// concurrencyLimiter bounds the number of requests or transfers in
+// flight. A fixed limiter always allows max of them.
+//
+// An adaptive one starts with one and judges the limit by windows of as
+// many completions as the limit allows. It halves the limit right away
+// on rate limiting and server errors, including the 429 responses the
+// API pacer absorbed before they reached the caller, and lowers it by
+// one after a window with more than a quarter of failures. Otherwise it
+// raises the limit by one after every window, up to max, as long as
+// that raised the throughput, bytes per second for transfers and
+// completions per second for plain requests, by at least 5%. A raise
+// that did not pay off is taken back and the limit held for a few
+// windows, so it settles where the connection or the API is saturated.
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	max      int
+	inFlight int
+	adaptive bool
+
+	// the current window
+	windowStart time.Time
+	done        int
+	failed      int
+	bytes       int64
+
+	// rate is the throughput of the last window, raised whether the
+	// limit was raised after it and hold the windows to wait before
+	// raising it again.
+	rate    float64
+	raised  bool
+	hold    int
+	limited int
+}
+
+// limiterHoldWindows is how many windows an adaptive limiter keeps the
+// limit after a raise did not pay off.
+const limiterHoldWindows = 4
+
+func newConcurrencyLimiter(max int, adaptive bool) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		limit:       max,
+		max:         max,
+		adaptive:    adaptive,
+		windowStart: time.Now(),
+	}
+	if adaptive {
+		l.limit = 1
+	}
+	_, l.limited = apiPacer.Stats()
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Acquire blocks until another request may start.
+func (l *concurrencyLimiter) Acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+// Abort gives back a slot taken with Acquire without starting a request.
+func (l *concurrencyLimiter) Abort() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.cond.Broadcast()
+}
+
+// Release ends a request started with Acquire, n is the number of bytes
+// it transferred and err its outcome.
+func (l *concurrencyLimiter) Release(n int64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if l.adaptive {
+		l.adjust(n, err)
+	}
+	l.cond.Broadcast()
+}
+
+func (l *concurrencyLimiter) adjust(n int64, err error) {
+	_, limited := apiPacer.Stats()
+	paced := limited > l.limited
+	l.limited = limited
+
+	if throttled(err) || paced {
+		l.limit = max(1, l.limit/2)
+		l.raised = false
+		l.hold = 0
+		l.resetWindow()
+		return
+	}
+
+	l.done++
+	l.bytes += n
+	if err != nil {
+		l.failed++
+	}
+	if l.done < l.limit {
+		return
+	}
+
+	elapsed := time.Since(l.windowStart).Seconds()
+	rate := float64(l.done) / elapsed
+	if l.bytes > 0 {
+		rate = float64(l.bytes) / elapsed
+	}
+
+	switch {
+	case 4*l.failed > l.done:
+		l.limit = max(1, l.limit-1)
+		l.raised = false
+	case l.raised && rate < l.rate*1.05:
+		// the last raise did not pay off
+		l.limit = max(1, l.limit-1)
+		l.raised = false
+		l.hold = limiterHoldWindows
+	case l.hold > 0:
+		l.hold--
+	case l.limit < l.max:
+		l.limit++
+		l.raised = true
+	default:
+		l.raised = false
+	}
+	l.rate = rate
+	l.resetWindow()
+}
+
+func (l *concurrencyLimiter) resetWindow() {
+	l.windowStart = time.Now()
+	l.done = 0
+	l.failed = 0
+	l.bytes = 0
+}
+
+// Do runs request within the limiter. Adaptive limiters retry throttled
+// requests a few times with growing delays after backing off.
+func (l *concurrencyLimiter) Do(request func() error) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		l.Acquire()
+		err := request()
+		l.Release(0, err)
+
+		if !l.adaptive || !throttled(err) || attempt == 3 {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// runLimited calls transfer for the indexes 0 to n-1 in order with as
+// many calls at once as limiter allows. transfer returns the number of
+// bytes it transferred. start is asked before index i is transferred,
+// once it refuses no further transfers are started.
+func runLimited(
+	limiter *concurrencyLimiter,
+	n int,
+	start func(i int) bool,
+	transfer func(i int) (int64, error),
+) {
+	var mu sync.Mutex
+	next := 0
+	take := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if next == n || !start(next) {
+			// refused indexes stay refused
+			next = n
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+
+	var wg sync.WaitGroup
+	for range limiter.max {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				limiter.Acquire()
+				i, ok := take()
+				if !ok {
+					limiter.Abort()
+					return
+				}
+				bytes, err := transfer(i)
+				limiter.Release(bytes, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
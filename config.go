@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the ydu config file. Its settings are defaults for the
+// upload flags, flags given on the command line take precedence.
+type config struct {
+	// Token is used when YANDEX_DISK_TOKEN is not set. Instead of the
+	// token itself the config may name a file holding it or a command
+	// printing it, e.g. `pass show yandex/token`.
+	Token     string `yaml:"token,omitempty"`
+	TokenFile string `yaml:"token_file,omitempty"`
+	TokenCmd  string `yaml:"token_cmd,omitempty"`
+
+	Target               string   `yaml:"target,omitempty"`
+	Overwrite            bool     `yaml:"overwrite,omitempty"`
+	Order                string   `yaml:"order,omitempty"`
+	MaxFileSize          string   `yaml:"max_file_size,omitempty"`
+	BWLimit              string   `yaml:"bwlimit,omitempty"`
+	PriorityPatterns     []string `yaml:"priority_patterns,omitempty"`
+	SmallFileConcurrency int      `yaml:"small_file_concurrency,omitempty"`
+	LargeFileConcurrency int      `yaml:"large_file_concurrency,omitempty"`
+	Excludes             []string `yaml:"excludes,omitempty"`
+
+	// ReadOnly refuses every request that would modify the disk, like
+	// the global --read-only flag.
+	ReadOnly bool `yaml:"read_only,omitempty"`
+
+	// Protected are remote paths uploads never write to directly: they
+	// upload to a staging copy that `ydu promote` or --auto-promote
+	// moves into place.
+	Protected []string `yaml:"protected,omitempty"`
+
+	// Retry is the retry policy, see retryConfig.
+	Retry *retryConfig `yaml:"retry,omitempty"`
+
+	// Jobs are the named jobs of `ydu run`.
+	Jobs map[string]jobConfig `yaml:"jobs,omitempty"`
+}
+
+// configFile returns the path of the config file, YDU_CONFIG or
+// config.yaml in the ydu config directory.
+func configFile() (string, error) {
+	if p := os.Getenv("YDU_CONFIG"); p != "" {
+		return p, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "ydu", "config.yaml"), nil
+}
+
+// loadConfig reads the config file, a missing file is an empty config.
+func loadConfig() (*config, error) {
+	configPath, err := configFile()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	return &c, nil
+}
+
+// saveConfig writes c to the config file. The file holds the token and
+// is only readable by the user.
+func saveConfig(c *config) (string, error) {
+	configPath, err := configFile()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(configPath), 0o700)
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath := configPath + partialSuffix
+	err = os.WriteFile(tmpPath, data, 0o600)
+	if err != nil {
+		return "", err
+	}
+	return configPath, os.Rename(tmpPath, configPath)
+}
+
+// flagDefaults returns the settings of c as upload flag values.
+func (c *config) flagDefaults() [][2]string {
+	var defaults [][2]string
+	add := func(name, value string) {
+		if value != "" {
+			defaults = append(defaults, [2]string{name, value})
+		}
+	}
+
+	add("target-yandex-disk-path", c.Target)
+	if c.Overwrite {
+		add("overwrite", strconv.FormatBool(c.Overwrite))
+	}
+	add("order", c.Order)
+	add("max-file-size", c.MaxFileSize)
+	add("bwlimit", c.BWLimit)
+	for _, pattern := range c.PriorityPatterns {
+		add("priority-pattern", pattern)
+	}
+	if c.SmallFileConcurrency > 0 {
+		add("small-file-concurrency", strconv.Itoa(c.SmallFileConcurrency))
+	}
+	if c.LargeFileConcurrency > 0 {
+		add("large-file-concurrency", strconv.Itoa(c.LargeFileConcurrency))
+	}
+	for _, pattern := range c.Excludes {
+		add("exclude", pattern)
+	}
+	return defaults
+}
+
+// applyConfigDefaults sets the flags of flags that are configured in c,
+// before the command line is parsed over them.
+func applyConfigDefaults(flags *flag.FlagSet, c *config) error {
+	for _, setting := range c.flagDefaults() {
+		err := flags.Set(setting[0], setting[1])
+		if err != nil {
+			return fmt.Errorf("invalid config value for %s: %w", setting[0], err)
+		}
+	}
+	return nil
+}
+
+// applyConfigGlobals applies the settings of the config file that hold
+// for every command, before the environment and the global flags
+// override them. A config file that cannot be read is reported by the
+// commands reading it.
+func applyConfigGlobals() {
+	c, err := loadConfig()
+	if err != nil || !c.ReadOnly {
+		return
+	}
+
+	configPath, _ := configFile()
+	setReadOnly(true, configPath)
+}
+
+// token returns the token configured in c, reading token_file or
+// running token_cmd when they are set.
+func (c *config) token() (string, error) {
+	if c.TokenFile == "" && c.TokenCmd == "" {
+		return c.Token, nil
+	}
+	return readSecret(c.TokenFile, c.TokenCmd)
+}
+
+// validate reports the first invalid setting of c.
+func (c *config) validate() error {
+	sources := 0
+	for _, setting := range []string{c.Token, c.TokenFile, c.TokenCmd} {
+		if setting != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of token, token_file and token_cmd can be set")
+	}
+
+	if c.Order != "" {
+		err := orderUploadQueue(nil, c.Order, c.PriorityPatterns)
+		if err != nil {
+			return fmt.Errorf("order: %w", err)
+		}
+	} else {
+		err := orderUploadQueue(nil, "alpha", c.PriorityPatterns)
+		if err != nil {
+			return fmt.Errorf("priority_patterns: %w", err)
+		}
+	}
+
+	if c.MaxFileSize != "" {
+		_, err := humanize.ParseBytes(c.MaxFileSize)
+		if err != nil {
+			return fmt.Errorf("max_file_size: %w", err)
+		}
+	}
+
+	if c.BWLimit != "" {
+		var schedule bandwidthSchedule
+		err := schedule.Set(c.BWLimit)
+		if err != nil {
+			return fmt.Errorf("bwlimit: %w", err)
+		}
+	}
+
+	if c.SmallFileConcurrency < 0 || c.LargeFileConcurrency < 0 {
+		return errors.New("small_file_concurrency and large_file_concurrency must not be negative")
+	}
+
+	for _, pattern := range c.Excludes {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("excludes: %q: %w", pattern, err)
+		}
+	}
+
+	err := validateProtected(c.Protected)
+	if err != nil {
+		return fmt.Errorf("protected: %w", err)
+	}
+
+	if c.Retry != nil {
+		err := c.Retry.validate()
+		if err != nil {
+			return fmt.Errorf("retry.%w", err)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Jobs)) {
+		err := c.Jobs[name].validate()
+		if err != nil {
+			return fmt.Errorf("jobs.%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// configFlagKeys maps the upload flags that can be configured to their
+// keys in the config file.
+var configFlagKeys = map[string]string{
+	"target-yandex-disk-path": "target",
+	"overwrite":               "overwrite",
+	"order":                   "order",
+	"max-file-size":           "max_file_size",
+	"bwlimit":                 "bwlimit",
+	"priority-pattern":        "priority_patterns",
+	"small-file-concurrency":  "small_file_concurrency",
+	"large-file-concurrency":  "large_file_concurrency",
+	"exclude":                 "excludes",
+}
+
+// bindConfigFlags defines the configurable upload flags on flags,
+// writing into c. Like in an upload, --priority-pattern adds to the
+// configured patterns, and so does --exclude.
+func bindConfigFlags(flags *flag.FlagSet, c *config) {
+	flags.StringVar(&c.Target, "target-yandex-disk-path", c.Target, "target path on yandex disk")
+	flags.BoolVar(&c.Overwrite, "overwrite", c.Overwrite, "overwrite existing files on yandex disk")
+	flags.StringVar(&c.Order, "order", c.Order, "upload queue order")
+	flags.StringVar(&c.MaxFileSize, "max-file-size", c.MaxFileSize, "skip files larger than this size")
+	flags.StringVar(&c.BWLimit, "bwlimit", c.BWLimit, "limit transfer speed")
+	flags.Var((*stringList)(&c.PriorityPatterns), "priority-pattern", "upload files matching this glob first")
+	flags.IntVar(&c.SmallFileConcurrency, "small-file-concurrency", c.SmallFileConcurrency, "number of small files uploaded in parallel")
+	flags.IntVar(&c.LargeFileConcurrency, "large-file-concurrency", c.LargeFileConcurrency, "number of large files uploaded in parallel")
+	flags.Var((*stringList)(&c.Excludes), "exclude", "leave out files matching this glob")
+}
+
+// redacted returns a copy of c that is safe to print.
+func (c *config) redacted() *config {
+	safe := *c
+	if safe.Token != "" {
+		safe.Token = "[redacted]"
+	}
+	return &safe
+}
+
+// printConfig writes c as YAML to out with the source of every setting
+// as a line comment.
+func printConfig(out io.Writer, c *config, sources map[string]string) error {
+	var doc yaml.Node
+	err := doc.Encode(c)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		source := sources[doc.Content[i].Value]
+		if source == "" {
+			continue
+		}
+		if doc.Content[i+1].Kind == yaml.SequenceNode {
+			doc.Content[i].LineComment = source
+		} else {
+			doc.Content[i+1].LineComment = source
+		}
+	}
+
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&doc)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// runConfig implements `ydu config validate` and `ydu config show
+// [--effective] [upload flags]`. The effective config merges the config
+// file, the YDU_<FLAG> environment variables and the given flags like
+// an upload does.
+func runConfig(logger *slog.Logger, args []string) error {
+	const usage = "usage: ydu config validate | ydu config show [--effective] [upload flags]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	configPath, err := configFile()
+	if err != nil {
+		return err
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "validate":
+		if len(args) != 1 {
+			return errors.New(usage)
+		}
+
+		err = c.validate()
+		if err != nil {
+			return fmt.Errorf("%s: %w", configPath, err)
+		}
+		fmt.Printf("%s is valid\n", configPath)
+		return nil
+	case "show":
+		flags := flag.NewFlagSet("config show", flag.ExitOnError)
+		effective := flags.Bool(
+			"effective",
+			false,
+			"merge the environment and the given upload flags into the config file",
+		)
+		sources := map[string]string{}
+		for _, setting := range c.flagDefaults() {
+			sources[configFlagKeys[setting[0]]] = configPath
+		}
+		if c.Token != "" {
+			sources["token"] = configPath
+		}
+		if c.ReadOnly {
+			sources["read_only"] = configPath
+		}
+
+		// the flags are bound to a copy so they only take effect with
+		// --effective
+		merged := *c
+		merged.PriorityPatterns = append([]string(nil), c.PriorityPatterns...)
+		merged.Excludes = append([]string(nil), c.Excludes...)
+		bindConfigFlags(flags, &merged)
+		fromEnv, err := applyEnvFlags(flags)
+		if err != nil {
+			return err
+		}
+		flags.Parse(args[1:])
+
+		if flags.NArg() != 0 {
+			return errors.New(usage)
+		}
+
+		if *effective {
+			if token := os.Getenv("YANDEX_DISK_TOKEN"); token != "" {
+				merged.Token = token
+				sources["token"] = "YANDEX_DISK_TOKEN"
+			}
+			// the config file, YDU_READ_ONLY and the global
+			// --read-only were applied before the command started
+			merged.ReadOnly = readOnly
+			if readOnlySource != "" {
+				sources["read_only"] = readOnlySource
+			}
+			for _, name := range fromEnv {
+				if key := configFlagKeys[name]; key != "" {
+					sources[key] = flagEnvName(name)
+				}
+			}
+			// flags set from the environment are visited like given
+			// ones, so the command line is parsed again on its own to
+			// tell them apart
+			given := flag.NewFlagSet("config show", flag.ContinueOnError)
+			given.Bool("effective", false, "")
+			bindConfigFlags(given, &config{})
+			given.Parse(args[1:])
+			given.Visit(func(f *flag.Flag) {
+				if key := configFlagKeys[f.Name]; key != "" {
+					sources[key] = "--" + f.Name
+				}
+			})
+
+			err = merged.validate()
+			if err != nil {
+				return err
+			}
+			c = &merged
+		}
+
+		return printConfig(os.Stdout, c.redacted(), sources)
+	default:
+		return errors.New(usage)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxConflictRenames bounds the number of "name (n).ext" candidates that
+// are probed before giving up.
+const maxConflictRenames = 1000
+
+func validConflictStrategy(strategy string) bool {
+	switch strategy {
+	case "fail", "rename", "timestamp":
+		return true
+	}
+	return false
+}
+
+// conflictCandidate returns remotePath with suffix inserted before the
+// file extension, e.g. "dir/name (1).ext".
+func conflictCandidate(remotePath, suffix string) string {
+	dir, name := path.Split(remotePath)
+	ext := path.Ext(name)
+	return dir + strings.TrimSuffix(name, ext) + suffix + ext
+}
+
+// resolveConflict returns the path to upload to when remotePath may
+// already exist. With the fail strategy remotePath is returned as is and
+// the upload request reports the conflict.
+func resolveConflict(
+	httpClient *http.Client,
+	remotePath, token, strategy string,
+) (string, error) {
+	if strategy == "fail" {
+		return remotePath, nil
+	}
+
+	exists, err := remoteExists(httpClient, remotePath, token)
+	if err != nil || !exists {
+		return remotePath, err
+	}
+
+	if strategy == "timestamp" {
+		suffix := time.Now().Format("-20060102-150405")
+		candidate := conflictCandidate(remotePath, suffix)
+
+		exists, err := remoteExists(httpClient, candidate, token)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		remotePath = candidate
+	}
+
+	for n := 1; n <= maxConflictRenames; n++ {
+		candidate := conflictCandidate(remotePath, fmt.Sprintf(" (%d)", n))
+
+		exists, err := remoteExists(httpClient, candidate, token)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf(
+		"no free name found for %s after %d attempts",
+		remotePath,
+		maxConflictRenames,
+	)
+}
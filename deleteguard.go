@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// deleteLimit is the value of --max-delete: the largest number of files
+// a mirror may delete, either absolute like "100" or relative to the
+// files it mirrors into like "50%". It protects against an accidentally
+// empty source wiping the mirror.
+type deleteLimit struct {
+	Count   int
+	Percent float64
+}
+
+func (l *deleteLimit) String() string {
+	if l.Percent > 0 {
+		return strconv.FormatFloat(l.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.Itoa(l.Count)
+}
+
+func (l *deleteLimit) Set(value string) error {
+	if percent, found := strings.CutSuffix(value, "%"); found {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return fmt.Errorf("invalid percentage %q", value)
+		}
+		*l = deleteLimit{Percent: p}
+		return nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return fmt.Errorf("expected a count or a percentage, got %q", value)
+	}
+	*l = deleteLimit{Count: count}
+	return nil
+}
+
+// check returns an error when deleting files of total exceeds the limit.
+func (l deleteLimit) check(deleting, total int) error {
+	exceeded := false
+	if l.Percent > 0 {
+		exceeded = float64(deleting) > float64(total)*l.Percent/100
+	} else {
+		exceeded = deleting > l.Count
+	}
+	if !exceeded {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"refusing to delete %d of %d files, more than --max-delete %s allows, use --force-delete to delete them anyway",
+		deleting, total, l.String(),
+	)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// downloadURL requests a download url for a file on the own disk.
+func downloadURL(
+	httpClient *http.Client,
+	remotePath, token string,
+) (string, error) {
+	params := url.Values{}
+	params.Add("path", remotePath)
+
+	var link apiLink
+	err := apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/resources/download",
+		params,
+		token,
+		&link,
+	)
+	if err != nil {
+		return "", fmt.Errorf(
+			"error during requesting download url for %s: %w",
+			remotePath,
+			err,
+		)
+	}
+
+	return link.Href, nil
+}
+
+// openDownload starts downloading href and returns the response body.
+func openDownload(
+	httpClient *http.Client,
+	href string,
+) (io.ReadCloser, error) {
+	body, _, err := openDownloadRange(httpClient, href, 0, -1)
+	return body, err
+}
+
+// openDownloadRange starts downloading the bytes offset to end of href,
+// the rest of the file when end is negative. It reports whether the
+// server honoured the range, otherwise the body is the complete file.
+func openDownloadRange(
+	httpClient *http.Client,
+	href string,
+	offset, end int64,
+) (io.ReadCloser, bool, error) {
+	req, err := http.NewRequest(
+		http.MethodGet,
+		href,
+		nil,
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf(
+			"error during creating download request: %v",
+			err,
+		)
+	}
+	ranged := offset > 0 || end >= 0
+	if ranged {
+		bytesRange := fmt.Sprintf("bytes=%d-", offset)
+		if end >= 0 {
+			bytesRange += strconv.FormatInt(end, 10)
+		}
+		req.Header.Set("Range", bytesRange)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf(
+			"error during download: %w",
+			err,
+		)
+	}
+
+	partial := resp.StatusCode == http.StatusPartialContent && ranged
+	if resp.StatusCode != http.StatusOK && !partial {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, false, fmt.Errorf(
+			"download error: %w",
+			newAPIError(resp, body),
+		)
+	}
+
+	// the body counts towards the usage as it is read
+	body := struct {
+		io.Reader
+		io.Closer
+	}{countingReader{r: resp.Body, n: &transferUsage.Downloaded}, resp.Body}
+	return body, partial, nil
+}
+
+// downloadResumable downloads href to partialPath. A partial file left
+// by an interrupted download, also by a previous run, is continued
+// rather than downloaded again. Large new files are downloaded in up to
+// streams ranges at once. The result is checked against the size and
+// md5 checksum reported by the API; a mismatch removes the file, so the
+// next attempt starts over. Network and server errors are retried as the
+// retry policy allows.
+func downloadResumable(
+	httpClient *http.Client,
+	href, partialPath string,
+	size int64,
+	md5 string,
+	streams int,
+) error {
+	_, err := os.Stat(partialPath)
+	if errors.Is(err, fs.ErrNotExist) && streams > 1 && size >= multiRangeMinSize {
+		err = downloadRanges(httpClient, href, partialPath, size, streams)
+		if err == nil {
+			return verifyDownload(partialPath, size, md5)
+		}
+		if !errors.Is(err, errRangesUnsupported) {
+			return err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := resumeDownload(httpClient, href, partialPath, size)
+		if err == nil {
+			err = verifyDownload(partialPath, size, md5)
+		}
+		if err == nil {
+			return nil
+		}
+
+		delay, retry := retries().next(err, attempt)
+		if !retry {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// resumeDownload appends the rest of href to partialPath.
+func resumeDownload(
+	httpClient *http.Client,
+	href, partialPath string,
+	size int64,
+) error {
+	var offset int64
+	info, err := os.Stat(partialPath)
+	if err == nil {
+		offset = info.Size()
+		if offset == size {
+			return nil
+		}
+		if offset > size {
+			// left over by another version of the file
+			offset = 0
+		}
+	}
+
+	body, ranged, err := openDownloadRange(httpClient, href, offset, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !ranged {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(partialPath, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to create target file: %v",
+			err,
+		)
+	}
+
+	_, err = io.Copy(file, pausableReader{
+		r:    throttledReader{r: body, limiter: &bandwidth},
+		gate: &transfers,
+	})
+	if err != nil {
+		file.Close()
+		return fmt.Errorf(
+			"error during download: %w",
+			err,
+		)
+	}
+
+	return file.Close()
+}
+
+// verifyDownload checks the downloaded file at localPath against the
+// size and md5 checksum reported by the API and removes it when they
+// differ.
+func verifyDownload(localPath string, size int64, md5 string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	var sum string
+	if info.Size() == size && md5 != "" {
+		sum, err = fileMD5(localPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if info.Size() != size || sum != md5 {
+		os.Remove(localPath)
+		return fmt.Errorf(
+			"downloaded file does not match yandex disk: size %d, md5 %s, expected size %d, md5 %s",
+			info.Size(),
+			sum,
+			size,
+			md5,
+		)
+	}
+	return nil
+}
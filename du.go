@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+)
+
+// remoteUsage returns the total size of the resource at remotePath and
+// calls report for every folder at most maxDepth levels below the root,
+// deepest folders first like du(1) does. A negative maxDepth reports all
+// folders.
+func remoteUsage(
+	httpClient *http.Client,
+	remotePath, token string,
+	depth, maxDepth int,
+	report func(remotePath string, size int64) error,
+) (int64, error) {
+	res, err := getDiskResource(httpClient, remotePath, token)
+	if err != nil {
+		return 0, err
+	}
+
+	if res.Type != "dir" {
+		if depth == 0 {
+			return res.Size, report(remotePath, res.Size)
+		}
+		return res.Size, nil
+	}
+
+	var total int64
+	for _, item := range res.Embedded.Items {
+		if item.Type != "dir" {
+			total += item.Size
+			continue
+		}
+
+		size, err := remoteUsage(
+			httpClient,
+			path.Join(remotePath, item.Name),
+			token,
+			depth+1,
+			maxDepth,
+			report,
+		)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+
+	if maxDepth < 0 || depth <= maxDepth {
+		err := report(remotePath, total)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// runDu implements `ydu du [--depth n] <remote-path>`.
+func runDu(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("du", flag.ExitOnError)
+	maxDepth := flags.Int(
+		"depth",
+		1,
+		"report folders at most this many levels below the path, -1 for all",
+	)
+	bytes := flags.Bool(
+		"bytes",
+		false,
+		"print sizes in bytes",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: ydu du [--depth n] <remote-path>")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	remotePath, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, err = remoteUsage(
+		httpClient,
+		remotePath,
+		token,
+		0,
+		*maxDepth,
+		func(remotePath string, size int64) error {
+			formatted := humanize.Bytes(uint64(size))
+			if *bytes {
+				formatted = fmt.Sprint(size)
+			}
+			_, err := fmt.Fprintf(w, "%s\t%s\n", formatted, remotePath)
+			return err
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
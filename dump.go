@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dumpBodyLimit is how many bytes of a body --dump-http prints by
+// default, dumpFullBodyLimit with --dump-http=full.
+const (
+	dumpBodyLimit     = 4096
+	dumpFullBodyLimit = 64 << 10
+)
+
+// httpDump is set by the global --dump-http flag. A BodyLimit of zero
+// prints only headers.
+var httpDump struct {
+	Enabled   bool
+	BodyLimit int
+}
+
+// setDumpMode configures httpDump from the value of --dump-http.
+func setDumpMode(mode string) error {
+	httpDump.Enabled = true
+	switch mode {
+	case "":
+		httpDump.BodyLimit = dumpBodyLimit
+	case "headers":
+		httpDump.BodyLimit = 0
+	case "full":
+		httpDump.BodyLimit = dumpFullBodyLimit
+	default:
+		return fmt.Errorf(
+			"unknown --dump-http mode %q, use headers or full",
+			mode,
+		)
+	}
+	return nil
+}
+
+// httpTransport returns the transport of the http clients. It sets the
+// User-Agent and request id headers, dumps requests and responses to
+// stderr when --dump-http is set and injects faults with --chaos.
+func httpTransport() http.RoundTripper {
+	transport := baseTransport()
+	if chaosEnabled() {
+		transport = chaosTransport{next: transport}
+	}
+
+	if httpDump.Enabled {
+		transport = &dumpTransport{
+			next:      transport,
+			out:       os.Stderr,
+			bodyLimit: httpDump.BodyLimit,
+		}
+	}
+
+	if statsd != nil {
+		transport = metricsTransport{next: transport}
+	}
+
+	return identifyingTransport{next: transport}
+}
+
+// dumpTransport writes request and response lines, headers and the
+// beginning of text bodies to out. The OAuth token is never written, and
+// bodies only for requests to the API, never for the download and
+// upload hrefs carrying file contents.
+type dumpTransport struct {
+	next      http.RoundTripper
+	out       io.Writer
+	bodyLimit int
+
+	mu sync.Mutex
+}
+
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var dump bytes.Buffer
+	dumpBodies := t.bodyLimit != 0 && isAPIRequest(req)
+
+	fmt.Fprintf(&dump, "> %s %s %s\n", req.Method, req.URL, req.Proto)
+	writeDumpHeaders(&dump, "> ", req.Header)
+
+	// only bodies that can be replayed, file uploads are streamed
+	if req.GetBody != nil && dumpBodies {
+		body, err := req.GetBody()
+		if err == nil {
+			data, _ := io.ReadAll(io.LimitReader(body, int64(t.bodyLimit)))
+			body.Close()
+			writeDumpBody(&dump, "> ", data, t.bodyLimit)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(&dump, "! %v\n", err)
+		t.write(dump.Bytes())
+		return nil, err
+	}
+
+	fmt.Fprintf(&dump, "< %s %s\n", resp.Proto, resp.Status)
+	writeDumpHeaders(&dump, "< ", resp.Header)
+
+	contentType := resp.Header.Get("Content-Type")
+	if dumpBodies &&
+		(strings.Contains(contentType, "json") ||
+			strings.HasPrefix(contentType, "text/")) {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, int64(t.bodyLimit)))
+		writeDumpBody(&dump, "< ", data, t.bodyLimit)
+
+		resp.Body = readCloser{
+			Reader: io.MultiReader(bytes.NewReader(data), resp.Body),
+			Closer: resp.Body,
+		}
+	}
+
+	t.write(dump.Bytes())
+	return resp, nil
+}
+
+// isAPIRequest reports whether req goes to the API rather than to a
+// download or upload href.
+func isAPIRequest(req *http.Request) bool {
+	u := req.URL.String()
+	return u == apiURL || strings.HasPrefix(u, apiURL+"/") ||
+		strings.HasPrefix(u, apiURL+"?")
+}
+
+func (t *dumpTransport) write(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.out.Write(data)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func writeDumpHeaders(w io.Writer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range header[name] {
+			if strings.EqualFold(name, "Authorization") {
+				scheme, _, _ := strings.Cut(value, " ")
+				value = scheme + " [redacted]"
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
+
+func writeDumpBody(w io.Writer, prefix string, data []byte, limit int) {
+	if len(data) == 0 {
+		return
+	}
+
+	truncated := ""
+	if len(data) >= limit {
+		data = data[:limit]
+		truncated = " [truncated]"
+	}
+
+	fmt.Fprintf(w, "%s\n%s%s%s\n", prefix, prefix, data, truncated)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// flagEnvName returns the environment variable of the flag name:
+// YDU_ followed by the name in upper case with dashes replaced by
+// underscores, e.g. YDU_MAX_FILE_SIZE for --max-file-size.
+func flagEnvName(name string) string {
+	return "YDU_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvFlags sets the flags of flags whose environment variable is
+// set and returns their names. Repeatable flags take a comma separated
+// list. The command line is parsed afterwards, so flags still take
+// precedence over the environment.
+func applyEnvFlags(flags *flag.FlagSet) ([]string, error) {
+	var applied []string
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		value, found := os.LookupEnv(flagEnvName(f.Name))
+		if !found || err != nil {
+			return
+		}
+
+		values := []string{value}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			values = splitList(value)
+		}
+
+		for _, v := range values {
+			setErr := flags.Set(f.Name, v)
+			if setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", flagEnvName(f.Name), setErr)
+				return
+			}
+		}
+		applied = append(applied, f.Name)
+	})
+	return applied, err
+}
+
+// parseFlags parses args like flags.Parse after applying the
+// environment, exiting on invalid values like flag.ExitOnError does.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	_, err := applyEnvFlags(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	flags.Parse(args)
+}
+
+// envBool parses the boolean environment variable name like boolean
+// flags are parsed and reports whether it is set.
+func envBool(name string) (value, found bool, err error) {
+	s, found := os.LookupEnv(name)
+	if !found {
+		return false, false, nil
+	}
+
+	value, err = strconv.ParseBool(s)
+	if err != nil {
+		return false, true, fmt.Errorf("invalid %s: %q is not a boolean", name, s)
+	}
+	return value, true, nil
+}
+
+// applyGlobalEnv applies the environment variables of the global flags
+// that are not read where the setting lives.
+func applyGlobalEnv() error {
+	if mode, found := os.LookupEnv("YDU_DUMP_HTTP"); found {
+		if mode == "1" || mode == "true" {
+			mode = ""
+		}
+		err := setDumpMode(mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	notify, found, err := envBool("YDU_NOTIFY")
+	if err != nil {
+		return err
+	}
+	if found {
+		notifyDesktop = notify
+	}
+
+	on, found, err := envBool("YDU_READ_ONLY")
+	if err != nil {
+		return err
+	}
+	if found {
+		setReadOnly(on, "YDU_READ_ONLY")
+	}
+
+	if u := os.Getenv("YDU_API_URL"); u != "" {
+		err := setAPIURL(u)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version := os.Getenv("YDU_IP_VERSION"); version != "" {
+		err := setIPVersion(version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dns := os.Getenv("YDU_DNS"); dns != "" {
+		err := setDNS(dns)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ttl := os.Getenv("YDU_LISTING_TTL"); ttl != "" {
+		err := setListingTTL(ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	if every := os.Getenv("YDU_LOG_EVERY"); every != "" {
+		err := setLogEvery(every)
+		if err != nil {
+			return err
+		}
+	}
+
+	if interval := os.Getenv("YDU_LOG_INTERVAL"); interval != "" {
+		err := setLogInterval(interval)
+		if err != nil {
+			return err
+		}
+	}
+
+	if addr := os.Getenv("YDU_STATSD_ADDR"); addr != "" {
+		err := setStatsD(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n := os.Getenv("YDU_LIST_CONCURRENCY"); n != "" {
+		err := setListConcurrency(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit := os.Getenv("YDU_MAX_MEMORY"); limit != "" {
+		err := setMaxMemory(limit)
+		if err != nil {
+			return err
+		}
+	}
+
+	if faults := os.Getenv("YDU_CHAOS"); faults != "" {
+		return setChaos(faults)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultExcludes are transient files that are not worth uploading:
+// temporary and partial files, office lock files, folder metadata of
+// macOS and Windows and editor swap and backup files.
+var defaultExcludes = []string{
+	"*.tmp",
+	"*.partial",
+	"*" + partialSuffix,
+	"~$*",
+	".~lock.*#",
+	".DS_Store",
+	"Thumbs.db",
+	".*.swp",
+	".*.swo",
+	"*~",
+	".#*",
+	"#*#",
+	// ydu's own description of a backup snapshot
+	manifestName,
+}
+
+// excludes are glob patterns of files left out of directory uploads. A
+// pattern is matched against the base name, or against the slash
+// separated relative path when it contains a slash.
+type excludes []string
+
+// match reports whether the file at the relative path rel is excluded.
+func (e excludes) match(rel string) bool {
+	for _, pattern := range e {
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeFlags are the values of the exclude flags.
+type excludeFlags struct {
+	Patterns   stringList
+	NoDefaults bool
+}
+
+// addExcludeFlags defines the exclude flags on flags.
+func addExcludeFlags(flags *flag.FlagSet) *excludeFlags {
+	f := &excludeFlags{}
+	flags.Var(
+		&f.Patterns,
+		"exclude",
+		"leave out files matching this glob, may be repeated",
+	)
+	flags.BoolVar(
+		&f.NoDefaults,
+		"no-default-excludes",
+		false,
+		"also upload temporary and partial files, office lock files, .DS_Store and editor swap files",
+	)
+	return f
+}
+
+// excludes returns the patterns selected by the flags.
+func (f *excludeFlags) excludes() (excludes, error) {
+	var e excludes
+	if !f.NoDefaults {
+		e = append(e, defaultExcludes...)
+	}
+
+	for _, pattern := range f.Patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid --exclude %q: %w", pattern, err)
+		}
+		e = append(e, pattern)
+	}
+	return e, nil
+}
+
+// excludeQueue removes the items matching e from queue and returns the
+// remaining and the excluded items.
+func excludeQueue(queue []uploadItem, e excludes) ([]uploadItem, []uploadItem) {
+	var kept, excluded []uploadItem
+	for _, item := range queue {
+		if e.match(item.RelPath) {
+			excluded = append(excluded, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	return kept, excluded
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// exitPartialFailure is the exit code of an upload run where some files
+// failed and the rest were uploaded.
+const exitPartialFailure = 2
+
+// failureManifest lists the files that failed in an upload run, it is
+// read back by --retry-failed.
+type failureManifest struct {
+	Target string         `json:"target"`
+	Failed []failedUpload `json:"failed"`
+}
+
+type failedUpload struct {
+	LocalPath  string `json:"local_path"`
+	RemotePath string `json:"remote_path"`
+	Size       int64  `json:"size"`
+	Error      string `json:"error"`
+}
+
+// writeFailureManifest writes the failed records of a run to
+// manifestPath.
+func writeFailureManifest(
+	manifestPath, target string,
+	records []transferRecord,
+) error {
+	manifest := failureManifest{
+		Target: target,
+		Failed: []failedUpload{},
+	}
+	for _, record := range records {
+		if record.Err == nil {
+			continue
+		}
+		manifest.Failed = append(manifest.Failed, failedUpload{
+			LocalPath:  record.LocalPath,
+			RemotePath: record.RemotePath,
+			Size:       record.Size,
+			Error:      record.Err.Error(),
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(manifestPath, append(data, '\n'), 0o644)
+}
+
+// buildRetryQueue builds the upload queue from the failed files of a
+// manifest and returns it together with the target of the failed run.
+func buildRetryQueue(manifestPath string) ([]uploadItem, string, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var manifest failureManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	queue := make([]uploadItem, 0, len(manifest.Failed))
+	for _, failed := range manifest.Failed {
+		info, err := os.Stat(failed.LocalPath)
+		if err != nil {
+			return nil, "", err
+		}
+
+		queue = append(queue, uploadItem{
+			LocalPath:  failed.LocalPath,
+			RelPath:    path.Base(failed.RemotePath),
+			RemotePath: failed.RemotePath,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+		})
+	}
+
+	return queue, manifest.Target, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fanOutTarget is an additional destination of an upload given with
+// --also-to: "local:<dir>" copies into a local folder, "<account>=<path>"
+// uploads with the token of a named account and a plain path uploads
+// with the default token.
+type fanOutTarget struct {
+	Spec  string
+	Root  string
+	Local bool
+
+	token string
+	dirs  *remoteDirs
+
+	Uploaded int
+	Failed   int
+}
+
+func newFanOutTarget(
+	httpClient *http.Client,
+	spec string,
+) (*fanOutTarget, error) {
+	target := &fanOutTarget{Spec: spec}
+
+	if dir, found := strings.CutPrefix(spec, "local:"); found {
+		target.Root = dir
+		target.Local = true
+		return target, nil
+	}
+
+	account, root, found := strings.Cut(spec, "=")
+	if !found {
+		account, root = "", spec
+	}
+
+	token, err := accountToken(account)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = resolveRemotePath(httpClient, root, token)
+	if err != nil {
+		return nil, err
+	}
+
+	target.Root = root
+	target.token = token
+	target.dirs = newRemoteDirs(httpClient, root, token)
+	return target, nil
+}
+
+// upload transfers item, whose remote path is below primaryRoot, to the
+// same place below the root of the target.
+func (t *fanOutTarget) upload(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	item uploadItem,
+	primaryRoot string,
+	options uploadOptions,
+) error {
+	rel := strings.TrimPrefix(
+		strings.TrimPrefix(item.RemotePath, primaryRoot),
+		"/",
+	)
+
+	if t.Local {
+		return copyLocalFile(
+			item.LocalPath,
+			filepath.Join(t.Root, filepath.FromSlash(rel)),
+		)
+	}
+
+	item.RemotePath = path.Join(t.Root, rel)
+	return uploadQueueItem(
+		logger,
+		httpClient,
+		t.dirs,
+		&item,
+		t.token,
+		options,
+	)
+}
+
+// copyLocalFile copies src to dst, creating the parents of dst. dst is
+// only replaced once the copy is complete.
+func copyLocalFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		return err
+	}
+
+	partialPath := dst + partialSuffix
+	out, err := os.Create(partialPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+
+	return os.Rename(partialPath, dst)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+)
+
+// listFiles pages through the flat list of all files on the disk with
+// the attributes fields, calling visit for every file. media types are
+// passed to the API as a comma separated filter.
+func listFiles(
+	httpClient *http.Client,
+	mediaType, token string,
+	fields []string,
+	visit func(res resource) error,
+) error {
+	for offset := 0; ; offset += listPageSize {
+		params := url.Values{}
+		params.Set("limit", strconv.Itoa(listPageSize))
+		params.Set("offset", strconv.Itoa(offset))
+		params.Set("fields", listFieldsParam(fields))
+		if mediaType != "" {
+			params.Set("media_type", mediaType)
+		}
+
+		var page resourceList
+		err := apiRequest(
+			httpClient,
+			http.MethodGet,
+			"/resources/files",
+			params,
+			token,
+			&page,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Items {
+			err := visit(item)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(page.Items) < listPageSize {
+			return nil
+		}
+	}
+}
+
+// runFind implements `ydu find [flags] [path]`.
+func runFind(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("find", flag.ExitOnError)
+	name := flags.String(
+		"name",
+		"",
+		"glob the file name has to match, e.g. '*.sql.gz'",
+	)
+	mediaType := flags.String(
+		"media-type",
+		"",
+		"comma separated media types, e.g. archive, video, document",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print matching files as JSON lines",
+	)
+	fieldList := flags.String(
+		"fields",
+		"",
+		"only fetch and print these comma separated attributes, e.g. path,size,md5",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() > 1 {
+		return errors.New("usage: ydu find [--name glob] [--media-type type] [--fields a,b] [path]")
+	}
+
+	fields := resourceFields
+	var printed []string
+	if *fieldList != "" {
+		var err error
+		printed, err = parseFields(*fieldList)
+		if err != nil {
+			return err
+		}
+		// the path and name are matched against the root and --name
+		fields = slices.Clone(printed)
+		for _, field := range []string{"path", "name"} {
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	if _, err := path.Match(*name, ""); err != nil {
+		return fmt.Errorf("invalid --name pattern: %v", err)
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	root, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+	root = diskPath(root)
+
+	encoder := json.NewEncoder(os.Stdout)
+	found := 0
+
+	err = listFiles(
+		httpClient,
+		*mediaType,
+		token,
+		fields,
+		func(res resource) error {
+			if !isBelow(res.Path, root) {
+				return nil
+			}
+			if *name != "" {
+				if ok, _ := path.Match(*name, res.Name); !ok {
+					return nil
+				}
+			}
+
+			found++
+			if printed != nil {
+				return printFields(os.Stdout, res, printed, *jsonOutput)
+			}
+			if *jsonOutput {
+				return encoder.Encode(res)
+			}
+			_, err := fmt.Println(res.Path)
+			return err
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"search finished",
+		slog.Int("found", found),
+	)
+	return nil
+}
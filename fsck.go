@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fsckProblem is an inconsistency ydu fsck found below the checked
+// path.
+type fsckProblem struct {
+	Problem  string `json:"problem"`
+	Path     string `json:"path"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// checkSnapshotManifest compares the manifest of the backup snapshot
+// snapshotDir with the files below it.
+func checkSnapshotManifest(
+	httpClient *http.Client,
+	snapshotDir, token string,
+	files map[string]resource,
+) ([]fsckProblem, error) {
+	m, err := readManifest(httpClient, snapshotDir, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []fsckProblem
+	listed := map[string]bool{}
+	for _, file := range m.Files {
+		p := path.Join(snapshotDir, file.Path)
+		listed[p] = true
+
+		res, found := files[p]
+		if !found {
+			problems = append(problems, fsckProblem{
+				Problem: "missing",
+				Path:    p,
+				Detail:  "listed in the manifest of " + snapshotDir,
+			})
+			continue
+		}
+
+		storedSize := file.Size
+		if file.Encoding == "sparse" {
+			storedSize = file.StoredSize
+		}
+		logical := logicalResource(res)
+		switch {
+		case res.Size != storedSize:
+			problems = append(problems, fsckProblem{
+				Problem: "size mismatch",
+				Path:    p,
+				Detail:  fmt.Sprintf("%d bytes, the manifest says %d", res.Size, storedSize),
+			})
+		case logical.MD5 != file.MD5:
+			problems = append(problems, fsckProblem{
+				Problem: "checksum mismatch",
+				Path:    p,
+				Detail:  fmt.Sprintf("md5 %s, the manifest says %s", logical.MD5, file.MD5),
+			})
+		case file.SHA256 != "" && res.SHA256 != "" && res.SHA256 != file.SHA256:
+			problems = append(problems, fsckProblem{
+				Problem: "checksum mismatch",
+				Path:    p,
+				Detail:  fmt.Sprintf("sha256 %s, the manifest says %s", res.SHA256, file.SHA256),
+			})
+		}
+	}
+
+	for p := range files {
+		if strings.HasPrefix(p, snapshotDir+"/") && !listed[p] &&
+			p != path.Join(snapshotDir, manifestName) {
+			problems = append(problems, fsckProblem{
+				Problem: "unlisted",
+				Path:    p,
+				Detail:  "not in the manifest of " + snapshotDir,
+			})
+		}
+	}
+	return problems, nil
+}
+
+// checkRepo checks that the chunks the snapshots of the repository r
+// refer to exist and add up to the sizes of the files, and finds the
+// chunks no snapshot refers to. With readData every referenced chunk is
+// downloaded and its id verified. With repair damaged chunks, which the
+// next backup of their data stores again, and orphaned chunks older
+// than orphanAge are moved to the trash.
+func checkRepo(
+	logger *slog.Logger,
+	r *repo,
+	files map[string]resource,
+	readData, repair bool,
+	orphanAge time.Duration,
+) ([]fsckProblem, error) {
+	chunksDir := path.Join(r.root, "chunks")
+	stored := map[string]resource{}
+	for p, res := range files {
+		if strings.HasPrefix(p, chunksDir+"/") {
+			stored[res.Name] = res
+		}
+	}
+
+	names, err := r.snapshotNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []fsckProblem
+	referenced := map[string]bool{}
+	damagedSnapshots := false
+	for _, name := range names {
+		snapshotPath := path.Join(r.root, "snapshots", name+".json")
+		snapshot, err := r.readSnapshot(name)
+		if err != nil {
+			damagedSnapshots = true
+			problems = append(problems, fsckProblem{
+				Problem: "damaged snapshot",
+				Path:    snapshotPath,
+				Detail:  err.Error(),
+			})
+			continue
+		}
+
+		for _, file := range snapshot.Files {
+			var size int64
+			complete := true
+			for _, id := range file.Chunks {
+				res, found := stored[id]
+				if !found {
+					complete = false
+					if !referenced[id] {
+						problems = append(problems, fsckProblem{
+							Problem: "missing chunk",
+							Path:    r.chunkPath(id),
+							Detail:  fmt.Sprintf("of %s in snapshot %s", file.Path, name),
+						})
+					}
+				} else {
+					size += res.Size - repoBlobOverhead
+				}
+				referenced[id] = true
+			}
+
+			if complete && size != file.Size {
+				problems = append(problems, fsckProblem{
+					Problem: "size mismatch",
+					Path:    snapshotPath,
+					Detail:  fmt.Sprintf("the chunks of %s hold %d bytes, the snapshot says %d", file.Path, size, file.Size),
+				})
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(stored))
+	for id := range stored {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if readData {
+		for _, id := range ids {
+			if !referenced[id] {
+				continue
+			}
+
+			blob, err := downloadBlob(r.httpClient, r.chunkPath(id), r.token)
+			if err != nil {
+				return problems, err
+			}
+			chunk, err := r.open(blob)
+			if err == nil && r.chunkID(chunk) == id {
+				continue
+			}
+
+			problem := fsckProblem{
+				Problem: "damaged chunk",
+				Path:    r.chunkPath(id),
+				Detail:  "its content does not match its id",
+			}
+			if repair {
+				problem.Repaired = repairObject(logger, r.httpClient, problem.Path, r.token)
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	// the chunks of a damaged snapshot cannot be told from orphans
+	if repair && damagedSnapshots {
+		logger.Warn("not removing orphaned chunks, some snapshots are damaged")
+	}
+	for _, id := range ids {
+		res := stored[id]
+		if referenced[id] || time.Since(res.Modified) < orphanAge {
+			continue
+		}
+
+		problem := fsckProblem{
+			Problem: "orphaned chunk",
+			Path:    r.chunkPath(id),
+			Detail:  "no snapshot refers to it",
+		}
+		if repair && !damagedSnapshots {
+			problem.Repaired = repairObject(logger, r.httpClient, problem.Path, r.token)
+		}
+		problems = append(problems, problem)
+	}
+
+	return problems, nil
+}
+
+// repairObject moves the inconsistent object remotePath to the trash
+// and reports whether that succeeded.
+func repairObject(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	remotePath, token string,
+) bool {
+	err := deleteResource(httpClient, remotePath, token, false)
+	if err != nil {
+		logger.Error(
+			"Error during repairing",
+			slog.String("path", remotePath),
+			slog.String("message", err.Error()),
+		)
+		return false
+	}
+
+	logger.Info(
+		"moved to the trash",
+		slog.String("path", remotePath),
+	)
+	return true
+}
+
+// runFsck implements `ydu fsck <remote-path>` which checks the backup
+// snapshots and repositories below a remote path against their
+// manifests and snapshots.
+func runFsck(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool(
+		"repair",
+		false,
+		"move damaged and orphaned repository chunks to the trash",
+	)
+	readData := flags.Bool(
+		"read-data",
+		false,
+		"download and verify every repository chunk instead of only checking that it exists",
+	)
+	olderThan := flags.String(
+		"older-than",
+		"1d",
+		"only report chunks no snapshot refers to when modified longer ago than this, so running backups are not disturbed",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print the problems as JSON lines",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: ydu fsck [--repair] [--read-data] [--older-than 1d] [--json] <remote-path>")
+	}
+
+	orphanAge, err := parseAge(*olderThan)
+	if err != nil {
+		return err
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	root, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]resource{}
+	dirs := map[string]bool{}
+	var snapshots, repos []string
+	err = walkRemote(
+		httpClient,
+		root,
+		token,
+		func(rel string, res resource) error {
+			p := path.Join(root, rel)
+			if res.Type == "dir" {
+				dirs[p] = true
+				return nil
+			}
+
+			files[p] = res
+			switch res.Name {
+			case manifestName:
+				snapshots = append(snapshots, path.Dir(p))
+			case "config.json":
+				repos = append(repos, path.Dir(p))
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	var problems []fsckProblem
+	for _, snapshotDir := range snapshots {
+		found, err := checkSnapshotManifest(httpClient, snapshotDir, token, files)
+		if err != nil {
+			found = []fsckProblem{{
+				Problem: "damaged manifest",
+				Path:    path.Join(snapshotDir, manifestName),
+				Detail:  err.Error(),
+			}}
+		}
+		problems = append(problems, found...)
+	}
+
+	checkedRepos := 0
+	for _, repoRoot := range repos {
+		if !dirs[path.Join(repoRoot, "chunks")] {
+			continue
+		}
+
+		password, err := repoPassword()
+		if err != nil {
+			logger.Warn(
+				"skipping repository",
+				slog.String("path", repoRoot),
+				slog.String("message", err.Error()),
+			)
+			continue
+		}
+		r, err := openRepo(httpClient, repoRoot, token, password)
+		if err != nil {
+			return fmt.Errorf("%s: %w", repoRoot, err)
+		}
+
+		found, err := checkRepo(logger, r, files, *readData, *repair, orphanAge)
+		problems = append(problems, found...)
+		if err != nil {
+			return err
+		}
+		checkedRepos++
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Path < problems[j].Path
+	})
+
+	encoder := json.NewEncoder(os.Stdout)
+	unrepaired := 0
+	for _, problem := range problems {
+		if !problem.Repaired {
+			unrepaired++
+		}
+
+		if *jsonOutput {
+			err = encoder.Encode(problem)
+		} else {
+			detail := problem.Detail
+			if problem.Repaired {
+				detail += ", moved to the trash"
+			}
+			_, err = fmt.Printf("%s\t%s\t%s\n", problem.Problem, problem.Path, detail)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info(
+		"fsck finished",
+		slog.String("path", root),
+		slog.Int("snapshots", len(snapshots)),
+		slog.Int("repositories", checkedRepos),
+		slog.Int("files", len(files)),
+		slog.Int("problems", len(problems)),
+		slog.Int("repaired", len(problems)-unrepaired),
+	)
+
+	if unrepaired > 0 {
+		return fmt.Errorf("%d problems found", unrepaired)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// runGc implements `ydu gc [--older-than age] [remote-path]` which
+// removes temporary .ydu-partial objects left behind by crashed atomic
+// uploads and interrupted backups.
+func runGc(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	olderThan := flags.String(
+		"older-than",
+		"1d",
+		"only remove objects modified longer ago than this, so running uploads are kept",
+	)
+	dryRun := flags.Bool(
+		"dry-run",
+		false,
+		"only print what would be removed",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() > 1 {
+		return errors.New("usage: ydu gc [--older-than age] [--dry-run] [remote-path]")
+	}
+
+	maxAge, err := parseAge(*olderThan)
+	if err != nil {
+		return err
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	root, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	var stale []resource
+	err = walkRemote(
+		httpClient,
+		root,
+		token,
+		func(rel string, res resource) error {
+			if !strings.HasSuffix(res.Name, partialSuffix) ||
+				time.Since(res.Modified) < maxAge {
+				return nil
+			}
+			// a partial folder is removed as a whole
+			for _, parent := range stale {
+				if isBelow(res.Path, parent.Path) {
+					return nil
+				}
+			}
+			stale = append(stale, res)
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range stale {
+		logger.Info(
+			"removing stale partial upload",
+			slog.String("path", res.Path),
+			slog.Time("modified", res.Modified),
+			slog.Bool("dry run", *dryRun),
+		)
+		if *dryRun {
+			continue
+		}
+
+		err := deleteResource(httpClient, res.Path, token, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info(
+		"gc finished",
+		slog.String("path", root),
+		slog.Int("removed", len(stale)),
+	)
+	return nil
+}
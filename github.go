@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// inGitHubActions reports whether ydu runs inside a GitHub Actions job.
+func inGitHubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+// escapeWorkflowData escapes a value for use in a workflow command
+// message, see
+// https://docs.github.com/actions/reference/workflow-commands-for-github-actions
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer(
+		"%", "%25",
+		"\r", "%0D",
+		"\n", "%0A",
+	).Replace(s)
+}
+
+func escapeWorkflowProperty(s string) string {
+	return strings.NewReplacer(
+		"%", "%25",
+		"\r", "%0D",
+		"\n", "%0A",
+		":", "%3A",
+		",", "%2C",
+	).Replace(s)
+}
+
+func escapeMarkdownCell(s string) string {
+	return strings.NewReplacer(
+		"|", "\\|",
+		"\n", " ",
+	).Replace(s)
+}
+
+// writeGitHubActionsReport emits an ::error annotation for every failed
+// transfer to w and appends a markdown table of all transfers to the job
+// summary file when GITHUB_STEP_SUMMARY is set.
+func writeGitHubActionsReport(w io.Writer, records []transferRecord) error {
+	for _, record := range records {
+		if record.Err == nil {
+			continue
+		}
+
+		fmt.Fprintf(
+			w,
+			"::error title=%s::%s\n",
+			escapeWorkflowProperty("upload of "+record.LocalPath+" failed"),
+			escapeWorkflowData(record.Err.Error()),
+		)
+	}
+
+	summaryPath := os.Getenv("GITHUB_STEP_SUMMARY")
+	if summaryPath == "" {
+		return nil
+	}
+
+	var summary strings.Builder
+	summary.WriteString("### ydu uploads\n\n")
+	summary.WriteString("| File | Yandex Disk path | Size | Duration | Result |\n")
+	summary.WriteString("| --- | --- | --- | --- | --- |\n")
+
+	for _, record := range records {
+		result := "✅ uploaded"
+		if record.SkipReason != "" {
+			result = "⏭️ skipped: " + record.SkipReason
+		}
+		if record.Err != nil {
+			result = "❌ " + record.Err.Error()
+		}
+
+		fmt.Fprintf(
+			&summary,
+			"| %s | %s | %s | %s | %s |\n",
+			escapeMarkdownCell(record.LocalPath),
+			escapeMarkdownCell(record.RemotePath),
+			humanize.Bytes(uint64(record.Size)),
+			record.Duration.Round(10*time.Millisecond),
+			escapeMarkdownCell(result),
+		)
+	}
+	summary.WriteString("\n")
+
+	file, err := os.OpenFile(
+		summaryPath,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0o644,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to open job summary file: %v",
+			err,
+		)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(summary.String())
+	return err
+}
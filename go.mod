@@ -2,4 +2,11 @@ module github.com/foi/ydu
 
 go 1.24.0
 
-require github.com/dustin/go-humanize v1.0.1
+require (
+	github.com/dustin/go-humanize v1.0.1
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.41.0
+	golang.org/x/text v0.25.0
+)
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// hardLinkProperty is the custom property of a file uploaded as a hard
+// link of another file, holding the path of that file relative to the
+// upload root.
+const hardLinkProperty = "ydu_hardlink"
+
+// findHardLinks returns the queue items that are hard links of an
+// earlier item, mapped to the index of that item.
+func findHardLinks(queue []uploadItem) map[int]int {
+	links := map[int]int{}
+	first := map[string]int{}
+	for i, item := range queue {
+		info, err := os.Stat(item.LocalPath)
+		if err != nil {
+			continue
+		}
+		id := fileLinkID(info)
+		if id == "" {
+			continue
+		}
+
+		if j, found := first[id]; found {
+			links[i] = j
+			continue
+		}
+		first[id] = i
+	}
+	return links
+}
+
+// linkRemoteFile creates remotePath as a copy of the already uploaded
+// primaryPath instead of uploading the same content again, and records
+// the link relative to root.
+func linkRemoteFile(
+	httpClient *http.Client,
+	dirs *remoteDirs,
+	primaryPath, remotePath, root, token string,
+	overwrite bool,
+) error {
+	err := dirs.ensure(path.Dir(remotePath))
+	if err != nil {
+		return err
+	}
+
+	err = copyResource(httpClient, primaryPath, remotePath, token, overwrite)
+	if err != nil {
+		return err
+	}
+
+	_, err = setCustomProperties(
+		httpClient,
+		remotePath,
+		token,
+		map[string]any{
+			hardLinkProperty: strings.TrimPrefix(primaryPath, root+"/"),
+		},
+	)
+	return err
+}
+
+// recordedHardLink returns the path relative to the mirrored folder that
+// res was uploaded as a hard link of, or an empty string.
+func recordedHardLink(res resource) string {
+	link, _ := res.CustomProperties[hardLinkProperty].(string)
+	for _, name := range strings.Split(link, "/") {
+		if safeLocalName(name) != nil {
+			return ""
+		}
+	}
+	return link
+}
+
+// restoreHardLink makes localPath a hard link of primaryPath when that
+// file has the content of res. It reports false when the file has to be
+// downloaded instead.
+func restoreHardLink(
+	logger *slog.Logger,
+	localPath, primaryPath string,
+	res resource,
+	dryRun bool,
+) (bool, error) {
+	primary, err := os.Stat(primaryPath)
+	if err != nil || primary.Size() != res.Size {
+		return false, nil
+	}
+	sum, err := localHashes.MD5(primaryPath)
+	if err != nil || sum != res.MD5 {
+		return false, nil
+	}
+
+	if info, err := os.Stat(localPath); err == nil && os.SameFile(info, primary) {
+		return true, nil
+	}
+
+	logger.Info(
+		"linking",
+		slog.String("path", res.Path),
+		slog.String("local path", localPath),
+		slog.String("link of", primaryPath),
+		slog.Bool("dry run", dryRun),
+	)
+	if dryRun {
+		return true, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(localPath), 0o755)
+	if err != nil {
+		return false, err
+	}
+	err = os.Remove(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, os.Link(primaryPath, localPath)
+}
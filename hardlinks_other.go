@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileLinkID returns an empty string, hard links are only detected on
+// unix systems.
+func fileLinkID(info fs.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+// runHash implements `ydu hash [--algo md5|sha256] <remote-path>` which
+// prints server side checksums in sha256sum(1) compatible format, so the
+// output can be verified against a local copy with `sha256sum -c`.
+func runHash(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("hash", flag.ExitOnError)
+	algo := flags.String(
+		"algo",
+		"sha256",
+		"checksum to print: md5 or sha256",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 || (*algo != "md5" && *algo != "sha256") {
+		return errors.New("usage: ydu hash [--algo md5|sha256] <remote-path>")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	root, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	return walkRemote(
+		httpClient,
+		root,
+		token,
+		func(rel string, res resource) error {
+			if res.Type == "dir" {
+				return nil
+			}
+
+			checksum := res.SHA256
+			if *algo == "md5" {
+				checksum = res.MD5
+			}
+			if checksum == "" {
+				logger.Warn(
+					"no checksum reported by the server",
+					slog.String("path", res.Path),
+				)
+				return nil
+			}
+
+			_, err := fmt.Printf("%s  %s\n", checksum, rel)
+			return err
+		},
+	)
+}
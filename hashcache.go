@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// hashCacheEntry is a cached checksum together with the stat signature
+// of the file it was computed from.
+type hashCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode,omitempty"`
+	MD5     string    `json:"md5"`
+}
+
+// hashCache remembers local file checksums between runs, an entry is
+// reused as long as size, mtime and inode of the file are unchanged. A
+// renamed file is found by its inode, so it is not hashed again.
+type hashCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]hashCacheEntry
+	// inodes maps inode numbers to the paths of their entries
+	inodes map[uint64]string
+	dirty  bool
+}
+
+// localHashes caches the checksums of local files of the process. It
+// hashes every file until Open is called.
+var localHashes hashCache
+
+// Open loads the cache from the user cache directory. With rehash the
+// stored entries are ignored and replaced by fresh checksums.
+func (c *hashCache) Open(rehash bool) error {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.path = filepath.Join(cacheDir, "ydu", "hashes.json")
+	c.entries = map[string]hashCacheEntry{}
+	c.inodes = map[uint64]string{}
+	if rehash {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &c.entries)
+	if err != nil {
+		return err
+	}
+
+	for entryPath, entry := range c.entries {
+		if entry.Inode != 0 {
+			c.inodes[entry.Inode] = entryPath
+		}
+	}
+	return nil
+}
+
+// MD5 returns the md5 checksum of localPath, from the cache when the
+// file did not change since it was hashed.
+func (c *hashCache) MD5(localPath string) (string, error) {
+	c.mu.Lock()
+	opened := c.entries != nil
+	c.mu.Unlock()
+	if !opened {
+		return fileMD5(localPath)
+	}
+
+	absPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", err
+	}
+
+	signature := hashCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Inode:   fileInode(info),
+	}
+
+	c.mu.Lock()
+	cached, found := c.entries[absPath]
+	renamed := false
+	if !found && signature.Inode != 0 {
+		cached, found = c.entries[c.inodes[signature.Inode]]
+		renamed = found
+	}
+	c.mu.Unlock()
+
+	if found &&
+		cached.Size == signature.Size &&
+		cached.ModTime.Equal(signature.ModTime) &&
+		cached.Inode == signature.Inode {
+		if !renamed {
+			return cached.MD5, nil
+		}
+		// remembered under the new path as well
+		signature.MD5 = cached.MD5
+	} else {
+		signature.MD5, err = fileMD5(absPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	c.mu.Lock()
+	c.entries[absPath] = signature
+	if signature.Inode != 0 {
+		c.inodes[signature.Inode] = absPath
+	}
+	c.dirty = true
+	c.mu.Unlock()
+
+	return signature.MD5, nil
+}
+
+// Save writes the cache back when new checksums were computed.
+func (c *hashCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// replace the cache in one step so concurrent runs never read a
+	// truncated file
+	tmpPath := c.path + partialSuffix
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, c.path)
+	if err != nil {
+		return err
+	}
+
+	c.dirty = false
+	return nil
+}
+
+// saveHashCache saves localHashes, a failure only costs rehashing on the
+// next run and is logged.
+func saveHashCache(logger *slog.Logger) {
+	err := localHashes.Save()
+	if err != nil {
+		logger.Warn(
+			"Error during saving hash cache",
+			slog.String("message", err.Error()),
+		)
+	}
+}
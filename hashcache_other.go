@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileInode returns 0, cache entries are matched by size and mtime only.
+func fileInode(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import "runtime"
+
+// hashFuture is the pending checksum of a file.
+type hashFuture struct {
+	done chan struct{}
+	sum  string
+	err  error
+}
+
+// hashPipeline hashes files with a pool of goroutines ahead of the
+// transfers that need the checksums, so hashing large trees does not
+// wait for network I/O and the other way round.
+type hashPipeline struct {
+	// futures is not modified after startHashPipeline returns.
+	futures map[string]*hashFuture
+}
+
+// defaultHashers is the default size of the hashing pool.
+var defaultHashers = runtime.NumCPU()
+
+// startHashPipeline starts hashing paths in order with workers
+// goroutines.
+func startHashPipeline(paths []string, workers int) *hashPipeline {
+	p := &hashPipeline{
+		futures: map[string]*hashFuture{},
+	}
+
+	jobs := make(chan string)
+	for _, localPath := range paths {
+		if _, found := p.futures[localPath]; !found {
+			p.futures[localPath] = &hashFuture{done: make(chan struct{})}
+		}
+	}
+
+	for range max(workers, 1) {
+		go func() {
+			for localPath := range jobs {
+				future := p.futures[localPath]
+				future.sum, future.err = localHashes.MD5(localPath)
+				close(future.done)
+			}
+		}()
+	}
+
+	go func() {
+		queued := map[string]bool{}
+		for _, localPath := range paths {
+			if !queued[localPath] {
+				queued[localPath] = true
+				jobs <- localPath
+			}
+		}
+		close(jobs)
+	}()
+
+	return p
+}
+
+// MD5 returns the checksum of localPath, waiting for the pool when it
+// is still being hashed. Paths the pipeline was not started with are
+// hashed directly.
+func (p *hashPipeline) MD5(localPath string) (string, error) {
+	future, found := p.futures[localPath]
+
+	if !found {
+		return localHashes.MD5(localPath)
+	}
+
+	<-future.done
+	return future.sum, future.err
+}
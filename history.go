@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// runSummary is an entry of the run history.
+type runSummary struct {
+	RunID    string    `json:"run_id"`
+	Command  string    `json:"command"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Host     string    `json:"host"`
+	// Account identifies the token without revealing it.
+	Account string `json:"account,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Files   int64  `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Failed  int64  `json:"failed"`
+	// Result is ok, partial, failed or interrupted.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// historyCommands are the subcommands recorded in the history besides
+// uploads.
+var historyCommands = map[string]bool{
+	"apply":   true,
+	"backup":  true,
+	"batch":   true,
+	"pull":    true,
+	"restore": true,
+	"xcopy":   true,
+}
+
+// runTotals counts the files transferred by the process, see
+// recordTransfer.
+var runTotals struct {
+	Files  atomic.Int64
+	Bytes  atomic.Int64
+	Failed atomic.Int64
+}
+
+// runStarted is when the process started.
+var runStarted = time.Now()
+
+// runTarget is the folder the command works on, set by the commands for
+// the history.
+var runTarget string
+
+// historyFile returns the path of the run history, YDU_HISTORY or
+// history.jsonl in the ydu config directory.
+func historyFile() (string, error) {
+	if p := os.Getenv("YDU_HISTORY"); p != "" {
+		return p, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "ydu", "history.jsonl"), nil
+}
+
+// recordRun appends the summary of the run of command to the history.
+// Failing to write it is reported on stderr but does not fail the run.
+func recordRun(command, result string, err error) {
+	summary := runSummary{
+		RunID:    runID,
+		Command:  command,
+		Started:  runStarted.UTC(),
+		Finished: time.Now().UTC(),
+		Target:   runTarget,
+		Files:    runTotals.Files.Load(),
+		Bytes:    runTotals.Bytes.Load(),
+		Failed:   runTotals.Failed.Load(),
+		Result:   result,
+	}
+	summary.Host, _ = os.Hostname()
+	if token, tokenErr := diskToken(); tokenErr == nil {
+		summary.Account = accountKey(token)
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	line, _ := json.Marshal(summary)
+	line = append(line, '\n')
+
+	historyPath, writeErr := historyFile()
+	if writeErr == nil {
+		writeErr = appendLine(historyPath, line)
+	}
+	if writeErr != nil {
+		fmt.Fprintf(os.Stderr, "ydu: error during writing run history: %v\n", writeErr)
+	}
+}
+
+// readRunSummaries returns the run history, oldest first.
+func readRunSummaries() ([]runSummary, error) {
+	historyPath, err := historyFile()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(historyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var summaries []runSummary
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var summary runSummary
+		if json.Unmarshal(scanner.Bytes(), &summary) == nil {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries, scanner.Err()
+}
+
+// runHistory implements `ydu history` which prints past runs.
+func runHistory(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	since := flags.String(
+		"since",
+		"",
+		"only show runs of this recent period, e.g. 24h or 7d",
+	)
+	command := flags.String(
+		"command",
+		"",
+		"only show runs of this command, e.g. upload or backup",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print the runs as JSON lines",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: ydu history [--since 7d] [--command backup] [--json]")
+	}
+
+	var cutoff time.Time
+	if *since != "" {
+		age, err := parseAge(*since)
+		if err != nil {
+			return err
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	summaries, err := readRunSummaries()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !*jsonOutput {
+		fmt.Fprintln(w, "STARTED\tDURATION\tCOMMAND\tTARGET\tFILES\tSIZE\tRESULT")
+	}
+	for _, summary := range summaries {
+		if summary.Started.Before(cutoff) ||
+			(*command != "" && summary.Command != *command) {
+			continue
+		}
+
+		if *jsonOutput {
+			err := encoder.Encode(summary)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		result := summary.Result
+		if summary.Failed > 0 {
+			result += fmt.Sprintf(" (%d failed)", summary.Failed)
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			summary.Started.Local().Format(time.DateTime),
+			summary.Finished.Sub(summary.Started).Round(time.Second),
+			summary.Command,
+			summary.Target,
+			summary.Files,
+			humanize.Bytes(uint64(summary.Bytes)),
+			result,
+		)
+	}
+	return w.Flush()
+}
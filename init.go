@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// prompter asks questions on out and reads the answers from in.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints question and returns the answer, def for an empty one.
+func (p prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+
+	answer := strings.TrimSpace(line)
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// askValid asks until valid accepts the answer.
+func (p prompter) askValid(
+	question, def string,
+	valid func(answer string) error,
+) (string, error) {
+	for {
+		answer, err := p.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+
+		err = valid(answer)
+		if err == nil {
+			return answer, nil
+		}
+		fmt.Fprintf(p.out, "  %v\n", err)
+	}
+}
+
+// runInit implements `ydu init`, an interactive setup of the config
+// file: the token, the default target folder and upload settings,
+// including excludes and concurrency. Settings of an existing config
+// file are offered as defaults.
+func runInit(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: ydu init")
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	configPath, err := configFile()
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+	p := prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+
+	fmt.Fprintf(p.out, "This creates %s, press enter to keep a suggested value.\n\n", configPath)
+	fmt.Fprintln(p.out, "ydu needs an OAuth token with access to yandex disk, you can get one at https://yandex.ru/dev/disk/poligon/")
+
+	// a token from token_file or token_cmd stays there
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	currentToken := ""
+	if token != "" {
+		currentToken = "keep current"
+	}
+
+	var info *diskInfo
+	changed := false
+	_, err = p.askValid("Token", currentToken, func(answer string) error {
+		if answer != currentToken {
+			token = answer
+			changed = true
+		}
+		if token == "" {
+			return errors.New("a token is required")
+		}
+
+		var infoErr error
+		info, infoErr = getDiskInfo(httpClient, token)
+		if infoErr != nil {
+			return fmt.Errorf("the token does not work: %w", infoErr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if changed {
+		// a new token replaces token_file or token_cmd
+		c.Token, c.TokenFile, c.TokenCmd = token, "", ""
+	}
+	fmt.Fprintf(p.out, "  logged in as %s\n\n", info.User.Login)
+
+	targetDefault := c.Target
+	if targetDefault == "" {
+		targetDefault = "backups"
+	}
+	c.Target, err = p.askValid("Default target folder on yandex disk", targetDefault, func(answer string) error {
+		resolved, err := resolveRemotePath(httpClient, answer, token)
+		if err == nil {
+			fmt.Fprintf(p.out, "  uploads go to %s\n", resolved)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	maxFileSizeDefault := c.MaxFileSize
+	if maxFileSizeDefault == "" && info.MaxFileSize > 0 {
+		maxFileSizeDefault = humanize.Bytes(uint64(info.MaxFileSize))
+	}
+	c.MaxFileSize, err = p.askValid("Skip files larger than (largest file your plan accepts)", maxFileSizeDefault, func(answer string) error {
+		_, err := humanize.ParseBytes(answer)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	bwlimitDefault := c.BWLimit
+	if bwlimitDefault == "" {
+		bwlimitDefault = "unlimited"
+	}
+	c.BWLimit, err = p.askValid("Bandwidth limit, e.g. 2M or 08:00-18:00=2M,18:00-08:00=unlimited", bwlimitDefault, func(answer string) error {
+		var schedule bandwidthSchedule
+		return schedule.Set(answer)
+	})
+	if err != nil {
+		return err
+	}
+	if c.BWLimit == "unlimited" {
+		c.BWLimit = ""
+	}
+
+	orderDefault := c.Order
+	if orderDefault == "" {
+		orderDefault = "alpha"
+	}
+	c.Order, err = p.askValid("Upload order: alpha, size-asc, size-desc or mtime", orderDefault, func(answer string) error {
+		return orderUploadQueue(nil, answer, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	patterns, err := p.askValid("Files to upload first, comma separated globs like *.db", strings.Join(c.PriorityPatterns, ","), func(answer string) error {
+		return orderUploadQueue(nil, "alpha", splitList(answer))
+	})
+	if err != nil {
+		return err
+	}
+	c.PriorityPatterns = splitList(patterns)
+
+	excludes, err := p.askValid("Files to leave out besides temporary and lock files, comma separated globs like *.log", strings.Join(c.Excludes, ","), func(answer string) error {
+		for _, pattern := range splitList(answer) {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Excludes = splitList(excludes)
+
+	c.SmallFileConcurrency, err = askConcurrency(p, "Small files uploaded in parallel", c.SmallFileConcurrency, defaultSmallFileConcurrency)
+	if err != nil {
+		return err
+	}
+	c.LargeFileConcurrency, err = askConcurrency(p, "Large files uploaded in parallel", c.LargeFileConcurrency, defaultLargeFileConcurrency)
+	if err != nil {
+		return err
+	}
+
+	overwriteDefault := "no"
+	if c.Overwrite {
+		overwriteDefault = "yes"
+	}
+	overwrite, err := p.askValid("Overwrite existing files on yandex disk (yes/no)", overwriteDefault, func(answer string) error {
+		if answer != "yes" && answer != "no" {
+			return errors.New("answer yes or no")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Overwrite = overwrite == "yes"
+
+	err = c.validate()
+	if err != nil {
+		return err
+	}
+
+	configPath, err = saveConfig(c)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(p.out, "\nSaved %s, upload with: ydu --path-to-file <file or directory>\n", configPath)
+	return nil
+}
+
+// askConcurrency asks for a number of parallel uploads, offering current
+// or else def. The default is not written to the config file.
+func askConcurrency(p prompter, question string, current, def int) (int, error) {
+	if current == 0 {
+		current = def
+	}
+	answer, err := p.askValid(question, strconv.Itoa(current), func(answer string) error {
+		n, err := strconv.Atoi(answer)
+		if err != nil || n < 1 {
+			return errors.New("enter a number of at least 1")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := strconv.Atoi(answer)
+	if n == def {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// splitList splits a comma separated list, leaving out empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// jobConfig is a named job of the config file, run with `ydu run`:
+//
+//	jobs:
+//	  photos:
+//	    source: /home/me/photos
+//	    destination: disk:/photos
+//	    exclude: ["*.xmp"]
+//	    flags: ["--order", "size-asc"]
+//	    schedule: daily
+//	    notify: [desktop, https://hooks.example.com/ydu]
+//	    token_cmd: pass show yandex/photos
+type jobConfig struct {
+	// Command is upload, the default, backup or pull.
+	Command     string   `yaml:"command,omitempty"`
+	Source      string   `yaml:"source"`
+	Destination string   `yaml:"destination"`
+	Exclude     []string `yaml:"exclude,omitempty"`
+	// Flags are further flags of the command.
+	Flags []string `yaml:"flags,omitempty"`
+	// Schedule is the systemd OnCalendar schedule used by `ydu systemd
+	// install --job`.
+	Schedule string `yaml:"schedule,omitempty"`
+	// Notify lists desktop and webhook urls to notify when the job
+	// finished.
+	Notify []string `yaml:"notify,omitempty"`
+	// TokenFile and TokenCmd read the token of the job, for jobs of
+	// other accounts than the one of the config.
+	TokenFile string `yaml:"token_file,omitempty"`
+	TokenCmd  string `yaml:"token_cmd,omitempty"`
+}
+
+// validate reports the first invalid setting of job.
+func (job jobConfig) validate() error {
+	switch job.Command {
+	case "", "upload", "backup":
+	case "pull":
+		if len(job.Exclude) > 0 {
+			return errors.New("exclude: pull does not support excludes")
+		}
+	default:
+		return fmt.Errorf("command: unknown command %q, use upload, backup or pull", job.Command)
+	}
+
+	if job.TokenFile != "" && job.TokenCmd != "" {
+		return errors.New("only one of token_file and token_cmd can be set")
+	}
+
+	if job.Source == "" {
+		return errors.New("source: missing")
+	}
+	if job.Destination == "" {
+		return errors.New("destination: missing")
+	}
+
+	for _, pattern := range job.Exclude {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("exclude: invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, target := range job.Notify {
+		if target == "desktop" {
+			continue
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notify: %q is neither desktop nor a webhook url", target)
+		}
+	}
+	return nil
+}
+
+// args returns the ydu arguments running job.
+func (job jobConfig) args() []string {
+	var args []string
+	if slices.Contains(job.Notify, "desktop") {
+		args = append(args, "--notify")
+	}
+
+	var excludes []string
+	for _, pattern := range job.Exclude {
+		excludes = append(excludes, "--exclude", pattern)
+	}
+
+	switch job.Command {
+	case "", "upload":
+		args = append(args, "--path-to-file", job.Source, "--target-yandex-disk-path", job.Destination)
+		args = append(args, excludes...)
+		return append(args, job.Flags...)
+	default:
+		args = append(args, job.Command)
+		args = append(args, excludes...)
+		args = append(args, job.Flags...)
+		return append(args, "--", job.Source, job.Destination)
+	}
+}
+
+// jobResult returns the result of a job process for the run history
+// and notifications.
+func jobResult(err error) string {
+	var exitErr *exec.ExitError
+	if err == nil {
+		return "ok"
+	}
+	if !errors.As(err, &exitErr) {
+		return "failed"
+	}
+
+	switch exitErr.ExitCode() {
+	case exitPartialFailure:
+		return "partial"
+	case exitInsufficientStorage:
+		return "out of space"
+	case exitInterrupted:
+		return "interrupted"
+	}
+	return "failed"
+}
+
+// jobNotification is the JSON body posted to the webhooks of a job.
+type jobNotification struct {
+	Job      string    `json:"job"`
+	Command  string    `json:"command"`
+	Host     string    `json:"host"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Result is ok, partial, failed, interrupted or out of space.
+	Result string `json:"result"`
+}
+
+// notifyWebhooks posts the outcome of a job to its webhook urls. A
+// webhook that cannot be reached is only logged.
+func notifyWebhooks(logger *slog.Logger, job jobConfig, notification jobNotification) {
+	body, _ := json.Marshal(notification)
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	for _, target := range job.Notify {
+		if target == "desktop" {
+			continue
+		}
+
+		resp, err := httpClient.Post(target, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+		if err != nil {
+			logger.Warn(
+				"Error during webhook notification",
+				slog.String("job", notification.Job),
+				slog.String("message", err.Error()),
+			)
+		}
+	}
+}
+
+// jobLimits are the limits shared by the jobs running at the same time,
+// each job process gets an even share through the environment.
+type jobLimits struct {
+	// Slots is the number of jobs running at the same time.
+	Slots        int
+	Bandwidth    bandwidthSchedule
+	MaxTransfers int
+}
+
+// env returns the environment of a job process.
+func (l jobLimits) env() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		// ydu run itself talks to systemd, a job must not report
+		// readiness or ping the watchdog on its behalf
+		if name != "NOTIFY_SOCKET" && name != "WATCHDOG_USEC" && name != "WATCHDOG_PID" {
+			env = append(env, kv)
+		}
+	}
+
+	if len(l.Bandwidth) > 0 {
+		share := l.Bandwidth.share(l.Slots)
+		env = append(env, "YDU_BWLIMIT="+share.String())
+	}
+	if l.MaxTransfers > 0 {
+		// an upload runs the large file tier besides the small one
+		share := max(1, l.MaxTransfers/l.Slots)
+		env = append(
+			env,
+			fmt.Sprintf("YDU_SMALL_FILE_CONCURRENCY=%d", max(1, share-1)),
+			"YDU_LARGE_FILE_CONCURRENCY=1",
+		)
+	}
+	return env
+}
+
+// jobOutcome is the summary of a finished job.
+type jobOutcome struct {
+	Name    string
+	Command string
+	RunID   string
+	Started time.Time
+	// Finished is zero for a job that was never started.
+	Finished time.Time
+	// Result is ok, partial, failed, interrupted or out of space.
+	Result string
+	Files  int64
+	Bytes  int64
+	Err    error
+}
+
+// runningJobs are the processes of the running jobs.
+type runningJobs struct {
+	mu        sync.Mutex
+	processes map[*os.Process]bool
+}
+
+// jobProcesses are the jobs ydu run is running.
+var jobProcesses runningJobs
+
+func (j *runningJobs) add(p *os.Process) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.processes == nil {
+		j.processes = map[*os.Process]bool{}
+	}
+	j.processes[p] = true
+}
+
+func (j *runningJobs) remove(p *os.Process) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.processes, p)
+}
+
+// signal sends sig to every running job.
+func (j *runningJobs) signal(sig os.Signal) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for p := range j.processes {
+		p.Signal(sig)
+	}
+}
+
+// runJob runs the job name in its own ydu process, so it behaves and is
+// recorded in the history like the command run by hand.
+func runJob(
+	logger *slog.Logger,
+	executable, name string,
+	job jobConfig,
+	limits jobLimits,
+) jobOutcome {
+	outcome := jobOutcome{
+		Name:    name,
+		Command: cmp.Or(job.Command, "upload"),
+		RunID:   newRunID(),
+		Started: time.Now().UTC(),
+	}
+
+	args := append(append([]string(nil), globalArgs...), job.args()...)
+	logger.Info(
+		"running job",
+		slog.String("job", name),
+		slog.String("job run id", outcome.RunID),
+		slog.String("command", strings.Join(args, " ")),
+	)
+
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(limits.env(), "YDU_RUN_ID="+outcome.RunID, "YDU_PROFILE="+name)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	var err error
+	if job.TokenFile != "" || job.TokenCmd != "" {
+		var token string
+		token, err = readSecret(job.TokenFile, job.TokenCmd)
+		// the last value of a variable wins
+		cmd.Env = append(cmd.Env, "YANDEX_DISK_TOKEN="+token)
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		jobProcesses.add(cmd.Process)
+		err = cmd.Wait()
+		jobProcesses.remove(cmd.Process)
+	}
+
+	outcome.Finished = time.Now().UTC()
+	outcome.Result = jobResult(err)
+	if err != nil {
+		outcome.Err = fmt.Errorf("job %s: %s: %w", name, outcome.Result, err)
+	}
+
+	// the job recorded what it transferred in the history
+	summaries, historyErr := readRunSummaries()
+	if historyErr != nil {
+		logger.Warn(
+			"Error during reading run history",
+			slog.String("message", historyErr.Error()),
+		)
+	}
+	for _, summary := range summaries {
+		if summary.RunID == outcome.RunID {
+			outcome.Files = summary.Files
+			outcome.Bytes = summary.Bytes
+		}
+	}
+
+	notification := jobNotification{
+		Job:      name,
+		Command:  outcome.Command,
+		Started:  outcome.Started,
+		Finished: outcome.Finished,
+		Result:   outcome.Result,
+	}
+	notification.Host, _ = os.Hostname()
+	notifyWebhooks(logger, job, notification)
+
+	if err != nil {
+		logger.Error(
+			"Error during job",
+			slog.String("job", name),
+			slog.String("message", outcome.Err.Error()),
+		)
+	} else {
+		logger.Info(
+			"job finished",
+			slog.String("job", name),
+			slog.String("duration", outcome.Finished.Sub(outcome.Started).Round(time.Second).String()),
+		)
+	}
+	return outcome
+}
+
+// printJobSummary writes the merged summary of the jobs of a run.
+func printJobSummary(out io.Writer, outcomes []jobOutcome) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tCOMMAND\tDURATION\tFILES\tSIZE\tRESULT")
+
+	var files, size int64
+	for _, outcome := range outcomes {
+		duration := "-"
+		result := outcome.Result
+		if outcome.Finished.IsZero() {
+			result = "not started"
+		} else {
+			duration = outcome.Finished.Sub(outcome.Started).Round(time.Second).String()
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%d\t%s\t%s\n",
+			outcome.Name,
+			outcome.Command,
+			duration,
+			outcome.Files,
+			humanize.Bytes(uint64(outcome.Bytes)),
+			result,
+		)
+		files += outcome.Files
+		size += outcome.Bytes
+	}
+	fmt.Fprintf(w, "total\t\t\t%d\t%s\t\n", files, humanize.Bytes(uint64(size)))
+	return w.Flush()
+}
+
+// runJobs implements `ydu run <job>... | --all` which runs jobs defined
+// in the config file, --parallel of them at the same time.
+func runJobs(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	all := flags.Bool(
+		"all",
+		false,
+		"run all jobs of the config file in name order",
+	)
+	list := flags.Bool(
+		"list",
+		false,
+		"print the jobs and the command line they run",
+	)
+	parallel := flags.Int(
+		"parallel",
+		1,
+		"run this many jobs at the same time",
+	)
+	var limits jobLimits
+	flags.Var(
+		&limits.Bandwidth,
+		"bwlimit",
+		"limit the transfer speed of all running jobs together, shared evenly among them",
+	)
+	flags.IntVar(
+		&limits.MaxTransfers,
+		"max-transfers",
+		0,
+		"limit the parallel uploads of all running jobs together, shared evenly among them",
+	)
+	parseFlags(flags, args)
+
+	modes := 0
+	for _, set := range []bool{flags.NArg() > 0, *all, *list} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 || *parallel < 1 {
+		return errors.New("usage: ydu run [--parallel 1] [--bwlimit 10M] [--max-transfers 8] <job>... | --all | --list")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	err = cfg.validate()
+	if err != nil {
+		return err
+	}
+
+	names := flags.Args()
+	if *all || *list {
+		names = slices.Sorted(maps.Keys(cfg.Jobs))
+		if len(names) == 0 {
+			return errors.New("no jobs defined in the config file")
+		}
+	}
+	for _, name := range names {
+		if _, ok := cfg.Jobs[name]; !ok {
+			return fmt.Errorf("unknown job %s, see ydu run --list", name)
+		}
+	}
+
+	if *list {
+		for _, name := range names {
+			fmt.Printf("%s\tydu %s\n", name, strings.Join(cfg.Jobs[name].args(), " "))
+		}
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to resolve ydu executable path: %v", err)
+	}
+
+	// the jobs get the signal as well, the remaining ones are not started
+	handleStopSignals(logger)
+	// the pause signals are passed on to the jobs, no job starts while
+	// they are paused
+	forwardPauseSignals(logger)
+
+	err = sdNotify("READY=1")
+	if err != nil {
+		logger.Warn(
+			"Error during systemd readiness notification",
+			slog.String("message", err.Error()),
+		)
+	}
+	defer startWatchdog(logger)()
+
+	limits.Slots = min(*parallel, len(names))
+	outcomes := make([]jobOutcome, len(names))
+	slots := make(chan struct{}, limits.Slots)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		slots <- struct{}{}
+		transfers.Wait()
+		if stopRequested.Load() {
+			<-slots
+			outcomes[i] = jobOutcome{Name: name, Command: cmp.Or(cfg.Jobs[name].Command, "upload")}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			outcomes[i] = runJob(logger, executable, name, cfg.Jobs[name], limits)
+		}()
+	}
+	wg.Wait()
+
+	if len(names) > 1 {
+		err = printJobSummary(os.Stdout, outcomes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if stopRequested.Load() {
+		return errors.New("run interrupted")
+	}
+	var failed []string
+	for _, outcome := range outcomes {
+		if outcome.Err != nil {
+			failed = append(failed, outcome.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d jobs failed: %s", len(failed), len(names), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// exitInterrupted is the exit code of an upload run stopped by SIGINT or
+// SIGTERM.
+const exitInterrupted = 130
+
+// stopRequested is set by the first SIGINT or SIGTERM, the upload stops
+// once the current file is complete.
+var stopRequested atomic.Bool
+
+// originalArgs are the arguments ydu was started with, including the
+// global flags, so a journal can repeat the run.
+var originalArgs = append([]string(nil), os.Args[1:]...)
+
+// handleStopSignals makes the first SIGINT or SIGTERM stop the run after
+// the current file, a second one exits immediately.
+func handleStopSignals(logger *slog.Logger) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logger.Warn(
+			"stopping after the current file, signal again to exit immediately",
+			slog.String("signal", sig.String()),
+		)
+		stopRequested.Store(true)
+		// a paused transfer could not complete otherwise
+		transfers.Resume()
+
+		<-signals
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// runJournal lists the files an upload run still has to upload. It is
+// written when the run starts and updated when it is interrupted or
+// stopped by its budget, so it also survives a crash, and removed when
+// the run completes. It is a failure manifest that --retry-failed
+// reads, together with what is needed to repeat the run.
+type runJournal struct {
+	failureManifest
+	RunID       string    `json:"run_id"`
+	Args        []string  `json:"args"`
+	Dir         string    `json:"dir"`
+	PID         int       `json:"pid"`
+	Host        string    `json:"host"`
+	Started     time.Time `json:"started"`
+	Interrupted time.Time `json:"interrupted,omitempty"`
+	// Stopped is when --deadline, --max-duration or --max-transfer
+	// stopped the run and StopReason which of them.
+	Stopped    time.Time `json:"stopped,omitempty"`
+	StopReason string    `json:"stop_reason,omitempty"`
+}
+
+// journalDir returns the folder of the run journals below the user
+// config directory.
+func journalDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "ydu", "runs"), nil
+}
+
+// journalFile returns the journal of the run with id.
+func journalFile(id string) (string, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+// newRunJournal returns the journal of the current run to target.
+func newRunJournal(target string) *runJournal {
+	dir, _ := os.Getwd()
+	host, _ := os.Hostname()
+	return &runJournal{
+		failureManifest: failureManifest{Target: target},
+		RunID:           runID,
+		Args:            originalArgs,
+		Dir:             dir,
+		PID:             os.Getpid(),
+		Host:            host,
+		Started:         time.Now().UTC(),
+	}
+}
+
+// write stores the journal with queue as the files left to upload.
+func (j *runJournal) write(queue []uploadItem) error {
+	j.Failed = []failedUpload{}
+	for _, item := range queue {
+		localPath, err := filepath.Abs(item.LocalPath)
+		if err != nil {
+			return err
+		}
+		j.Failed = append(j.Failed, failedUpload{
+			LocalPath:  localPath,
+			RemotePath: item.RemotePath,
+			Size:       item.Size,
+		})
+	}
+	return j.save()
+}
+
+// save stores the journal.
+func (j *runJournal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	journalPath, err := journalFile(j.RunID)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(journalPath), 0o700)
+	if err != nil {
+		return err
+	}
+
+	// replaced in one step, a torn journal would lose the run
+	tmpPath := journalPath + partialSuffix
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, journalPath)
+}
+
+// remove deletes the journal of a completed run.
+func (j *runJournal) remove() error {
+	journalPath, err := journalFile(j.RunID)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// running reports whether the run of the journal is still in progress
+// on this host.
+func (j *runJournal) running() bool {
+	host, _ := os.Hostname()
+	return j.Interrupted.IsZero() && j.Host == host && processAlive(j.PID)
+}
+
+// readRunJournal reads the journal at journalPath.
+func readRunJournal(journalPath string) (*runJournal, error) {
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var j runJournal
+	err = json.Unmarshal(data, &j)
+	if err != nil {
+		return nil, fmt.Errorf("invalid run journal %s: %w", journalPath, err)
+	}
+	return &j, nil
+}
+
+// readRunJournals reads all journals, oldest first.
+func readRunJournals() ([]*runJournal, error) {
+	dir, err := journalDir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var journals []*runJournal
+	for _, journalPath := range paths {
+		j, err := readRunJournal(journalPath)
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, j)
+	}
+
+	sort.Slice(journals, func(a, b int) bool {
+		return journals[a].Started.Before(journals[b].Started)
+	})
+	return journals, nil
+}
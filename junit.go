@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"time"
+)
+
+// transferRecord describes the outcome of a single file transfer.
+type transferRecord struct {
+	LocalPath  string
+	RemotePath string
+	Size       int64
+	Duration   time.Duration
+	Err        error
+	// SkipReason is set when the file was not transferred on purpose.
+	SkipReason string
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnitReport writes records to path as a JUnit XML report, one
+// test case per file transfer.
+func writeJUnitReport(path string, records []transferRecord) error {
+	suite := junitTestSuite{
+		Name:      "ydu",
+		Tests:     len(records),
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+
+	var total time.Duration
+	for _, record := range records {
+		total += record.Duration
+
+		testCase := junitTestCase{
+			Name:      record.RemotePath,
+			ClassName: "ydu.upload",
+			Time:      junitSeconds(record.Duration),
+			SystemOut: fmt.Sprintf(
+				"%s -> %s (%d bytes)",
+				record.LocalPath,
+				record.RemotePath,
+				record.Size,
+			),
+		}
+
+		if record.SkipReason != "" {
+			suite.Skipped++
+			testCase.Skipped = &junitSkipped{
+				Message: record.SkipReason,
+			}
+		}
+
+		if record.Err != nil {
+			suite.Failures++
+			testCase.Failure = &junitFailure{
+				Message: record.Err.Error(),
+				Type:    "UploadError",
+				Text:    record.Err.Error(),
+			}
+		}
+
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Time = junitSeconds(total)
+
+	data, err := xml.MarshalIndent(
+		junitTestSuites{Suites: []junitTestSuite{suite}},
+		"",
+		"  ",
+	)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(
+		path,
+		append([]byte(xml.Header), append(data, '\n')...),
+		0o644,
+	)
+}
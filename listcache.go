@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// listingCache keeps folder listings in the user cache directory for TTL
+// so repeated commands on huge trees do not fetch the same listings
+// again within minutes. It is disabled while TTL is 0.
+type listingCache struct {
+	TTL time.Duration
+}
+
+// listings caches the folder listings of the process, configured by the
+// global --listing-ttl flag or YDU_LISTING_TTL.
+var listings listingCache
+
+// cachedListing is the file format of a cached listing.
+type cachedListing struct {
+	Fetched  time.Time `json:"fetched"`
+	Resource resource  `json:"resource"`
+}
+
+// setListingTTL configures listings from the value of --listing-ttl.
+func setListingTTL(value string) error {
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return fmt.Errorf("invalid --listing-ttl %q, e.g. 10m", value)
+	}
+	listings.TTL = ttl
+	return nil
+}
+
+// file returns the cache file of the listing of remotePath. The name
+// includes the token so accounts never see each others listings.
+func (c *listingCache) file(remotePath, token string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(token + "\x00" + diskPath(remotePath)))
+	return filepath.Join(
+		cacheDir,
+		"ydu",
+		"listings",
+		hex.EncodeToString(sum[:])+".json",
+	), nil
+}
+
+// Get returns the cached listing of remotePath if it is younger than
+// TTL.
+func (c *listingCache) Get(remotePath, token string) (*resource, bool) {
+	if c.TTL <= 0 {
+		return nil, false
+	}
+
+	cacheFile, err := c.file(remotePath, token)
+	if err != nil {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		return nil, false
+	}
+
+	var cached cachedListing
+	err = json.Unmarshal(data, &cached)
+	if err != nil || time.Since(cached.Fetched) > c.TTL {
+		return nil, false
+	}
+	return &cached.Resource, true
+}
+
+// Put stores the listing of remotePath. Failures only cost a later
+// cache miss and are ignored.
+func (c *listingCache) Put(remotePath, token string, res *resource) {
+	if c.TTL <= 0 {
+		return
+	}
+
+	cacheFile, err := c.file(remotePath, token)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(cachedListing{
+		Fetched:  time.Now(),
+		Resource: *res,
+	})
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(cacheFile), 0o700)
+	if err != nil {
+		return
+	}
+
+	partialPath := cacheFile + partialSuffix
+	err = os.WriteFile(partialPath, data, 0o600)
+	if err != nil {
+		return
+	}
+	os.Rename(partialPath, cacheFile)
+}
+
+// Invalidate drops the cached listings of remotePath and of its parent
+// folder after the process changed remotePath.
+func (c *listingCache) Invalidate(remotePath, token string) {
+	if c.TTL <= 0 || remotePath == "" {
+		return
+	}
+
+	for _, p := range []string{remotePath, path.Dir(remotePath)} {
+		cacheFile, err := c.file(p, token)
+		if err == nil {
+			os.Remove(cacheFile)
+		}
+	}
+}
+
+// resourceMemo remembers the metadata the process fetched, keyed by
+// token, path and the other request parameters such as fields, so
+// planning a run over a large tree asks for every folder once. Unlike
+// listingCache it lives only as long as the process and is always on.
+type resourceMemo struct {
+	mu       sync.Mutex
+	disabled bool
+	entries  map[string]memoEntry
+}
+
+type memoEntry struct {
+	path string
+	res  *resource
+}
+
+// memo is the resource memo of the process. Commands polling the disk
+// for changes made elsewhere disable it.
+var memo resourceMemo
+
+func memoKey(endpoint string, params url.Values, token string) string {
+	return token + "\x00" + endpoint + "?" + params.Encode()
+}
+
+// Get returns the remembered response to the metadata request, a copy
+// the caller may change.
+func (m *resourceMemo) Get(
+	endpoint string,
+	params url.Values,
+	token string,
+) (*resource, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.disabled {
+		return nil, false
+	}
+	entry, ok := m.entries[memoKey(endpoint, params, token)]
+	if !ok {
+		return nil, false
+	}
+	return cloneResource(entry.res), true
+}
+
+// Put remembers the response to the metadata request.
+func (m *resourceMemo) Put(
+	endpoint string,
+	params url.Values,
+	token string,
+	res *resource,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.disabled {
+		return
+	}
+	if m.entries == nil {
+		m.entries = map[string]memoEntry{}
+	}
+	m.entries[memoKey(endpoint, params, token)] = memoEntry{
+		path: diskPath(params.Get("path")),
+		res:  cloneResource(res),
+	}
+}
+
+// Invalidate forgets remotePath, everything below it and its parent
+// folder after the process changed remotePath.
+func (m *resourceMemo) Invalidate(remotePath string) {
+	if remotePath == "" {
+		return
+	}
+	remotePath = diskPath(remotePath)
+	parent := path.Dir(remotePath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, entry := range m.entries {
+		if entry.path == parent || isBelow(entry.path, remotePath) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// cloneResource copies res and its listing so callers of
+// resourceMemo.Get can sort or append to the items.
+func cloneResource(res *resource) *resource {
+	c := *res
+	if res.Embedded != nil {
+		embedded := *res.Embedded
+		embedded.Items = slices.Clone(embedded.Items)
+		c.Embedded = &embedded
+	}
+	return &c
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// listingConcurrency bounds the folder listings walkRemote fetches at
+// the same time, set by the global --list-concurrency flag or
+// YDU_LIST_CONCURRENCY.
+var listingConcurrency = 8
+
+// setListConcurrency configures listingConcurrency from the value of
+// --list-concurrency.
+func setListConcurrency(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid --list-concurrency %q, expected a positive number", value)
+	}
+	listingConcurrency = n
+	return nil
+}
+
+// listingSlots holds a token per listing request in flight.
+var (
+	listingSlots     chan struct{}
+	listingSlotsOnce sync.Once
+)
+
+// errWalkStopped is the error of listings skipped because the walk
+// ended early.
+var errWalkStopped = errors.New("walk stopped")
+
+// listingFuture is a folder listing fetched ahead of the walk.
+type listingFuture struct {
+	done chan struct{}
+	res  *resource
+	err  error
+}
+
+// wait returns the listing once it is fetched.
+func (f *listingFuture) wait() (*resource, error) {
+	<-f.done
+	return f.res, f.err
+}
+
+// prefetchListings starts fetching the listings of paths, with the
+// attributes fields of their items, in the background, in order and at
+// most listingConcurrency at a time across the process. Listings not
+// started yet when stop is set are skipped.
+func prefetchListings(
+	httpClient *http.Client,
+	paths []string,
+	token string,
+	fields []string,
+	stop *atomic.Bool,
+) []*listingFuture {
+	listingSlotsOnce.Do(func() {
+		listingSlots = make(chan struct{}, listingConcurrency)
+	})
+
+	futures := make([]*listingFuture, len(paths))
+	for i := range paths {
+		futures[i] = &listingFuture{done: make(chan struct{})}
+	}
+
+	go func() {
+		for i, remotePath := range paths {
+			future := futures[i]
+			listingSlots <- struct{}{}
+			if stop.Load() {
+				<-listingSlots
+				future.err = errWalkStopped
+				close(future.done)
+				continue
+			}
+
+			go func() {
+				defer close(future.done)
+				defer func() { <-listingSlots }()
+				future.res, future.err = getDiskResourceFields(httpClient, remotePath, token, fields)
+			}()
+		}
+	}()
+	return futures
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// remoteLockName is the marker file --remote-lock creates in the target
+// folder. Remote walks skip it.
+const remoteLockName = ".ydu-lock"
+
+// lockPollInterval is how often --wait-lock checks a held lock.
+const lockPollInterval = 5 * time.Second
+
+// lockOptions are the values of the lock flags.
+type lockOptions struct {
+	// Wait is how long to wait for a held lock, 0 fails at once.
+	Wait time.Duration
+	// Remote also creates a marker in the target folder, which covers
+	// runs on other machines.
+	Remote bool
+	// StaleAfter is the age after which a lock is considered left over
+	// by a crashed run, 0 never expires locks.
+	StaleAfter time.Duration
+}
+
+// addLockFlags defines the lock flags on flags, --remote-lock only for
+// commands writing to a remote target.
+func addLockFlags(flags *flag.FlagSet, remote bool) *lockOptions {
+	options := &lockOptions{}
+	flags.DurationVar(
+		&options.Wait,
+		"wait-lock",
+		0,
+		"wait this long for another run against the same target to finish instead of failing",
+	)
+	if remote {
+		flags.BoolVar(
+			&options.Remote,
+			"remote-lock",
+			false,
+			"also lock the target with a "+remoteLockName+" marker on yandex disk, for runs from several machines",
+		)
+	}
+	flags.DurationVar(
+		&options.StaleAfter,
+		"stale-lock",
+		24*time.Hour,
+		"treat locks older than this as left over by a crashed run, 0 never",
+	)
+	return options
+}
+
+// lockInfo is the content of a lock, it identifies the run holding it.
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	RunID   string    `json:"run_id"`
+	Started time.Time `json:"started"`
+}
+
+// stale reports whether the run holding the lock is gone: its process no
+// longer exists on this host or the lock is older than staleAfter.
+func (l lockInfo) stale(staleAfter time.Duration) bool {
+	host, _ := os.Hostname()
+	if l.Host == host && l.PID != 0 && !processAlive(l.PID) {
+		return true
+	}
+	return staleAfter > 0 && time.Since(l.Started) > staleAfter
+}
+
+func (l lockInfo) String() string {
+	return fmt.Sprintf(
+		"run %s (pid %d on %s) since %s",
+		l.RunID,
+		l.PID,
+		l.Host,
+		l.Started.Format(time.RFC3339),
+	)
+}
+
+// runLock is held by a run against a target, so that overlapping runs,
+// e.g. from cron, don't race each other.
+type runLock struct {
+	localPath  string
+	remotePath string
+	httpClient *http.Client
+	token      string
+
+	// data is the content of the lock written by this run
+	data []byte
+}
+
+// lockFile returns the local lock file of target in the account of
+// token, below the user cache directory.
+func lockFile(target, token string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(target))
+	return filepath.Join(
+		cacheDir,
+		"ydu",
+		"locks",
+		accountKey(token)+"-"+hex.EncodeToString(sum[:8])+".lock",
+	), nil
+}
+
+// acquireLock locks target, waiting up to options.Wait for a run
+// holding it. Locks of crashed runs are taken over. target is a remote
+// folder, or a local one with an empty token.
+func acquireLock(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	target, token string,
+	options lockOptions,
+) (*runLock, error) {
+	localPath, err := lockFile(target, token)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(localPath), 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	data, err := json.Marshal(lockInfo{
+		PID:     os.Getpid(),
+		Host:    host,
+		RunID:   runID,
+		Started: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &runLock{
+		localPath:  localPath,
+		httpClient: httpClient,
+		token:      token,
+		data:       data,
+	}
+	if options.Remote {
+		lock.remotePath = path.Join(target, remoteLockName)
+	}
+
+	deadline := time.Now().Add(options.Wait)
+	waiting := false
+	for {
+		holder, err := lock.try(logger, data, options.StaleAfter)
+		if err != nil {
+			return nil, err
+		}
+		if holder == nil {
+			return lock, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf(
+				"%s is locked by %s, use --wait-lock to wait for it",
+				target,
+				holder,
+			)
+		}
+		if !waiting {
+			waiting = true
+			logger.Info(
+				"waiting for lock",
+				slog.String("target", target),
+				slog.String("holder", holder.String()),
+			)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// try takes the lock once and returns the holder when another run holds
+// it.
+func (l *runLock) try(
+	logger *slog.Logger,
+	data []byte,
+	staleAfter time.Duration,
+) (*lockInfo, error) {
+	for {
+		file, err := os.OpenFile(l.localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_, err = file.Write(data)
+			closeErr := file.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(l.localPath)
+				return nil, err
+			}
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		holder, err := readLocalLock(l.localPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !holder.stale(staleAfter) {
+			return holder, nil
+		}
+
+		logger.Warn(
+			"removing stale lock",
+			slog.String("path", l.localPath),
+			slog.String("holder", holder.String()),
+		)
+		err = os.Remove(l.localPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	if l.remotePath == "" {
+		return nil, nil
+	}
+
+	holder, err := l.tryRemote(logger, data, staleAfter)
+	if err != nil || holder != nil {
+		os.Remove(l.localPath)
+	}
+	return holder, err
+}
+
+// tryRemote creates the remote marker unless another run holds it.
+func (l *runLock) tryRemote(
+	logger *slog.Logger,
+	data []byte,
+	staleAfter time.Duration,
+) (*lockInfo, error) {
+	err := newRemoteDirs(l.httpClient, path.Dir(l.remotePath), l.token).
+		ensure(path.Dir(l.remotePath))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		uploadURL, err := createRequestOnUpload(
+			l.httpClient,
+			l.remotePath,
+			l.token,
+			false,
+		)
+		if err == nil {
+			err = uploadStream(
+				l.httpClient,
+				uploadURL,
+				bytes.NewReader(data),
+				int64(len(data)),
+			)
+			auditUpload(l.remotePath, l.token, int64(len(data)), err)
+			return nil, err
+		}
+		if !isAPIError(err, errDiskResourceAlreadyExists) {
+			return nil, err
+		}
+
+		content, err := downloadBlob(l.httpClient, l.remotePath, l.token)
+		if isAPIError(err, errDiskPathDoesntExists) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var holder lockInfo
+		err = json.Unmarshal(content, &holder)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lock %s: %w", l.remotePath, err)
+		}
+		if !holder.stale(staleAfter) {
+			return &holder, nil
+		}
+
+		logger.Warn(
+			"removing stale lock",
+			slog.String("path", l.remotePath),
+			slog.String("holder", holder.String()),
+		)
+		err = deleteResource(l.httpClient, l.remotePath, l.token, true)
+		if err != nil && !isAPIError(err, errDiskPathDoesntExists) {
+			return nil, err
+		}
+	}
+}
+
+// readLocalLock reads the lock file at localPath. A lock that is still
+// being written is dated by its modification time.
+func readLocalLock(localPath string) (*lockInfo, error) {
+	content, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var holder lockInfo
+	if json.Unmarshal(content, &holder) != nil {
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		holder = lockInfo{Started: info.ModTime()}
+	}
+	return &holder, nil
+}
+
+// release removes the lock, failures are logged since the lock becomes
+// stale anyway. A lock another run took over as stale in the meantime
+// is left to that run.
+func (l *runLock) release(logger *slog.Logger) {
+	if l.remotePath != "" {
+		content, err := downloadBlob(l.httpClient, l.remotePath, l.token)
+		if err == nil && !bytes.Equal(content, l.data) {
+			logger.Warn(
+				"remote lock was taken over by another run, leaving it",
+				slog.String("path", l.remotePath),
+			)
+		} else if err == nil {
+			err = deleteResource(l.httpClient, l.remotePath, l.token, true)
+		}
+		if err != nil && !isAPIError(err, errDiskPathDoesntExists) {
+			logger.Warn(
+				"Error during removing remote lock",
+				slog.String("path", l.remotePath),
+				slog.String("message", err.Error()),
+			)
+		}
+	}
+
+	content, err := os.ReadFile(l.localPath)
+	if err == nil && !bytes.Equal(content, l.data) {
+		logger.Warn(
+			"lock was taken over by another run, leaving it",
+			slog.String("path", l.localPath),
+		)
+		return
+	}
+	if err == nil {
+		err = os.Remove(l.localPath)
+	}
+	if err != nil {
+		logger.Warn(
+			"Error during removing lock",
+			slog.String("path", l.localPath),
+			slog.String("message", err.Error()),
+		)
+	}
+}
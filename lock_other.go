@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// processAlive reports whether a process with pid exists. On Windows
+// finding a process fails when it is gone, elsewhere locks only expire
+// by age.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fileLogMessages are the info messages logged for individual files. On
+// million-file runs they overwhelm log collectors, so with sampling they
+// are replaced by progress lines.
+var fileLogMessages = map[string]bool{
+	"src file size":                             true,
+	"upload url received":                       true,
+	"file uploaded successfully":                true,
+	"target exists, uploading under a new name": true,
+	"previous version kept":                     true,
+	"renamed file moved":                        true,
+	"deleting remote extra":                     true,
+	"downloading":                               true,
+	"linking":                                   true,
+	"file linked":                               true,
+	"deleting local extra":                      true,
+	"copying":                                   true,
+	"file restored":                             true,
+	"pruning":                                   true,
+	"removing stale partial upload":             true,
+}
+
+// fileDoneMessages are the file messages that count as a processed file
+// in the progress lines.
+var fileDoneMessages = map[string]bool{
+	"file uploaded successfully": true,
+	"downloading":                true,
+	"linking":                    true,
+	"file linked":                true,
+	"copying":                    true,
+	"file restored":              true,
+}
+
+// logSampling is set by the global --log-every and --log-interval flags.
+// With either set, file messages are only counted and a progress line
+// is logged every Every files or every Interval, whichever comes first.
+// Warnings and errors are always logged.
+var logSampling struct {
+	Every    int
+	Interval time.Duration
+}
+
+// setLogEvery configures logSampling from the value of --log-every.
+func setLogEvery(value string) error {
+	every, err := strconv.Atoi(value)
+	if err != nil || every < 0 {
+		return fmt.Errorf("invalid --log-every %q, expected a number of files", value)
+	}
+	logSampling.Every = every
+	return nil
+}
+
+// setLogInterval configures logSampling from the value of
+// --log-interval.
+func setLogInterval(value string) error {
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return fmt.Errorf("invalid --log-interval %q, expected a duration like 30s", value)
+	}
+	logSampling.Interval = interval
+	return nil
+}
+
+// newLogger returns the JSON logger of the process writing to w, with
+// file messages sampled when configured.
+func newLogger(w io.Writer) *slog.Logger {
+	var handler slog.Handler = slog.NewJSONHandler(w, nil)
+	if logSampling.Every > 0 || logSampling.Interval > 0 {
+		handler = &samplingHandler{
+			next: handler,
+			progress: &logProgress{
+				every:    logSampling.Every,
+				interval: logSampling.Interval,
+				last:     time.Now(),
+			},
+		}
+	}
+	return slog.New(handler).With(slog.String("run id", runID))
+}
+
+// logProgress counts the sampled file messages of a process.
+type logProgress struct {
+	every    int
+	interval time.Duration
+
+	mu         sync.Mutex
+	files      int
+	suppressed int
+	last       time.Time
+}
+
+// count records a file message and reports whether a progress line is
+// due, together with the totals to log.
+func (p *logProgress) count(message string, now time.Time) (bool, int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.suppressed++
+	due := false
+	if fileDoneMessages[message] {
+		p.files++
+		due = p.every > 0 && p.files%p.every == 0
+	}
+	if p.interval > 0 && now.Sub(p.last) >= p.interval {
+		due = true
+	}
+	if due {
+		p.last = now
+	}
+	return due, p.files, p.suppressed
+}
+
+// samplingHandler replaces the info records of individual files by
+// progress lines.
+type samplingHandler struct {
+	next     slog.Handler
+	progress *logProgress
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn || !fileLogMessages[r.Message] {
+		return h.next.Handle(ctx, r)
+	}
+
+	due, files, suppressed := h.progress.count(r.Message, r.Time)
+	if !due {
+		return nil
+	}
+
+	progress := slog.NewRecord(r.Time, slog.LevelInfo, "progress", r.PC)
+	progress.AddAttrs(
+		slog.Int("files", files),
+		slog.Int("sampled lines", suppressed),
+	)
+	return h.next.Handle(ctx, progress)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), progress: h.progress}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), progress: h.progress}
+}
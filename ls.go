@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// tagFilter selects resources by custom_properties, every key=value pair
+// has to match.
+type tagFilter []string
+
+func (f *tagFilter) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *tagFilter) Set(value string) error {
+	key, _, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+func (f tagFilter) matches(res resource) bool {
+	for _, tag := range f {
+		key, value, _ := strings.Cut(tag, "=")
+
+		property, ok := res.CustomProperties[key]
+		if !ok || propertyString(property) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func printResource(w io.Writer, name string, res resource, long bool) {
+	if res.Type == "dir" {
+		name += "/"
+	}
+
+	if !long {
+		fmt.Fprintln(w, name)
+		return
+	}
+
+	size := "-"
+	if res.Type != "dir" {
+		size = humanize.Bytes(uint64(res.Size))
+	}
+
+	fmt.Fprintf(
+		w,
+		"%s\t%s\t%s\n",
+		res.Modified.Local().Format(time.DateTime),
+		size,
+		name,
+	)
+}
+
+// printFields prints the attributes fields of res tab separated, or as
+// a JSON object with only these attributes when jsonOutput is set.
+func printFields(w io.Writer, res resource, fields []string, jsonOutput bool) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	var all map[string]any
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		selected := map[string]any{}
+		for _, field := range fields {
+			if value, ok := all[field]; ok {
+				selected[field] = value
+			}
+		}
+		return json.NewEncoder(w).Encode(selected)
+	}
+
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i] = "-"
+		if value, ok := all[field]; ok {
+			values[i] = propertyString(value)
+		}
+	}
+	_, err = fmt.Fprintln(w, strings.Join(values, "\t"))
+	return err
+}
+
+// runLs implements `ydu ls [-R] [-l] [--tag key=value] <remote-path>`.
+func runLs(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	recursive := flags.Bool(
+		"R",
+		false,
+		"list folders recursively",
+	)
+	long := flags.Bool(
+		"l",
+		false,
+		"print modification time and size",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print resources as JSON lines",
+	)
+	fieldList := flags.String(
+		"fields",
+		"",
+		"only fetch and print these comma separated attributes, e.g. path,size,md5",
+	)
+	var tags tagFilter
+	flags.Var(
+		&tags,
+		"tag",
+		"only list resources with this custom property key=value, may be repeated",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() > 1 {
+		return errors.New("usage: ydu ls [-R] [-l] [--tag key=value] [--fields a,b] [remote-path]")
+	}
+
+	fields := resourceFields
+	var printed []string
+	if *fieldList != "" {
+		var err error
+		printed, err = parseFields(*fieldList)
+		if err != nil {
+			return err
+		}
+		// listing needs the walk fields, --tag the custom properties
+		required := walkFields
+		if len(tags) > 0 {
+			required = append(slices.Clip(required), "custom_properties")
+		}
+		fields = slices.Clone(printed)
+		for _, field := range required {
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	remotePath, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	encoder := json.NewEncoder(os.Stdout)
+
+	visit := func(rel string, res resource) error {
+		if !tags.matches(res) {
+			return nil
+		}
+		if printed != nil {
+			return printFields(os.Stdout, res, printed, *jsonOutput)
+		}
+		if *jsonOutput {
+			return encoder.Encode(res)
+		}
+		printResource(w, rel, res, *long)
+		return nil
+	}
+
+	if *recursive {
+		err = walkRemoteFields(httpClient, remotePath, token, fields, visit)
+	} else {
+		var res *resource
+		res, err = getDiskResourceFields(httpClient, remotePath, token, fields)
+		if err == nil && res.Type != "dir" {
+			err = visit(res.Name, *res)
+		} else if err == nil {
+			for _, item := range res.Embedded.Items {
+				err = visit(path.Base(item.Path), item)
+				if err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,13 +9,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 )
 
-const yandexUploadUrl = "https://cloud-api.yandex.net/v1/disk/resources/upload"
-
 func uploadFile(
 	httpClient *http.Client,
 	uploadURL, filePath string,
@@ -29,10 +32,44 @@ func uploadFile(
 	}
 	defer file.Close()
 
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf(
+			"filed to stat source file: %v",
+			err,
+		)
+	}
+
+	return uploadStream(
+		httpClient,
+		uploadURL,
+		file,
+		fileInfo.Size(),
+	)
+}
+
+// uploadStream uploads size bytes read from body to uploadURL.
+func uploadStream(
+	httpClient *http.Client,
+	uploadURL string,
+	body io.Reader,
+	size int64,
+) error {
+	err := checkWritable(http.MethodPut, "upload")
+	if err != nil {
+		return err
+	}
+
 	req, err := http.NewRequest(
 		http.MethodPut,
 		uploadURL,
-		file,
+		pausableReader{
+			r: throttledReader{
+				r:       countingReader{r: body, n: &transferUsage.Uploaded},
+				limiter: &bandwidth,
+			},
+			gate: &transfers,
+		},
 	)
 	if err != nil {
 		return fmt.Errorf(
@@ -40,6 +77,7 @@ func uploadFile(
 			err,
 		)
 	}
+	req.ContentLength = size
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -53,9 +91,8 @@ func uploadFile(
 	if resp.StatusCode != http.StatusCreated {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf(
-			"upload error: %s, body: %s",
-			resp.Status,
-			string(body),
+			"upload error: %w",
+			newAPIError(resp, body),
 		)
 	}
 
@@ -69,76 +106,378 @@ type UploadTarget struct {
 	Templated   bool   `json:"templated"`
 }
 
+// createRequestOnUpload requests an upload url for yandexDiskPath.
 func createRequestOnUpload(
 	httpClient *http.Client,
 	yandexDiskPath,
 	token string,
-) (*string, error) {
+	overwrite bool,
+) (string, error) {
+
+	// fail before anything is read from the source
+	err := checkWritable(http.MethodPut, yandexDiskPath)
+	if err != nil {
+		return "", err
+	}
 
 	params := url.Values{}
 	params.Add("path", yandexDiskPath)
+	if overwrite {
+		params.Add("overwrite", "true")
+	}
 
-	u, err := url.Parse(yandexUploadUrl)
+	// server errors are retried by apiRequest
+	var target UploadTarget
+	err = apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/resources/upload",
+		params,
+		token,
+		&target,
+	)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	u.RawQuery = params.Encode()
+	if target.Href == "" {
+		return "", errors.New("no upload url in the response")
+	}
+	return target.Href, nil
+}
 
-	req, err := http.NewRequest(
-		http.MethodGet,
-		u.String(),
-		nil,
+// requestUploadURL requests an upload url for remotePath like
+// createRequestOnUpload, with errors worded for file uploads.
+func requestUploadURL(
+	httpClient *http.Client,
+	remotePath, token string,
+	overwrite bool,
+) (string, error) {
+	uploadUrl, err := createRequestOnUpload(
+		httpClient,
+		remotePath,
+		token,
+		overwrite,
 	)
+	if isAPIError(err, errDiskResourceAlreadyExists) {
+		return "", fmt.Errorf(
+			"%s already exists, use --overwrite or --on-conflict: %w",
+			remotePath,
+			err,
+		)
+	}
+	if err != nil {
+		return "", fmt.Errorf(
+			"error during create upload request to yandex disk: %w",
+			err,
+		)
+	}
+	return uploadUrl, nil
+}
 
+// transferFile requests an upload url for remotePath and uploads
+// localPath to it.
+func transferFile(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	localPath, remotePath, token string,
+	overwrite bool,
+) error {
+	uploadUrl, err := requestUploadURL(httpClient, remotePath, token, overwrite)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	req.Header.Add(
-		"Authorization",
-		fmt.Sprintf("OAuth %s", token),
+	logger.Info("upload url received")
+
+	started := time.Now()
+	err = uploadFile(
+		httpClient,
+		uploadUrl,
+		localPath,
 	)
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
+	var size int64
+	if info, statErr := os.Stat(localPath); statErr == nil {
+		size = info.Size()
 	}
+	// a listing fetched while the file was uploading misses it
+	memo.Invalidate(remotePath)
+	auditUpload(remotePath, token, size, err)
+	recordTransfer("upload", size, time.Since(started), err)
+	return err
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, err
+// diskToken returns the yandex disk token from the environment or the
+// config file, its token_file or token_cmd.
+func diskToken() (string, error) {
+	token := os.Getenv("YANDEX_DISK_TOKEN")
+	if token == "" {
+		c, err := loadConfig()
+		if err != nil {
+			return "", err
+		}
+		token, err = c.token()
+		if err != nil {
+			return "", err
+		}
+	}
+	if token == "" {
+		return "", errors.New("pass ENV variable with yandex disk token YANDEX_DISK_TOKEN or run ydu init")
 	}
+	return token, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// newHTTPClient returns the http client used by the commands. Requests
+// time out after timeoutSec, not counting the time transfers are paused.
+func newHTTPClient(timeoutSec int) *http.Client {
+	return &http.Client{
+		Transport: pauseAwareTimeout{
+			next:    httpTransport(),
+			timeout: time.Second * time.Duration(timeoutSec),
+			gate:    &transfers,
+		},
 	}
+}
 
-	resp.Body.Close()
+// commands returns the subcommands ydu supports besides the default
+// upload mode. Subcommands log to stderr so their stdout can be piped.
+func commands() map[string]func(logger *slog.Logger, args []string) error {
+	return map[string]func(logger *slog.Logger, args []string) error{
+		"apply":        runApply,
+		"archive":      runArchive,
+		"audit":        runAudit,
+		"backup":       runBackup,
+		"batch":        runBatch,
+		"bench":        runBench,
+		"cat":          runCat,
+		"check":        runCheck,
+		"config":       runConfig,
+		"du":           runDu,
+		"find":         runFind,
+		"fsck":         runFsck,
+		"gc":           runGc,
+		"get-public":   runGetPublic,
+		"hash":         runHash,
+		"history":      runHistory,
+		"init":         runInit,
+		"ls":           runLs,
+		"meta":         runMeta,
+		"ops":          runOps,
+		"promote":      runPromote,
+		"prune":        runPrune,
+		"pull":         runPull,
+		"repo":         runRepo,
+		"recent":       runRecent,
+		"restore":      runRestore,
+		"resume":       runResume,
+		"run":          runJobs,
+		"save-public":  runSavePublic,
+		"service":      runService,
+		"trash":        runTrash,
+		"tree":         runTree,
+		"systemd":      runSystemd,
+		"usage":        runUsage,
+		"watch-remote": runWatchRemote,
+		"whoami":       runWhoami,
+		"xcopy":        runXcopy,
+	}
+}
 
-	var target UploadTarget
+// globalArgs are the global flags removed by parseGlobalFlags, which
+// jobs pass on to the ydu processes they start.
+var globalArgs []string
 
-	err = json.Unmarshal(
-		[]byte(body),
-		&target,
-	)
+// globalValueFlags are the global flags that take a value, given as
+// --flag=value or --flag value.
+var globalValueFlags = map[string]bool{
+	"chaos":            true,
+	"user-agent":       true,
+	"listing-ttl":      true,
+	"log-every":        true,
+	"log-interval":     true,
+	"api-url":          true,
+	"ip-version":       true,
+	"dns":              true,
+	"statsd-addr":      true,
+	"list-concurrency": true,
+	"max-memory":       true,
+}
 
-	if err != nil {
-		return nil, err
+// parseGlobalFlags removes the flags that apply to every command from
+// args, e.g. --dump-http[=headers|full], --read-only, --notify,
+// --listing-ttl <duration> and --user-agent <value>.
+func parseGlobalFlags(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			// everything after -- belongs to a wrapped command
+			return append(rest, args[i:]...), nil
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue && strings.HasPrefix(name, "-") &&
+			globalValueFlags[strings.TrimLeft(name, "-")] {
+			// --flag value, passed on to jobs as --flag=value
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("flag needs an argument: %s", name)
+			}
+			i++
+			value = args[i]
+			arg = name + "=" + value
+		}
+		switch name {
+		case "--dump-http", "-dump-http":
+			err := setDumpMode(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--read-only", "-read-only":
+			on, err := globalFlagBool(name, value, hasValue)
+			if err != nil {
+				return nil, err
+			}
+			setReadOnly(on, "--read-only")
+		case "--notify", "-notify":
+			on, err := globalFlagBool(name, value, hasValue)
+			if err != nil {
+				return nil, err
+			}
+			notifyDesktop = on
+		case "--chaos", "-chaos":
+			// hidden, for exercising retries in integration tests
+			err := setChaos(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--user-agent", "-user-agent":
+			userAgent = value
+		case "--listing-ttl", "-listing-ttl":
+			err := setListingTTL(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--log-every", "-log-every":
+			err := setLogEvery(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--log-interval", "-log-interval":
+			err := setLogInterval(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--api-url", "-api-url":
+			err := setAPIURL(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--ip-version", "-ip-version":
+			err := setIPVersion(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--dns", "-dns":
+			err := setDNS(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--statsd-addr", "-statsd-addr":
+			err := setStatsD(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--list-concurrency", "-list-concurrency":
+			err := setListConcurrency(value)
+			if err != nil {
+				return nil, err
+			}
+		case "--max-memory", "-max-memory":
+			err := setMaxMemory(value)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+		globalArgs = append(globalArgs, arg)
 	}
+	return rest, nil
+}
 
-	return &target.Href, nil
+// globalFlagBool parses the value of the boolean global flag name like
+// the flag package does, the flag alone means true.
+func globalFlagBool(name, value string, hasValue bool) (bool, error) {
+	if !hasValue {
+		return true, nil
+	}
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %q is not a boolean", name, value)
+	}
+	return on, nil
 }
 
 func main() {
-	logger := slog.New(
-		slog.NewJSONHandler(os.Stdout, nil),
-	)
+	applyConfigGlobals()
+
+	err := applyGlobalEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	args, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Args = append(os.Args[:1], args...)
+
+	if len(os.Args) > 1 {
+		if run, ok := commands()[os.Args[1]]; ok {
+			logger := newLogger(os.Stderr)
+
+			err := run(logger, os.Args[2:])
+			notifyFinished(logger, os.Args[1], err)
+			if historyCommands[os.Args[1]] {
+				result := "ok"
+				if err != nil {
+					result = "failed"
+				} else if runTotals.Failed.Load() > 0 {
+					result = "partial"
+				}
+				recordRun(os.Args[1], result, err)
+			}
+			recordUsage()
+			if err != nil {
+				attrs := append(
+					[]any{slog.String("message", err.Error())},
+					apiErrorAttrs(err)...,
+				)
+				if isAPIError(err, errUnauthorized) {
+					attrs = append(attrs, slog.String("hint", "check YANDEX_DISK_TOKEN"))
+				}
+
+				logger.Error("Error during "+os.Args[1], attrs...)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	runUpload()
+}
+
+func runUpload() {
+	logger := newLogger(os.Stdout)
 
 	filePath := flag.String(
 		"path-to-file",
 		"",
-		"path to source file",
+		"path to source file or directory",
 	)
 	yandexDiskUploadPath := flag.String(
 		"target-yandex-disk-path",
@@ -150,21 +489,340 @@ func main() {
 		900,
 		"http client timeout (sec)",
 	)
+	junitReportPath := flag.String(
+		"report-junit",
+		"",
+		"write a JUnit XML report of file transfers to this path",
+	)
+	uploadOrder := flag.String(
+		"order",
+		"alpha",
+		"upload queue order: size-asc, size-desc, mtime (newest first) or alpha",
+	)
+	maxFileSize := flag.String(
+		"max-file-size",
+		"",
+		"skip files larger than this size, e.g. 1GB or 50GiB",
+	)
+	smallFileSize := flag.String(
+		"small-file-size",
+		defaultSmallFileSize,
+		"files smaller than this are uploaded in parallel by --small-file-concurrency workers, 0 sends every file through --large-file-concurrency",
+	)
+	smallFileConcurrency := flag.Int(
+		"small-file-concurrency",
+		defaultSmallFileConcurrency,
+		"number of small files uploaded in parallel",
+	)
+	largeFileConcurrency := flag.Int(
+		"large-file-concurrency",
+		defaultLargeFileConcurrency,
+		"number of files of at least --small-file-size uploaded in parallel, next to the small ones",
+	)
+	adaptive := flag.Bool(
+		"adaptive",
+		false,
+		"adapt the number of parallel uploads of each pool, up to its concurrency, to the throughput and rate limiting",
+	)
+	overwrite := flag.Bool(
+		"overwrite",
+		false,
+		"overwrite existing files on yandex disk",
+	)
+	onConflict := flag.String(
+		"on-conflict",
+		"fail",
+		"what to do when the target exists and --overwrite is not set: fail, rename (name (1).ext) or timestamp",
+	)
+	forceOverwrite := flag.Bool(
+		"force-overwrite",
+		false,
+		"with --overwrite, also replace files changed on yandex disk since ydu last uploaded or downloaded them",
+	)
+	backupDir := flag.String(
+		"backup-dir",
+		"",
+		"with --overwrite, move replaced files into this folder first, {date} is the date of the run",
+	)
+	deleteExtra := flag.Bool(
+		"delete",
+		false,
+		"after uploading a directory, delete remote files that do not exist locally",
+	)
+	permanent := flag.Bool(
+		"permanent",
+		false,
+		"with --delete, delete permanently instead of moving to the trash",
+	)
+	maxDelete := deleteLimit{Percent: 50}
+	flag.Var(
+		&maxDelete,
+		"max-delete",
+		"abort --delete when it would remove more remote files than this count or percentage",
+	)
+	forceDelete := flag.Bool(
+		"force-delete",
+		false,
+		"delete remote extras even beyond --max-delete",
+	)
+	detectRenames := flag.Bool(
+		"detect-renames",
+		true,
+		"with --delete, move remote files whose content matches a new local file instead of uploading it again",
+	)
+	caseCollisions := flag.String(
+		"case-collisions",
+		"warn",
+		"what to do with files whose names differ only by case: warn, fail or rename (name~2.ext)",
+	)
+	sanitize := flag.String(
+		"sanitize",
+		"skip",
+		"what to do with file names yandex disk rejects: replace, encode or skip",
+	)
+	hardLinks := flag.Bool(
+		"hard-links",
+		false,
+		"upload hard links of a file as server side copies of it and record the link for pull and restore",
+	)
+	var verify verifyMode
+	flag.Var(
+		&verify,
+		"verify",
+		"after the upload check the size and md5 of uploaded files on yandex disk: off, all or sample:<percent>%, e.g. sample:5%",
+	)
+	verifyDownload := flag.Bool(
+		"verify-download",
+		false,
+		"verify by downloading the checked files again instead of trusting the md5 yandex disk reports",
+	)
+	sparse := flag.Bool(
+		"sparse",
+		false,
+		"upload sparse files, e.g. disk images, without their zero blocks; pull and restore expand them again",
+	)
+	preservePerms := flag.Bool(
+		"preserve-perms",
+		false,
+		"record the mode, owner and group of files in custom properties for pull and restore --preserve-perms",
+	)
+	atomic := flag.Bool(
+		"atomic",
+		false,
+		"upload to a temporary name and move it into place when complete",
+	)
+	cleanupFailed := flag.Bool(
+		"cleanup-failed",
+		false,
+		"delete what a failed upload left on yandex disk",
+	)
+	filesFrom := flag.String(
+		"files-from",
+		"",
+		"upload the files listed in this file, one per line, - reads stdin; relative paths are resolved against --path-to-file",
+	)
+	filesFromNul := flag.Bool(
+		"0",
+		false,
+		"--files-from entries are separated by NUL instead of newlines",
+	)
+	maxTransfer := flag.String(
+		"max-transfer",
+		"",
+		"stop the run before the transferred data exceeds this size, e.g. 200G",
+	)
+	maxDuration := flag.Duration(
+		"max-duration",
+		0,
+		"do not start new files after the run took this long, e.g. 6h",
+	)
+	dryRun := flag.Bool(
+		"dry-run",
+		false,
+		"only log the moves, uploads and deletes the run would perform",
+	)
+	planOutput := flag.String(
+		"output",
+		"",
+		"with --dry-run, write the planned operations to this JSON file for ydu apply",
+	)
+	autoPromote := flag.Bool(
+		"auto-promote",
+		false,
+		"move the staging copy of a protected target into place once the upload completed without failures",
+	)
+	deadline := flag.String(
+		"deadline",
+		"",
+		"do not start new files after this time of day, e.g. 06:30, and keep the rest for ydu resume",
+	)
+	saveRemaining := flag.String(
+		"save-remaining",
+		"",
+		"when a budget stops the run, write the files not uploaded to this file for --files-from",
+	)
+	failureManifestPath := flag.String(
+		"failure-manifest",
+		"",
+		"write the files that failed to upload to this JSON file",
+	)
+	retryFailed := flag.String(
+		"retry-failed",
+		"",
+		"only upload the files listed in this --failure-manifest of a previous run",
+	)
+	var bwlimit bandwidthSchedule
+	flag.Var(
+		&bwlimit,
+		"bwlimit",
+		"limit transfer speed in bytes per second, e.g. 2M, or per time of day: 08:00-18:00=2M,18:00-08:00=unlimited",
+	)
+	unicodeNormalize := unicodeNone
+	flag.Var(
+		&unicodeNormalize,
+		"unicode-normalize",
+		"upload file names in this unicode form: nfc, nfd or none",
+	)
+	var alsoTo stringList
+	flag.Var(
+		&alsoTo,
+		"also-to",
+		"also upload every file to this destination: a path, <account>=<path> or local:<dir>, may be repeated",
+	)
+	var priorityPatterns stringList
+	flag.Var(
+		&priorityPatterns,
+		"priority-pattern",
+		"upload files matching this glob first, may be repeated",
+	)
+	excluding := addExcludeFlags(flag.CommandLine)
+	locking := addLockFlags(flag.CommandLine, true)
 
-	token := os.Getenv("YANDEX_DISK_TOKEN")
+	cfg, err := loadConfig()
+	if err == nil {
+		err = applyConfigDefaults(flag.CommandLine, cfg)
+	}
+	if err == nil {
+		_, err = applyEnvFlags(flag.CommandLine)
+	}
+	if err != nil {
+		logger.Error(
+			"Error during loading config",
+			slog.String("message", err.Error()),
+		)
+		os.Exit(1)
+	}
 
 	flag.Parse()
 
-	if *filePath == "" ||
+	token, err := diskToken()
+	if err != nil && (cfg.TokenFile != "" || cfg.TokenCmd != "") {
+		logger.Error(
+			"Error during reading token",
+			slog.String("message", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	if ((*filePath == "" && *filesFrom == "") ||
 		*yandexDiskUploadPath == "" ||
-		token == "" {
+		token == "") && (*retryFailed == "" || token == "") {
 		logger.Error(
-			"please set --path-to-file, --target-yandex-disk-path, and pass ENV variable with yandex disk token YANDEX_DISK_TOKEN",
+			"please set --path-to-file or --files-from, --target-yandex-disk-path, and pass ENV variable with yandex disk token YANDEX_DISK_TOKEN, or run ydu init",
 		)
 		os.Exit(1)
 	}
 
-	fileInfo, err := os.Stat(*filePath)
+	if *yandexDiskUploadPath != "" {
+		*yandexDiskUploadPath, err = resolveRemotePath(
+			newHTTPClient(*httpClientTimeout),
+			*yandexDiskUploadPath,
+			token,
+		)
+		if err != nil {
+			logger.Error(
+				"Error during checking token access",
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
+	// a versions folder below the target would be moved into itself, or
+	// deleted as a remote extra by --delete
+	if *backupDir != "" && *yandexDiskUploadPath != "" {
+		versions, err := resolveRemotePath(
+			newHTTPClient(*httpClientTimeout),
+			*backupDir,
+			token,
+		)
+		if err == nil && isBelow(diskPath(versions), diskPath(*yandexDiskUploadPath)) {
+			err = fmt.Errorf(
+				"%s is below the target %s, choose a folder outside of it",
+				*backupDir,
+				*yandexDiskUploadPath,
+			)
+		}
+		if err != nil {
+			logger.Error(
+				"Error during checking --backup-dir",
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
+	if *planOutput != "" && !*dryRun {
+		logger.Error("--output requires --dry-run")
+		os.Exit(1)
+	}
+
+	// uploads to a protected path go to its staging copy, a dry run
+	// plans against the path itself
+	production := ""
+	if *yandexDiskUploadPath != "" && !*dryRun {
+		production = cfg.protectedPath(*yandexDiskUploadPath)
+	}
+	if production != "" {
+		info, statErr := os.Stat(*filePath)
+		*yandexDiskUploadPath, err = prepareStaging(
+			logger,
+			newHTTPClient(*httpClientTimeout),
+			production,
+			token,
+			statErr == nil && info.IsDir(),
+		)
+		if err != nil {
+			logger.Error(
+				"Error during preparing staging copy",
+				slog.String("path", production),
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
+	var queue []uploadItem
+	var unreadable []unreadableEntry
+	if *retryFailed != "" {
+		var target string
+		queue, target, err = buildRetryQueue(*retryFailed)
+		if *yandexDiskUploadPath == "" {
+			*yandexDiskUploadPath = target
+		}
+	} else if *filesFrom != "" {
+		queue, err = buildFilesFromQueue(
+			*filesFrom,
+			*filesFromNul,
+			*filePath,
+			*yandexDiskUploadPath,
+		)
+	} else {
+		queue, unreadable, err = buildUploadQueue(
+			*filePath,
+			*yandexDiskUploadPath,
+		)
+	}
 	if err != nil {
 		logger.Error(
 			"Error dusting checking source file existence",
@@ -174,61 +832,929 @@ func main() {
 		os.Exit(1)
 	}
 
-	httpClient := http.Client{
-		Timeout: time.Second * time.Duration(
-			*httpClientTimeout,
-		),
+	excludePatterns, err := excluding.excludes()
+	if err != nil {
+		logger.Error(
+			"Error during parsing excludes",
+			slog.String("message", err.Error()),
+		)
+		os.Exit(1)
 	}
+	// files given explicitly are uploaded whatever their name
+	if info, statErr := os.Stat(*filePath); statErr == nil && info.IsDir() &&
+		*filesFrom == "" && *retryFailed == "" {
+		var excluded []uploadItem
+		queue, excluded = excludeQueue(queue, excludePatterns)
+		if len(excluded) > 0 {
+			logger.Info(
+				"excluded files",
+				slog.Int("files", len(excluded)),
+			)
+		}
 
-	logger.Info(
-		"src file size",
-		slog.String(
-			"src file path",
-			*filePath,
-		),
-		slog.String(
-			"size",
-			humanize.Bytes(
-				uint64(fileInfo.Size()),
-			),
-		),
-		slog.String(
-			"target yandex disk path",
-			*yandexDiskUploadPath,
-		),
+		readable := unreadable[:0:0]
+		for _, entry := range unreadable {
+			if !excludePatterns.match(entry.RelPath) {
+				readable = append(readable, entry)
+			}
+		}
+		unreadable = readable
+	}
+
+	err = orderUploadQueue(
+		queue,
+		*uploadOrder,
+		priorityPatterns,
 	)
+	if err != nil {
+		logger.Error(
+			"Error during ordering upload queue",
+			slog.String("message", err.Error()),
+		)
+		os.Exit(1)
+	}
 
-	uploadUrl, err := createRequestOnUpload(
-		&httpClient,
+	if !validSanitizeStrategy(*sanitize) {
+		logger.Error(
+			"unknown --sanitize strategy, use replace, encode or skip",
+			slog.String("sanitize", *sanitize),
+		)
+		os.Exit(1)
+	}
+
+	normalizeQueue(queue, unicodeNormalize)
+
+	queue, records := sanitizeQueue(queue, *sanitize)
+	for _, record := range records {
+		logger.Warn(
+			"skipping file",
+			slog.String("file", record.LocalPath),
+			slog.String("reason", record.SkipReason),
+		)
+	}
+
+	// unreadable entries fail on their own, the rest is still uploaded
+	for _, entry := range unreadable {
+		logger.Error(
+			"Error during reading file",
+			slog.String("file", entry.LocalPath),
+			slog.String("message", entry.Err.Error()),
+		)
+		records = append(records, transferRecord{
+			LocalPath:  entry.LocalPath,
+			RemotePath: entry.RemotePath,
+			Err:        entry.Err,
+		})
+	}
+
+	if !validCollisionPolicy(*caseCollisions) {
+		logger.Error(
+			"unknown --case-collisions policy, use warn, fail or rename",
+			slog.String("case-collisions", *caseCollisions),
+		)
+		os.Exit(1)
+	}
+
+	collisions := findCaseCollisions(queue)
+	for _, collision := range collisions {
+		var paths []string
+		for _, i := range collision {
+			paths = append(paths, queue[i].LocalPath)
+		}
+		logger.Warn(
+			"file names differ only by case",
+			slog.Any("files", paths),
+			slog.String("case-collisions", *caseCollisions),
+		)
+	}
+	if len(collisions) > 0 {
+		switch *caseCollisions {
+		case "fail":
+			logger.Error(
+				"refusing to upload files whose names differ only by case, use --case-collisions warn or rename",
+				slog.Int("collisions", len(collisions)),
+			)
+			os.Exit(1)
+		case "rename":
+			resolveCaseCollisions(queue, collisions)
+		}
+	}
+
+	if !validConflictStrategy(*onConflict) {
+		logger.Error(
+			"unknown --on-conflict strategy, use fail, rename or timestamp",
+			slog.String("on-conflict", *onConflict),
+		)
+		os.Exit(1)
+	}
+
+	var maxFileSizeBytes uint64
+	if *maxFileSize != "" {
+		maxFileSizeBytes, err = humanize.ParseBytes(*maxFileSize)
+		if err != nil {
+			logger.Error(
+				"Error during parsing --max-file-size",
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+
+	var maxTransferBytes uint64
+	if *maxTransfer != "" {
+		maxTransferBytes, err = humanize.ParseBytes(*maxTransfer)
+		if err != nil {
+			logger.Error(
+				"Error during parsing --max-transfer",
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+	var deadlineTime time.Time
+	if *deadline != "" {
+		deadlineTime, err = parseDeadline(*deadline, time.Now())
+		if err != nil {
+			logger.Error(
+				"Error during parsing --deadline",
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+	}
+	budget := newRunBudget(maxTransferBytes, *maxDuration, deadlineTime)
+
+	if *dryRun {
+		plan := uploadPlan{
+			Source:     absPath(*filePath),
+			Target:     *yandexDiskUploadPath,
+			Overwrite:  *overwrite,
+			OnConflict: *onConflict,
+			Permanent:  *permanent,
+		}
+		planning := planOptions{
+			Mirror: *deleteExtra && *filePath != "" && *filesFrom == "" && *retryFailed == "",
+			// moved files would be missing at the --also-to destinations
+			DetectRenames: *detectRenames && len(alsoTo) == 0,
+			MaxFileSize:   maxFileSizeBytes,
+			Excludes:      excludePatterns,
+			DeleteLimit:   &maxDelete,
+		}
+		if *forceDelete {
+			planning.DeleteLimit = nil
+		}
+
+		err = buildUploadPlan(
+			newHTTPClient(*httpClientTimeout),
+			&plan,
+			token,
+			queue,
+			records,
+			planning,
+		)
+		if err == nil && *planOutput != "" {
+			err = writePlan(*planOutput, &plan)
+		}
+		if err != nil {
+			logger.Error(
+				"Error during planning upload",
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+
+		logPlan(logger, &plan)
+		return
+	}
+
+	smallFileSizeBytes, err := humanize.ParseBytes(*smallFileSize)
+	if err != nil {
+		logger.Error(
+			"Error during parsing --small-file-size",
+			slog.String("message", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	bandwidth.SetSchedule(bwlimit)
+	handlePauseSignals(logger)
+	handleStopSignals(logger)
+
+	err = remoteRevisions.Open()
+	if err != nil {
+		logger.Warn(
+			"Error during loading remote revisions",
+			slog.String("message", err.Error()),
+		)
+	}
+
+	err = sdNotify("READY=1")
+	if err != nil {
+		logger.Warn(
+			"Error during systemd readiness notification",
+			slog.String("message", err.Error()),
+		)
+	}
+	stopWatchdog := startWatchdog(logger)
+
+	options := uploadOptions{
+		Overwrite:  *overwrite,
+		OnConflict: *onConflict,
+		Atomic:     *atomic,
+
+		CleanupFailed:  *cleanupFailed,
+		ForceOverwrite: *forceOverwrite,
+		Sparse:         *sparse,
+	}
+	if *backupDir != "" {
+		options.Versions = newVersionsDir(*backupDir, time.Now())
+	}
+
+	dirs := newRemoteDirs(
+		httpClient,
 		*yandexDiskUploadPath,
 		token,
 	)
 
+	var fanOut []*fanOutTarget
+	for _, spec := range alsoTo {
+		target, err := newFanOutTarget(httpClient, spec)
+		if err != nil {
+			logger.Error(
+				"Error during preparing upload destination",
+				slog.String("destination", spec),
+				slog.String("message", err.Error()),
+			)
+			os.Exit(1)
+		}
+		fanOut = append(fanOut, target)
+	}
+
+	runTarget = *yandexDiskUploadPath
+
+	// a single file is uploaded to the target path itself, the folder
+	// holding it is locked
+	lockTarget := *yandexDiskUploadPath
+	if info, statErr := os.Stat(*filePath); statErr == nil && !info.IsDir() &&
+		*filesFrom == "" && *retryFailed == "" {
+		lockTarget = path.Dir(lockTarget)
+	}
+	lock, err := acquireLock(
+		logger,
+		httpClient,
+		lockTarget,
+		token,
+		*locking,
+	)
 	if err != nil {
 		logger.Error(
-			"Error during create upload request to yandex disk",
+			"Error during locking target",
 			slog.String("message", err.Error()),
 		)
 		os.Exit(1)
 	}
 
-	logger.Info("upload url received")
+	mirroring := *deleteExtra && *filePath != "" && *filesFrom == "" && *retryFailed == ""
 
-	err = uploadFile(
-		&httpClient,
-		*uploadUrl,
-		*filePath,
+	// moved files would be missing at the --also-to destinations
+	var moved map[string]bool
+	if mirroring && *detectRenames && len(fanOut) == 0 {
+		err = localHashes.Open(false)
+		if err == nil {
+			moved, err = moveRenamedFiles(
+				logger,
+				httpClient,
+				dirs,
+				*yandexDiskUploadPath,
+				token,
+				queue,
+				excludePatterns,
+			)
+		}
+		if err != nil {
+			logger.Warn(
+				"Error during detecting renamed files",
+				slog.String("message", err.Error()),
+			)
+		}
+	}
+
+	// the moved files are in place and only kept by --delete
+	pending := queue[:0:0]
+	for _, item := range queue {
+		if !moved[item.RemotePath] {
+			pending = append(pending, item)
+		}
+	}
+	queue = pending
+
+	// oversized files are skipped before the run, they are not left over
+	sized := queue[:0:0]
+	for _, item := range queue {
+		if maxFileSizeBytes == 0 || uint64(item.Size) <= maxFileSizeBytes {
+			sized = append(sized, item)
+			continue
+		}
+
+		reason := fmt.Sprintf(
+			"file size %s exceeds --max-file-size %s",
+			humanize.Bytes(uint64(item.Size)),
+			humanize.Bytes(maxFileSizeBytes),
+		)
+		logger.Warn(
+			"skipping file",
+			slog.String("file", item.LocalPath),
+			slog.String("reason", reason),
+		)
+		records = append(records, transferRecord{
+			LocalPath:  item.LocalPath,
+			RemotePath: item.RemotePath,
+			Size:       item.Size,
+			SkipReason: reason,
+		})
+	}
+	queue = sized
+
+	journal := newRunJournal(*yandexDiskUploadPath)
+	err = journal.write(queue)
+	if err != nil {
+		logger.Warn(
+			"Error during writing run journal",
+			slog.String("message", err.Error()),
+		)
+	}
+
+	// hard links are copied from the file they link to once it is
+	// uploaded, copies would be missing at the --also-to destinations
+	linkOf := map[string]string{}
+	var linkItems []uploadItem
+	if *hardLinks && len(fanOut) == 0 {
+		links := findHardLinks(queue)
+		primaries := queue[:0:0]
+		for i, item := range queue {
+			if j, found := links[i]; found {
+				linkOf[item.LocalPath] = queue[j].LocalPath
+				linkItems = append(linkItems, item)
+				continue
+			}
+			primaries = append(primaries, item)
+		}
+		queue = primaries
+	}
+
+	// mu guards the results of the parallel uploads
+	var mu sync.Mutex
+	failed := len(unreadable)
+	outOfSpace, interrupted := false, false
+	// outOfSpaceBytes is the size of the files that did not fit
+	var outOfSpaceBytes int64
+	// stopReason is why no further files are started
+	stopReason := ""
+
+	start := func(item uploadItem) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if stopReason == "" && stopRequested.Load() {
+			interrupted = true
+			stopReason = "run interrupted"
+		}
+		if stopReason == "" {
+			stopReason = budget.exceededBy(item)
+		}
+		if stopReason != "" {
+			return false
+		}
+
+		budget.add(item)
+		return true
+	}
+
+	upload := func(item uploadItem) error {
+		logger.Info(
+			"src file size",
+			slog.String(
+				"src file path",
+				item.LocalPath,
+			),
+			slog.String(
+				"size",
+				humanize.Bytes(
+					uint64(item.Size),
+				),
+			),
+			slog.String(
+				"target yandex disk path",
+				item.RemotePath,
+			),
+		)
+
+		started := time.Now()
+		original := item
+
+		err := uploadQueueItem(
+			logger,
+			httpClient,
+			dirs,
+			&item,
+			token,
+			options,
+		)
+
+		mu.Lock()
+		records = append(records, transferRecord{
+			LocalPath:  item.LocalPath,
+			RemotePath: item.RemotePath,
+			Size:       item.Size,
+			Duration:   time.Since(started),
+			Err:        err,
+		})
+		if err != nil {
+			budget.release(item)
+		}
+		if insufficientStorage(err) {
+			// the following files would fail the same way
+			outOfSpace = true
+			outOfSpaceBytes += item.Size
+			stopReason = "not enough space on yandex disk"
+			mu.Unlock()
+			return err
+		}
+		mu.Unlock()
+
+		for _, target := range fanOut {
+			fanOutErr := target.upload(
+				logger,
+				httpClient,
+				original,
+				*yandexDiskUploadPath,
+				options,
+			)
+
+			mu.Lock()
+			if fanOutErr != nil {
+				target.Failed++
+			} else {
+				target.Uploaded++
+			}
+			mu.Unlock()
+
+			if fanOutErr != nil {
+				logger.Error(
+					"Error during upload file",
+					slog.String("file", item.LocalPath),
+					slog.String("destination", target.Spec),
+					slog.String("message", fanOutErr.Error()),
+				)
+			}
+		}
+
+		if err != nil {
+			mu.Lock()
+			failed++
+			mu.Unlock()
+
+			logger.Error(
+				"Error during upload file",
+				append(
+					[]any{
+						slog.String("file", item.LocalPath),
+						slog.String("message", err.Error()),
+					},
+					apiErrorAttrs(err)...,
+				)...,
+			)
+			return err
+		}
+
+		if item.OriginalPath != "" {
+			_, err = setCustomProperties(
+				httpClient,
+				item.RemotePath,
+				token,
+				map[string]any{originalPathProperty: item.OriginalPath},
+			)
+			if err != nil {
+				logger.Warn(
+					"Error during recording original file name",
+					slog.String("file", item.LocalPath),
+					slog.String("message", err.Error()),
+				)
+			}
+		}
+
+		if *preservePerms {
+			err = recordPermissions(httpClient, item, token)
+			if err != nil {
+				logger.Warn(
+					"Error during recording permissions",
+					slog.String("file", item.LocalPath),
+					slog.String("message", err.Error()),
+				)
+			}
+		}
+
+		logger.Info(
+			"file uploaded successfully",
+			slog.String("file", item.LocalPath),
+		)
+		return nil
+	}
+
+	remaining := runTiers(
+		queue,
+		splitTiers(
+			queue,
+			smallFileSizeBytes,
+			*smallFileConcurrency,
+			*largeFileConcurrency,
+			*adaptive,
+		),
+		start,
+		upload,
 	)
+
+	uploadedTo := map[string]string{}
+	for _, record := range records {
+		if record.Err == nil && record.SkipReason == "" {
+			uploadedTo[record.LocalPath] = record.RemotePath
+		}
+	}
+	for _, item := range linkItems {
+		// the file it links to was not uploaded or the run stops
+		primaryPath, found := uploadedTo[linkOf[item.LocalPath]]
+		if !found || stopReason != "" || stopRequested.Load() {
+			if start(item) {
+				upload(item)
+			} else {
+				remaining = append(remaining, item)
+			}
+			continue
+		}
+
+		started := time.Now()
+		err := linkRemoteFile(
+			httpClient,
+			dirs,
+			primaryPath,
+			item.RemotePath,
+			*yandexDiskUploadPath,
+			token,
+			options.Overwrite,
+		)
+		records = append(records, transferRecord{
+			LocalPath:  item.LocalPath,
+			RemotePath: item.RemotePath,
+			Size:       item.Size,
+			Duration:   time.Since(started),
+			Err:        err,
+		})
+		if err != nil {
+			failed++
+			logger.Error(
+				"Error during linking file",
+				append(
+					[]any{
+						slog.String("file", item.LocalPath),
+						slog.String("message", err.Error()),
+					},
+					apiErrorAttrs(err)...,
+				)...,
+			)
+			continue
+		}
+		logger.Info(
+			"file linked",
+			slog.String("file", item.LocalPath),
+			slog.String("link of", linkOf[item.LocalPath]),
+		)
+	}
+
+	for _, item := range remaining {
+		records = append(records, transferRecord{
+			LocalPath:  item.LocalPath,
+			RemotePath: item.RemotePath,
+			Size:       item.Size,
+			SkipReason: stopReason,
+		})
+	}
+	if outOfSpace {
+		// the files that did not fit and those never started
+		required := outOfSpaceBytes
+		for _, item := range remaining {
+			required += item.Size
+		}
+		reportInsufficientStorage(logger, httpClient, token, required)
+	}
+	if len(remaining) > 0 && !outOfSpace {
+		message := "budget exhausted, stopping"
+		if interrupted {
+			message = "run interrupted, stopping"
+		}
+		logger.Warn(
+			message,
+			slog.String("reason", stopReason),
+			slog.Int("remaining files", len(remaining)),
+		)
+	}
+
+	if !interrupted {
+		verified, mismatched := verifyUploads(
+			logger,
+			httpClient,
+			records,
+			token,
+			verify,
+			*verifyDownload,
+		)
+		failed += mismatched
+		if verified > 0 {
+			logger.Info(
+				"uploads verified",
+				slog.Int("files", verified),
+				slog.Int("failed", mismatched),
+			)
+		}
+	}
+
+	// the remote copy of a folder that could not be listed is not extra
+	unlisted := slices.ContainsFunc(unreadable, func(entry unreadableEntry) bool {
+		return entry.Dir
+	})
+	if mirroring && unlisted {
+		logger.Warn("not deleting remote extras, some local folders could not be read")
+	}
+
+	deleted, deleteFailed := 0, false
+	if mirroring && !outOfSpace && !interrupted && !unlisted {
+		keep := map[string]bool{}
+		for _, item := range queue {
+			keep[item.RemotePath] = true
+		}
+		for _, record := range records {
+			keep[record.RemotePath] = true
+		}
+		for remotePath := range moved {
+			keep[remotePath] = true
+		}
+
+		mirrorOptions := remoteMirrorOptions{
+			Permanently: *permanent,
+			Versions:    options.Versions,
+			Limit:       &maxDelete,
+			Excludes:    excludePatterns,
+		}
+		if *forceDelete {
+			mirrorOptions.Limit = nil
+		}
+
+		deleted, err = deleteRemoteExtras(
+			logger,
+			httpClient,
+			*yandexDiskUploadPath,
+			token,
+			keep,
+			mirrorOptions,
+		)
+		if err != nil {
+			deleteFailed = true
+			logger.Error(
+				"Error during deleting remote extras",
+				slog.String("message", err.Error()),
+			)
+		}
+	}
+
+	// a complete mirror is described by a manifest like a backup snapshot
+	if mirroring && !deleteFailed && !outOfSpace && !interrupted && failed == 0 && len(remaining) == 0 {
+		uploaded := 0
+		for _, record := range records {
+			if record.SkipReason == "" {
+				uploaded++
+			}
+		}
+		err = writeMirrorManifest(httpClient, *filePath, *yandexDiskUploadPath, token, uploaded)
+		if err != nil {
+			logger.Warn(
+				"Error during writing mirror manifest",
+				slog.String("path", *yandexDiskUploadPath),
+				slog.String("message", err.Error()),
+			)
+		}
+	}
+
+	// a run stopped by --deadline, --max-duration or --max-transfer is
+	// continued by ydu resume like an interrupted one
+	budgetStopped := len(remaining) > 0 && !interrupted && !outOfSpace && stopReason != ""
+	if interrupted {
+		journal.Interrupted = time.Now().UTC()
+		err = journal.write(remaining)
+	} else if budgetStopped {
+		journal.Stopped = time.Now().UTC()
+		journal.StopReason = stopReason
+		err = journal.write(remaining)
+	} else {
+		err = journal.remove()
+	}
 	if err != nil {
-		logger.Error(
-			"Erroro during upload file",
+		logger.Warn(
+			"Error during updating run journal",
 			slog.String("message", err.Error()),
 		)
+	}
+
+	lock.release(logger)
+	stopWatchdog()
+	sdNotify("STOPPING=1")
+	saveRemoteRevisions(logger)
+	saveHashCache(logger)
+
+	for _, target := range fanOut {
+		logger.Info(
+			"destination finished",
+			slog.String("destination", target.Spec),
+			slog.Int("uploaded", target.Uploaded),
+			slog.Int("failed", target.Failed),
+		)
+	}
+
+	if *saveRemaining != "" && len(remaining) > 0 {
+		saveErr := writeFileList(*saveRemaining, remaining)
+		if saveErr != nil {
+			logger.Error(
+				"Error during saving remaining files",
+				slog.String("path", *saveRemaining),
+				slog.String("message", saveErr.Error()),
+			)
+		}
+	}
+
+	if *failureManifestPath != "" {
+		manifestErr := writeFailureManifest(
+			*failureManifestPath,
+			*yandexDiskUploadPath,
+			records,
+		)
+		if manifestErr != nil {
+			logger.Error(
+				"Error during writing failure manifest",
+				slog.String("path", *failureManifestPath),
+				slog.String("message", manifestErr.Error()),
+			)
+		}
+	}
+
+	if *junitReportPath != "" {
+		reportErr := writeJUnitReport(
+			*junitReportPath,
+			records,
+		)
+		if reportErr != nil {
+			logger.Error(
+				"Error during writing junit report",
+				slog.String("path", *junitReportPath),
+				slog.String("message", reportErr.Error()),
+			)
+		}
+	}
+
+	if inGitHubActions() {
+		reportErr := writeGitHubActionsReport(
+			os.Stdout,
+			records,
+		)
+		if reportErr != nil {
+			logger.Error(
+				"Error during writing github actions summary",
+				slog.String("message", reportErr.Error()),
+			)
+		}
+	}
+
+	skipped := 0
+	for _, record := range records {
+		if record.SkipReason != "" {
+			skipped++
+		}
+	}
+
+	fanOutFailed := 0
+	for _, target := range fanOut {
+		fanOutFailed += target.Failed
+	}
+
+	complete := !interrupted && !outOfSpace && failed == 0 && fanOutFailed == 0 && !deleteFailed && len(remaining) == 0
+	promoteFailed := false
+	switch {
+	case production == "":
+	case complete && *autoPromote:
+		err = promoteStaging(logger, httpClient, production, token, *locking)
+		if err != nil {
+			logger.Error(
+				"Error during promoting staged upload",
+				slog.String("path", production),
+				slog.String("message", err.Error()),
+			)
+			promoteFailed = true
+		}
+	case complete:
+		logger.Info(
+			"upload staged",
+			slog.String("path", production),
+			slog.String("staging", *yandexDiskUploadPath),
+			slog.String("promote", "ydu promote "+production),
+		)
+	default:
+		logger.Warn(
+			"staged upload incomplete, not promoting",
+			slog.String("path", production),
+			slog.String("staging", *yandexDiskUploadPath),
+		)
+	}
+
+	result := "ok"
+	switch {
+	case interrupted:
+		result = "interrupted"
+	case outOfSpace:
+		result = "out of space"
+	case failed > 0 || fanOutFailed > 0 || deleteFailed:
+		result = "failed"
+		if len(records)-skipped-failed > 0 {
+			result = "partial"
+		}
+	case promoteFailed:
+		result = "failed"
+	}
+	recordRun("upload", result, nil)
+	recordUsage()
+
+	if interrupted {
+		logger.Warn(
+			"run interrupted",
+			slog.Int("files", len(records)-skipped),
+			slog.Int("remaining", len(remaining)),
+			slog.String("resume", "ydu resume "+journal.RunID),
+		)
+		notifyFinished(logger, "upload", errors.New("run interrupted"))
+		os.Exit(exitInterrupted)
+	}
+
+	if outOfSpace {
+		notifyFinished(logger, "upload", errors.New("not enough space on yandex disk"))
+		os.Exit(exitInsufficientStorage)
+	}
+
+	if failed > 0 || fanOutFailed > 0 || deleteFailed {
+		uploaded := len(records) - skipped - failed
+		logger.Error(
+			"some files failed to upload",
+			slog.Int("failed", failed),
+			slog.Int("failed at other destinations", fanOutFailed),
+			slog.Int("uploaded", uploaded),
+		)
+		notifyFinished(logger, "upload", errors.New("some files failed to upload"))
+		if uploaded > 0 {
+			os.Exit(exitPartialFailure)
+		}
+		os.Exit(1)
+	}
+
+	if promoteFailed {
+		notifyFinished(logger, "upload", errors.New("promoting the staged upload failed"))
 		os.Exit(1)
 	}
 
+	if budgetStopped {
+		logger.Info(
+			"run stopped by budget",
+			slog.String("reason", stopReason),
+			slog.Int("files", len(records)-skipped),
+			slog.Int("remaining", len(remaining)),
+			slog.String("resume", "ydu resume "+journal.RunID),
+		)
+		notifyFinished(logger, "upload", nil)
+		return
+	}
+
+	if len(remaining) > 0 {
+		logger.Info(
+			"run stopped by budget",
+			slog.Int("files", len(records)-skipped),
+			slog.Int("remaining", len(remaining)),
+		)
+		notifyFinished(logger, "upload", nil)
+		return
+	}
+
 	logger.Info(
-		"file uploaded successfully",
-		slog.String("file", *filePath),
+		"all files uploaded successfully",
+		slog.Int("files", len(records)-skipped),
+		slog.Int("skipped", skipped),
+		slog.Int("moved", len(moved)),
+		slog.Int("deleted", deleted),
 	)
+	notifyFinished(logger, "upload", nil)
 }
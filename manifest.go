@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// manifestName is the file a backup stores next to the files of its
+// snapshot, describing the snapshot without any local state.
+const manifestName = ".ydu-manifest.json"
+
+// manifestVersion is the format version of backupManifest.
+const manifestVersion = 1
+
+// backupManifest is the content of the manifest of a snapshot.
+type backupManifest struct {
+	Version int       `json:"version"`
+	Tool    string    `json:"tool"`
+	Created time.Time `json:"created"`
+	Host    string    `json:"host"`
+	Source  string    `json:"source"`
+	// Snapshot is the name of the snapshot, Previous the one unchanged
+	// files were copied from.
+	Snapshot string `json:"snapshot"`
+	Previous string `json:"previous,omitempty"`
+	// Encryption is "none": backups and mirrors store the files as they
+	// are. Encrypted backups go to a repository (ydu repo) instead, whose
+	// config.json holds the key derivation parameters.
+	Encryption string `json:"encryption"`
+	Uploaded   int    `json:"uploaded"`
+	Copied     int    `json:"copied"`
+	Linked     int    `json:"linked"`
+	TotalSize  int64  `json:"total_size"`
+
+	Files []manifestFile `json:"files"`
+}
+
+// manifestFile is a file of the snapshot with the size and checksums of
+// its content as restored.
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Encoding is "sparse" for files stored without their zero blocks,
+	// StoredSize is the size on the disk then.
+	Encoding   string `json:"encoding,omitempty"`
+	StoredSize int64  `json:"stored_size,omitempty"`
+	// Mode, UID and GID are the recorded permissions, LinkOf the file a
+	// hard link shares its content with.
+	Mode   string `json:"mode,omitempty"`
+	UID    string `json:"uid,omitempty"`
+	GID    string `json:"gid,omitempty"`
+	LinkOf string `json:"link_of,omitempty"`
+}
+
+// permResource returns a resource with the permissions recorded for f
+// for applyPermProperties.
+func (f manifestFile) permResource() resource {
+	properties := map[string]any{}
+	for key, value := range map[string]string{
+		modeProperty: f.Mode,
+		uidProperty:  f.UID,
+		gidProperty:  f.GID,
+	} {
+		if value != "" {
+			properties[key] = value
+		}
+	}
+	return resource{Path: f.Path, CustomProperties: properties}
+}
+
+// buildManifest lists the files below the snapshot folder snapshotDir
+// into m.
+func buildManifest(
+	httpClient *http.Client,
+	snapshotDir, token string,
+	m *backupManifest,
+) error {
+	m.Version = manifestVersion
+	m.Tool = defaultUserAgent()
+	m.Host, _ = os.Hostname()
+	m.Encryption = "none"
+	m.Files = []manifestFile{}
+
+	err := walkRemote(
+		httpClient,
+		snapshotDir,
+		token,
+		func(rel string, res resource) error {
+			if res.Type == "dir" || rel == manifestName {
+				return nil
+			}
+
+			logical := logicalResource(res)
+			file := manifestFile{
+				Path:   rel,
+				Size:   logical.Size,
+				MD5:    logical.MD5,
+				LinkOf: recordedHardLink(res),
+			}
+			if logical.Size != res.Size || logical.MD5 != res.MD5 {
+				file.Encoding = "sparse"
+				file.StoredSize = res.Size
+			} else {
+				// the API only knows the sha256 of the stored content
+				file.SHA256 = res.SHA256
+			}
+			file.Mode, _ = res.CustomProperties[modeProperty].(string)
+			file.UID, _ = res.CustomProperties[uidProperty].(string)
+			file.GID, _ = res.CustomProperties[gidProperty].(string)
+
+			m.TotalSize += file.Size
+			m.Files = append(m.Files, file)
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+	return nil
+}
+
+// uploadManifest writes m as the manifest of the snapshot folder
+// snapshotDir.
+func uploadManifest(
+	httpClient *http.Client,
+	snapshotDir, token string,
+	m *backupManifest,
+) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return uploadBlob(httpClient, path.Join(snapshotDir, manifestName), token, data)
+}
+
+// writeMirrorManifest writes the manifest of remoteDir after a mirror
+// upload of localDir completed, uploaded is the number of files the run
+// uploaded.
+func writeMirrorManifest(
+	httpClient *http.Client,
+	localDir, remoteDir, token string,
+	uploaded int,
+) error {
+	m := backupManifest{
+		Created:  time.Now().UTC(),
+		Source:   localDir,
+		Snapshot: path.Base(remoteDir),
+		Uploaded: uploaded,
+	}
+	if abs, err := filepath.Abs(localDir); err == nil {
+		m.Source = abs
+	}
+	err := buildManifest(httpClient, remoteDir, token, &m)
+	if err != nil {
+		return err
+	}
+	return uploadManifest(httpClient, remoteDir, token, &m)
+}
+
+// readManifest downloads the manifest of the snapshot folder
+// snapshotDir.
+func readManifest(
+	httpClient *http.Client,
+	snapshotDir, token string,
+) (*backupManifest, error) {
+	data, err := downloadBlob(httpClient, path.Join(snapshotDir, manifestName), token)
+	if isAPIError(err, errDiskPathDoesntExists) {
+		return nil, fmt.Errorf("%s has no manifest, it was created by an older ydu", snapshotDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m backupManifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("manifest of %s is damaged: %w", snapshotDir, err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest of %s has version %d, update ydu", snapshotDir, m.Version)
+	}
+	return &m, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// defaultMaxMemory bounds the buffered data when --max-memory is not
+// given.
+const defaultMaxMemory = 256 << 20
+
+// memoryBudget bounds the data a process holds in memory between
+// producing and transferring it, e.g. sealed repository chunks waiting
+// for an upload. Producers block in Acquire until transfers release
+// enough, so raising the concurrency does not raise the memory use.
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// bufferMemory is the memory budget of the process, configured by the
+// global --max-memory flag or YDU_MAX_MEMORY.
+var bufferMemory = newMemoryBudget(defaultMaxMemory)
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	b := &memoryBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// setMaxMemory configures bufferMemory from the value of --max-memory.
+func setMaxMemory(value string) error {
+	limit, err := humanize.ParseBytes(value)
+	if err != nil || limit == 0 {
+		return fmt.Errorf("invalid --max-memory %q, e.g. 512MB", value)
+	}
+
+	bufferMemory.mu.Lock()
+	defer bufferMemory.mu.Unlock()
+	bufferMemory.limit = int64(limit)
+	return nil
+}
+
+// Acquire blocks until n more bytes fit into the budget. A single
+// request larger than the budget is admitted once nothing else is held,
+// so it cannot wait forever.
+func (b *memoryBudget) Acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.used > 0 && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+// Release returns n bytes taken with Acquire.
+func (b *memoryBudget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	b.cond.Broadcast()
+}
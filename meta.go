@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+const metaUsage = "usage: ydu meta get <remote-path> [key...] | ydu meta set <remote-path> key=value..."
+
+// setCustomProperties updates custom_properties of a resource, nil values
+// remove the property.
+func setCustomProperties(
+	httpClient *http.Client,
+	remotePath, token string,
+	properties map[string]any,
+) (*resource, error) {
+	params := url.Values{}
+	params.Add("path", remotePath)
+
+	var res resource
+	err := apiRequestWithBody(
+		httpClient,
+		http.MethodPatch,
+		"/resources",
+		params,
+		token,
+		map[string]any{"custom_properties": properties},
+		&res,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// propertyString formats a custom property value, strings are printed
+// without quotes.
+func propertyString(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func printProperties(properties map[string]any, keys []string) {
+	if len(keys) == 0 {
+		for key := range properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	for _, key := range keys {
+		value, ok := properties[key]
+		if !ok {
+			continue
+		}
+		fmt.Printf("%s=%s\n", key, propertyString(value))
+	}
+}
+
+// runMeta implements `ydu meta get|set` for custom_properties.
+func runMeta(logger *slog.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New(metaUsage)
+	}
+
+	flags := flag.NewFlagSet("meta "+args[0], flag.ExitOnError)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print properties as JSON",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args[1:])
+
+	if flags.NArg() < 1 {
+		return errors.New(metaUsage)
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	remotePath, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	var properties map[string]any
+	var keys []string
+
+	switch args[0] {
+	case "get":
+		params := url.Values{}
+		params.Add("path", remotePath)
+		params.Add("fields", "custom_properties")
+
+		var res resource
+		err := apiRequest(
+			httpClient,
+			http.MethodGet,
+			"/resources",
+			params,
+			token,
+			&res,
+		)
+		if err != nil {
+			return err
+		}
+
+		properties = res.CustomProperties
+		keys = flags.Args()[1:]
+	case "set":
+		if flags.NArg() < 2 {
+			return errors.New(metaUsage)
+		}
+
+		update := map[string]any{}
+		for _, pair := range flags.Args()[1:] {
+			key, value, found := strings.Cut(pair, "=")
+			if !found || key == "" {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			// an empty value removes the property
+			if value == "" {
+				update[key] = nil
+			} else {
+				update[key] = value
+			}
+		}
+
+		res, err := setCustomProperties(httpClient, remotePath, token, update)
+		if err != nil {
+			return err
+		}
+
+		logger.Info(
+			"custom properties updated",
+			slog.String("path", remotePath),
+		)
+		properties = res.CustomProperties
+	default:
+		return errors.New(metaUsage)
+	}
+
+	if *jsonOutput {
+		if properties == nil {
+			properties = map[string]any{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(properties)
+	}
+
+	printProperties(properties, keys)
+	return nil
+}
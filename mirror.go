@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// remoteMirrorOptions controls how deleteRemoteExtras removes files.
+type remoteMirrorOptions struct {
+	// Permanently skips the trash.
+	Permanently bool
+	// Versions receives deleted files instead of the trash when set.
+	Versions *versionsDir
+	// Limit aborts before deleting more files than allowed, nil is
+	// unlimited.
+	Limit *deleteLimit
+	// Excludes protects the files it matches, they were left out of
+	// the upload rather than deleted locally.
+	Excludes excludes
+}
+
+// remoteExtra is a file or folder findRemoteExtras found, with the
+// number and size of the files deleting it removes.
+type remoteExtra struct {
+	Path  string
+	Type  string
+	MD5   string
+	Files int
+	Size  int64
+}
+
+// findRemoteExtras returns the files and folders below root that are
+// neither in keep nor a parent of a path in keep, a folder without the
+// files below it, and the number of files below root. Excluded files
+// are never extras, and a folder holding one is not deleted as a whole
+// but its other files one by one.
+func findRemoteExtras(
+	httpClient *http.Client,
+	root, token string,
+	keep map[string]bool,
+	excludes excludes,
+) ([]remoteExtra, int, error) {
+	type remoteEntry struct {
+		rel string
+		res resource
+	}
+	var entries []remoteEntry
+	err := walkRemote(
+		httpClient,
+		root,
+		token,
+		func(rel string, res resource) error {
+			entries = append(entries, remoteEntry{rel: rel, res: res})
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// every folder leading to a kept or excluded file is kept as well
+	keepDirs := map[string]bool{}
+	keepParents := func(p string) {
+		for dir := path.Dir(p); isBelow(dir, root) && !keepDirs[dir]; dir = path.Dir(dir) {
+			keepDirs[dir] = true
+		}
+	}
+	for p := range keep {
+		keepParents(p)
+	}
+	for _, entry := range entries {
+		if entry.res.Type != "dir" && excludes.match(entry.rel) {
+			keepParents(path.Join(root, entry.rel))
+		}
+	}
+
+	var extras []remoteExtra
+	total := 0
+	for _, entry := range entries {
+		res := entry.res
+		remotePath := path.Join(root, entry.rel)
+		isFile := res.Type != "dir"
+		if isFile {
+			total++
+		}
+
+		if last := len(extras) - 1; last >= 0 &&
+			strings.HasPrefix(remotePath, extras[last].Path+"/") {
+			// inside a folder that is deleted as a whole
+			if isFile {
+				extras[last].Files++
+				extras[last].Size += res.Size
+			}
+			continue
+		}
+
+		if keep[remotePath] || (!isFile && keepDirs[remotePath]) ||
+			(isFile && excludes.match(entry.rel)) {
+			continue
+		}
+
+		extra := remoteExtra{Path: remotePath, Type: res.Type}
+		if isFile {
+			extra.MD5 = res.MD5
+			extra.Files = 1
+			extra.Size = res.Size
+		}
+		extras = append(extras, extra)
+	}
+	return extras, total, nil
+}
+
+// deleteRemoteExtras removes the files and folders findRemoteExtras
+// finds and returns the number of removed files. Removed objects go to
+// the trash unless options.Permanently is set, so a mistake stays
+// recoverable.
+func deleteRemoteExtras(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	root, token string,
+	keep map[string]bool,
+	options remoteMirrorOptions,
+) (int, error) {
+	extras, total, err := findRemoteExtras(httpClient, root, token, keep, options.Excludes)
+	if err != nil {
+		return 0, err
+	}
+
+	deleting := 0
+	for _, extra := range extras {
+		deleting += extra.Files
+	}
+	if options.Limit != nil {
+		err = options.Limit.check(deleting, total)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, extra := range extras {
+		logger.Info(
+			"deleting remote extra",
+			slog.String("path", extra.Path),
+			slog.Bool("permanently", options.Permanently),
+		)
+
+		if options.Versions != nil {
+			err = options.Versions.keep(logger, httpClient, extra.Path, token)
+		} else {
+			err = deleteResource(httpClient, extra.Path, token, options.Permanently)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return deleting, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// multiRangeMinSize is the smallest file downloaded in several ranges,
+// below it the extra requests cost more than they gain.
+const multiRangeMinSize = 64 << 20
+
+// defaultDownloadStreams is the default of --streams.
+const defaultDownloadStreams = 4
+
+// errRangesUnsupported is returned by downloadRanges when the server
+// answers a range request with the complete file.
+var errRangesUnsupported = errors.New("server does not support range requests")
+
+// downloadRanges downloads href to partialPath in streams byte ranges
+// concurrently, single streams from the CDN are often the bottleneck of
+// big restores. A failed range is retried on its own from where it
+// stopped. The ranges are written to a file of their own, which has
+// holes until all of them are complete, and it only becomes
+// partialPath when it is. On failure just the prefix downloaded without
+// gaps is kept as partialPath for resumeDownload to continue; a file
+// left by a crash is started over, nothing tells which of its ranges
+// are complete.
+func downloadRanges(
+	httpClient *http.Client,
+	href, partialPath string,
+	size int64,
+	streams int,
+) error {
+	rangesPath := strings.TrimSuffix(partialPath, partialSuffix) + ".ranges" + partialSuffix
+	file, err := os.Create(rangesPath)
+	if err != nil {
+		return err
+	}
+
+	err = file.Truncate(size)
+	if err != nil {
+		file.Close()
+		os.Remove(rangesPath)
+		return err
+	}
+
+	partSize := (size + int64(streams) - 1) / int64(streams)
+	parts := int((size + partSize - 1) / partSize)
+	written := make([]int64, parts)
+	errs := make(chan error, parts)
+	for part := range parts {
+		start := int64(part) * partSize
+		end := min(start+partSize, size) - 1
+		go func() {
+			errs <- downloadRange(httpClient, href, file, start, end, &written[part])
+		}()
+	}
+
+	for range parts {
+		if rangeErr := <-errs; rangeErr != nil && err == nil {
+			err = rangeErr
+		}
+	}
+
+	// the ranges complete without a gap from the start
+	var prefix int64
+	for part := range parts {
+		prefix += written[part]
+		if written[part] < partSize {
+			break
+		}
+	}
+	if err != nil {
+		truncErr := file.Truncate(prefix)
+		if file.Close() != nil || truncErr != nil || prefix == 0 {
+			os.Remove(rangesPath)
+			return err
+		}
+		if os.Rename(rangesPath, partialPath) != nil {
+			os.Remove(rangesPath)
+		}
+		return err
+	}
+
+	err = file.Close()
+	if err == nil {
+		err = os.Rename(rangesPath, partialPath)
+	}
+	if err != nil {
+		os.Remove(rangesPath)
+	}
+	return err
+}
+
+// downloadRange writes the bytes start to end of href into file at their
+// offset, resuming after network and server errors. written counts the
+// bytes of the range written so far.
+func downloadRange(
+	httpClient *http.Client,
+	href string,
+	file *os.File,
+	start, end int64,
+	written *int64,
+) error {
+	for attempt := 1; ; attempt++ {
+		n, err := copyRange(httpClient, href, file, start, end)
+		start += n
+		*written += n
+		if err == nil || start > end {
+			return nil
+		}
+		if errors.Is(err, errRangesUnsupported) {
+			return err
+		}
+
+		delay, retry := retries().next(err, attempt)
+		if !retry {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+func copyRange(
+	httpClient *http.Client,
+	href string,
+	file *os.File,
+	start, end int64,
+) (int64, error) {
+	body, ranged, err := openDownloadRange(httpClient, href, start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	if !ranged {
+		return 0, errRangesUnsupported
+	}
+
+	written, err := io.Copy(
+		io.NewOffsetWriter(file, start),
+		pausableReader{
+			r:    throttledReader{r: io.LimitReader(body, end-start+1), limiter: &bandwidth},
+			gate: &transfers,
+		},
+	)
+	if err == nil && written < end-start+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
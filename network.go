@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// networkSettings are set by the global --ip-version and --dns flags.
+// Some networks have broken IPv6 paths to the yandex CDN hosts which
+// show up as stalled transfers rather than errors.
+var networkSettings struct {
+	// Network is "tcp", "tcp4" or "tcp6".
+	Network string
+	// DNS is the host:port of the resolver to use instead of the system
+	// one.
+	DNS string
+}
+
+// setIPVersion configures networkSettings from the value of
+// --ip-version.
+func setIPVersion(value string) error {
+	switch value {
+	case "auto":
+		networkSettings.Network = ""
+	case "4":
+		networkSettings.Network = "tcp4"
+	case "6":
+		networkSettings.Network = "tcp6"
+	default:
+		return fmt.Errorf("invalid --ip-version %q, expected 4, 6 or auto", value)
+	}
+	return nil
+}
+
+// setDNS configures networkSettings from the value of --dns, a port
+// defaults to 53.
+func setDNS(value string) error {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		value = net.JoinHostPort(value, "53")
+	}
+	host, _, err := net.SplitHostPort(value)
+	if err != nil || net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid --dns %q, expected an ip address", value)
+	}
+	networkSettings.DNS = value
+	return nil
+}
+
+var (
+	baseTransportOnce sync.Once
+	baseTransportRT   http.RoundTripper
+)
+
+// baseTransport returns the transport every request ends in:
+// http.DefaultTransport, dialing over the selected ip version and
+// resolving names with the selected resolver when configured.
+func baseTransport() http.RoundTripper {
+	baseTransportOnce.Do(func() {
+		baseTransportRT = http.DefaultTransport
+		if networkSettings.Network == "" && networkSettings.DNS == "" {
+			return
+		}
+
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		if networkSettings.DNS != "" {
+			dialer.Resolver = &net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, networkSettings.DNS)
+				},
+			}
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if networkSettings.Network != "" {
+				network = networkSettings.Network
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+		baseTransportRT = transport
+	})
+	return baseTransportRT
+}
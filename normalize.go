@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// unicodeForm is the value of --unicode-normalize. macOS stores file
+// names decomposed (NFD) while yandex disk and its web interface expect
+// composed names (NFC), so without normalization every accented name
+// looks like a different file.
+type unicodeForm string
+
+const (
+	unicodeNone unicodeForm = "none"
+	unicodeNFC  unicodeForm = "nfc"
+	unicodeNFD  unicodeForm = "nfd"
+)
+
+func (f *unicodeForm) String() string {
+	return string(*f)
+}
+
+func (f *unicodeForm) Set(value string) error {
+	switch form := unicodeForm(strings.ToLower(value)); form {
+	case unicodeNone, unicodeNFC, unicodeNFD:
+		*f = form
+		return nil
+	}
+	return fmt.Errorf("expected nfc, nfd or none, got %q", value)
+}
+
+// apply returns s in the form.
+func (f unicodeForm) apply(s string) string {
+	switch f {
+	case unicodeNFC:
+		return norm.NFC.String(s)
+	case unicodeNFD:
+		return norm.NFD.String(s)
+	}
+	return s
+}
+
+// normalizeQueue rewrites the relative and remote paths of the queue
+// items below their root in the form.
+func normalizeQueue(queue []uploadItem, form unicodeForm) {
+	if form == unicodeNone {
+		return
+	}
+
+	for i, item := range queue {
+		rel := form.apply(item.RelPath)
+		// a single file upload is stored under the given target name
+		if prefix, found := strings.CutSuffix(item.RemotePath, item.RelPath); found {
+			queue[i].RemotePath = prefix + rel
+		}
+		queue[i].RelPath = rel
+	}
+}
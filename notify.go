@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// notifyDesktop is set by the global --notify flag: a desktop
+// notification is shown when the run finishes, so a long upload can be
+// left running in the background.
+var notifyDesktop bool
+
+// windowsToastScript shows a toast notification through the WinRT API
+// available to PowerShell. The title and message are passed in the
+// environment so they never need quoting.
+const windowsToastScript = `
+$title = $env:YDU_NOTIFY_TITLE
+$message = $env:YDU_NOTIFY_MESSAGE
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$texts = $template.GetElementsByTagName("text")
+$texts.Item(0).AppendChild($template.CreateTextNode($title)) | Out-Null
+$texts.Item(1).AppendChild($template.CreateTextNode($message)) | Out-Null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier("ydu").Show($toast)
+`
+
+// notificationCommand returns the command showing a desktop
+// notification on the current platform.
+func notificationCommand(title, message string) (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		return exec.Command("notify-send", "--app-name=ydu", title, message), nil
+	case "darwin":
+		script := fmt.Sprintf(
+			"display notification %s with title %s",
+			appleScriptString(message),
+			appleScriptString(title),
+		)
+		return exec.Command("osascript", "-e", script), nil
+	case "windows":
+		cmd := exec.Command(
+			"powershell",
+			"-NoProfile",
+			"-NonInteractive",
+			"-Command",
+			windowsToastScript,
+		)
+		cmd.Env = append(
+			os.Environ(),
+			"YDU_NOTIFY_TITLE="+title,
+			"YDU_NOTIFY_MESSAGE="+message,
+		)
+		return cmd, nil
+	}
+	return nil, fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+}
+
+// appleScriptString quotes s as an AppleScript string literal.
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// notified is set once the notification about the end of the run was
+// shown. ydu resume runs an upload, which shows its own.
+var notified bool
+
+// notifyFinished shows a desktop notification about the end of command
+// when --notify is set, only the first one of the process. A
+// notification that cannot be shown is only logged.
+func notifyFinished(logger *slog.Logger, command string, err error) {
+	if !notifyDesktop || notified {
+		return
+	}
+	notified = true
+
+	title := "ydu " + command + " finished"
+	message := "completed successfully"
+	if err != nil {
+		title = "ydu " + command + " failed"
+		message = err.Error()
+	}
+
+	cmd, notifyErr := notificationCommand(title, message)
+	if notifyErr == nil {
+		notifyErr = cmd.Run()
+	}
+	if notifyErr != nil {
+		logger.Warn(
+			"Error during desktop notification",
+			slog.String("message", notifyErr.Error()),
+		)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// maxOperationRecords is how many started operations are remembered.
+const maxOperationRecords = 100
+
+// operationRecord is an async operation started by ydu.
+type operationRecord struct {
+	ID          string    `json:"id"`
+	Href        string    `json:"href"`
+	Description string    `json:"description"`
+	Started     time.Time `json:"started"`
+}
+
+func operationsFile() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "ydu", "operations.jsonl"), nil
+}
+
+func readOperationRecords() ([]operationRecord, error) {
+	recordsPath, err := operationsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(recordsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []operationRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record operationRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// trackOperation returns the id of the async operation link points to
+// and records it for `ydu ops`, so a run interrupted while waiting can
+// be checked on later. Recording is best effort.
+func trackOperation(link apiLink, description string) string {
+	id := operationID(link)
+	if id == "" {
+		return ""
+	}
+
+	records, err := readOperationRecords()
+	if err != nil {
+		return id
+	}
+	records = append(records, operationRecord{
+		ID:          id,
+		Href:        link.Href,
+		Description: description,
+		Started:     time.Now(),
+	})
+	if len(records) > maxOperationRecords {
+		records = records[len(records)-maxOperationRecords:]
+	}
+
+	recordsPath, err := operationsFile()
+	if err != nil {
+		return id
+	}
+	err = os.MkdirAll(filepath.Dir(recordsPath), 0o755)
+	if err != nil {
+		return id
+	}
+
+	var data []byte
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		data = append(append(data, line...), '\n')
+	}
+	os.WriteFile(recordsPath, data, 0o644)
+
+	return id
+}
+
+// runOps implements `ydu ops ls` and `ydu ops wait <operation-id>`.
+func runOps(logger *slog.Logger, args []string) error {
+	const usage = "usage: ydu ops ls | ydu ops wait <operation-id>"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	flags := flag.NewFlagSet("ops "+args[0], flag.ExitOnError)
+	pollInterval := flags.Duration(
+		"poll-interval",
+		2*time.Second,
+		"how often to check the operation status",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args[1:])
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	switch {
+	case args[0] == "ls" && flags.NArg() == 0:
+		records, err := readOperationRecords()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, record := range records {
+			status, err := operationStatus(httpClient, record.ID, token)
+			if apiErr, ok := err.(*apiError); ok &&
+				apiErr.StatusCode == http.StatusNotFound {
+				// the API forgets finished operations after a while
+				status = "expired"
+			} else if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%s\t%s\n",
+				record.ID,
+				status,
+				record.Started.Local().Format(time.DateTime),
+				record.Description,
+			)
+		}
+		return w.Flush()
+	case args[0] == "wait" && flags.NArg() == 1:
+		id := flags.Arg(0)
+		logger.Info(
+			"waiting for operation",
+			slog.String("operation id", id),
+		)
+
+		err := waitOperation(httpClient, id, token, *pollInterval)
+		if err != nil {
+			return err
+		}
+
+		logger.Info(
+			"operation finished",
+			slog.String("operation id", id),
+		)
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
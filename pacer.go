@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPacingInterval bounds the gap the pacer leaves between API calls.
+const maxPacingInterval = 2 * time.Second
+
+// callPacer spaces out API calls. It starts without any gap, doubles the
+// gap on every 429 response and honours Retry-After, then narrows the
+// gap again by a tenth with every successful call. Metadata heavy
+// commands thereby settle at a rate the API accepts instead of running
+// into one 429 after another.
+type callPacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+	calls    int
+	limited  int
+}
+
+// apiPacer paces every API call of the process.
+var apiPacer callPacer
+
+// Wait blocks until the next call may start.
+func (p *callPacer) Wait() {
+	p.mu.Lock()
+	now := time.Now()
+	slot := p.next
+	if slot.Before(now) {
+		slot = now
+	}
+	p.next = slot.Add(p.interval)
+	p.calls++
+	p.mu.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
+
+// Observe adapts the pace to a response.
+func (p *callPacer) Observe(resp *http.Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		p.interval -= p.interval / 10
+		if p.interval < 10*time.Millisecond {
+			p.interval = 0
+		}
+		return
+	}
+
+	p.limited++
+	p.interval = min(max(2*p.interval, 100*time.Millisecond), maxPacingInterval)
+
+	pause := p.interval
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		pause = max(pause, time.Duration(seconds)*time.Second)
+	}
+	if next := time.Now().Add(pause); next.After(p.next) {
+		p.next = next
+	}
+}
+
+// Stats returns the number of calls made and how many of them were
+// rate limited.
+func (p *callPacer) Stats() (calls, limited int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls, p.limited
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pauseGate blocks transfers while they are paused. Data already handed
+// to the connection is still sent, new reads wait for Resume.
+type pauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{}
+	// pausedAt is when the current pause began, pausedTotal the length
+	// of the pauses before it.
+	pausedAt    time.Time
+	pausedTotal time.Duration
+}
+
+// transfers gates every file transfer of the process.
+var transfers pauseGate
+
+// Pause pauses transfers and reports whether they were running.
+func (g *pauseGate) Pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		return false
+	}
+	g.paused = true
+	g.resume = make(chan struct{})
+	g.pausedAt = time.Now()
+	return true
+}
+
+// Resume resumes transfers and reports whether they were paused.
+func (g *pauseGate) Resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	close(g.resume)
+	g.pausedTotal += time.Since(g.pausedAt)
+	return true
+}
+
+// Wait blocks while transfers are paused.
+func (g *pauseGate) Wait() {
+	g.mu.Lock()
+	paused, resume := g.paused, g.resume
+	g.mu.Unlock()
+
+	if paused {
+		<-resume
+	}
+}
+
+// pausedFor returns how long transfers have been paused in total,
+// including the current pause.
+func (g *pauseGate) pausedFor() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		return g.pausedTotal + time.Since(g.pausedAt)
+	}
+	return g.pausedTotal
+}
+
+type pausableReader struct {
+	r    io.Reader
+	gate *pauseGate
+}
+
+func (r pausableReader) Read(p []byte) (int, error) {
+	r.gate.Wait()
+	return r.r.Read(p)
+}
+
+// errTransferTimeout is returned when a request including its response
+// body takes longer than the --timeout of the command.
+var errTransferTimeout = errors.New("request timeout exceeded")
+
+// pauseAwareTimeout limits a request including reading its response body
+// to timeout like http.Client.Timeout does, but does not count the time
+// gate is paused, so pausing a transfer for long does not abort it.
+type pauseAwareTimeout struct {
+	next    http.RoundTripper
+	timeout time.Duration
+	gate    *pauseGate
+}
+
+func (t pauseAwareTimeout) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	done := make(chan struct{})
+	stop := sync.OnceFunc(func() {
+		close(done)
+		cancel(nil)
+	})
+	go t.watch(cancel, done)
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		stop()
+		if errors.Is(context.Cause(ctx), errTransferTimeout) {
+			return nil, errTransferTimeout
+		}
+		return nil, err
+	}
+
+	resp.Body = timeoutBody{ReadCloser: resp.Body, ctx: ctx, stop: stop}
+	return resp, nil
+}
+
+// watch cancels the request once it was active, not paused, for longer
+// than t.timeout, unless done is closed first.
+func (t pauseAwareTimeout) watch(cancel context.CancelCauseFunc, done chan struct{}) {
+	started := time.Now()
+	pausedBefore := t.gate.pausedFor()
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+
+		active := time.Since(started) - (t.gate.pausedFor() - pausedBefore)
+		if active >= t.timeout {
+			cancel(errTransferTimeout)
+			return
+		}
+		timer.Reset(t.timeout - active)
+	}
+}
+
+// timeoutBody ends the timeout of its request when closed.
+type timeoutBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	stop func()
+}
+
+func (b timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && errors.Is(context.Cause(b.ctx), errTransferTimeout) {
+		err = errTransferTimeout
+	}
+	return n, err
+}
+
+func (b timeoutBody) Close() error {
+	defer b.stop()
+	return b.ReadCloser.Close()
+}
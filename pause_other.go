@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "log/slog"
+
+// handlePauseSignals is a no-op on platforms without SIGUSR1/SIGUSR2.
+func handlePauseSignals(logger *slog.Logger) {}
+
+// forwardPauseSignals is a no-op on platforms without SIGUSR1/SIGUSR2.
+func forwardPauseSignals(logger *slog.Logger) {}
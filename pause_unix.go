@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals pauses transfers on SIGUSR1 and resumes them on
+// SIGUSR2.
+func handlePauseSignals(logger *slog.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				if transfers.Pause() {
+					logger.Info("transfers paused, send SIGUSR2 to resume")
+				}
+				continue
+			}
+
+			if transfers.Resume() {
+				logger.Info("transfers resumed")
+			}
+		}
+	}()
+}
+
+// forwardPauseSignals passes SIGUSR1 and SIGUSR2 on to the jobs of ydu
+// run and pauses and resumes transfers, which keeps further jobs from
+// starting.
+func forwardPauseSignals(logger *slog.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			jobProcesses.signal(sig)
+			if sig == syscall.SIGUSR1 {
+				if transfers.Pause() {
+					logger.Info("jobs paused, send SIGUSR2 to resume")
+				}
+				continue
+			}
+
+			if transfers.Resume() {
+				logger.Info("jobs resumed")
+			}
+		}
+	}()
+}
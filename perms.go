@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The custom properties recording the POSIX permissions, owner and
+// modification time of files uploaded with --preserve-perms.
+const (
+	modeProperty  = "ydu_mode"
+	uidProperty   = "ydu_uid"
+	gidProperty   = "ydu_gid"
+	mtimeProperty = "ydu_mtime"
+)
+
+// permProperties returns the custom properties recording the mode,
+// owner and modification time of localPath.
+func permProperties(localPath string) (map[string]any, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := map[string]any{
+		modeProperty:  fmt.Sprintf("%04o", info.Mode().Perm()),
+		mtimeProperty: info.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		properties[uidProperty] = strconv.Itoa(uid)
+		properties[gidProperty] = strconv.Itoa(gid)
+	}
+	return properties, nil
+}
+
+// recordsProperties reports whether res already carries properties, so
+// a copied file needs no update.
+func recordsProperties(res resource, properties map[string]any) bool {
+	for key, value := range properties {
+		if fmt.Sprint(res.CustomProperties[key]) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyPermProperties gives localPath the mode recorded in the custom
+// properties of res and, when running as root, the owner. Files
+// uploaded without --preserve-perms are left alone.
+func applyPermProperties(localPath string, res resource) error {
+	mode, found := res.CustomProperties[modeProperty].(string)
+	if !found {
+		return nil
+	}
+
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q of %s", modeProperty, mode, res.Path)
+	}
+	err = os.Chmod(localPath, os.FileMode(perm).Perm())
+	if err != nil {
+		return err
+	}
+
+	// only root may give files away
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	uid, uidErr := strconv.Atoi(fmt.Sprint(res.CustomProperties[uidProperty]))
+	gid, gidErr := strconv.Atoi(fmt.Sprint(res.CustomProperties[gidProperty]))
+	if uidErr != nil || gidErr != nil {
+		return nil
+	}
+	return os.Chown(localPath, uid, gid)
+}
+
+// recordPermissions stores the mode and owner of the local file of item
+// in the custom properties of the uploaded file.
+func recordPermissions(
+	httpClient *http.Client,
+	item uploadItem,
+	token string,
+) error {
+	properties, err := permProperties(item.LocalPath)
+	if err != nil {
+		return err
+	}
+	_, err = setCustomProperties(httpClient, item.RemotePath, token, properties)
+	return err
+}
+
+// recordedModTime returns the modification time of the local file res
+// was uploaded from when --preserve-perms recorded it, otherwise the
+// time the file was modified on the disk.
+func recordedModTime(res resource) time.Time {
+	recorded, ok := res.CustomProperties[mtimeProperty].(string)
+	if !ok {
+		return res.Modified
+	}
+	modified, err := time.Parse(time.RFC3339Nano, recorded)
+	if err != nil {
+		return res.Modified
+	}
+	return modified
+}
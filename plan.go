@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// planVersion is the format version of uploadPlan.
+const planVersion = 1
+
+// uploadPlan is the set of operations an upload run would perform,
+// written by --dry-run --output for review and executed by ydu apply.
+type uploadPlan struct {
+	Version int       `json:"version"`
+	Tool    string    `json:"tool"`
+	Created time.Time `json:"created"`
+	Host    string    `json:"host"`
+	// Source is the local file or folder, Target the remote path of the
+	// run.
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Overwrite, OnConflict and Permanent are the options the
+	// operations are executed with.
+	Overwrite  bool   `json:"overwrite"`
+	OnConflict string `json:"on_conflict"`
+	Permanent  bool   `json:"permanent"`
+
+	// Moves come first, then Uploads and finally Deletes, like in the
+	// run itself.
+	Moves   []plannedMove   `json:"moves"`
+	Uploads []plannedUpload `json:"uploads"`
+	Deletes []plannedDelete `json:"deletes"`
+
+	UploadSize int64 `json:"upload_size"`
+	DeleteSize int64 `json:"delete_size"`
+}
+
+// plannedUpload uploads a local file. Size and Modified are the state of
+// the local file the plan was made for, Replaces the remote file it
+// overwrites.
+type plannedUpload struct {
+	LocalPath  string       `json:"local_path"`
+	RemotePath string       `json:"remote_path"`
+	Size       int64        `json:"size"`
+	Modified   time.Time    `json:"modified"`
+	Replaces   *plannedFile `json:"replaces,omitempty"`
+}
+
+// plannedMove moves a remote file whose content matches the renamed
+// local file LocalPath into place.
+type plannedMove struct {
+	LocalPath string `json:"local_path"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Size      int64  `json:"size"`
+	MD5       string `json:"md5"`
+}
+
+// plannedDelete deletes a remote file, or a folder with Files files of
+// Size bytes below it.
+type plannedDelete struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"`
+	MD5   string `json:"md5,omitempty"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+// plannedFile is a remote file as the plan found it.
+type plannedFile struct {
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// planOptions are the flags of the upload run that decide the plan.
+type planOptions struct {
+	Mirror        bool
+	DetectRenames bool
+	MaxFileSize   uint64
+	Excludes      excludes
+	// DeleteLimit fails the plan when it deletes more files than
+	// allowed, nil is unlimited.
+	DeleteLimit *deleteLimit
+}
+
+// buildUploadPlan fills plan with the operations uploading queue to
+// plan.Target would perform, without changing anything. skipped are the
+// files left out of the queue, which --delete keeps nevertheless.
+func buildUploadPlan(
+	httpClient *http.Client,
+	plan *uploadPlan,
+	token string,
+	queue []uploadItem,
+	skipped []transferRecord,
+	options planOptions,
+) error {
+	plan.Version = planVersion
+	plan.Tool = defaultUserAgent()
+	plan.Created = time.Now().UTC()
+	plan.Host, _ = os.Hostname()
+	plan.Moves = []plannedMove{}
+	plan.Uploads = []plannedUpload{}
+	plan.Deletes = []plannedDelete{}
+
+	remote := map[string]resource{}
+	err := walkRemote(
+		httpClient,
+		plan.Target,
+		token,
+		func(rel string, res resource) error {
+			if res.Type != "dir" {
+				remote[diskPath(res.Path)] = logicalResource(res)
+			}
+			return nil
+		},
+	)
+	if err != nil && !isAPIError(err, errDiskPathDoesntExists) {
+		return err
+	}
+
+	moved := map[string]bool{}
+	if options.Mirror && options.DetectRenames {
+		err = localHashes.Open(false)
+		if err != nil {
+			return err
+		}
+		renamed, err := findRenamedFiles(httpClient, plan.Target, token, queue, options.Excludes)
+		if err != nil {
+			return err
+		}
+		for _, file := range renamed {
+			plan.Moves = append(plan.Moves, plannedMove{
+				LocalPath: absPath(file.Item.LocalPath),
+				From:      file.From.Path,
+				To:        file.Item.RemotePath,
+				Size:      file.From.Size,
+				MD5:       file.From.MD5,
+			})
+			moved[file.Item.RemotePath] = true
+		}
+	}
+
+	for _, item := range queue {
+		if moved[item.RemotePath] ||
+			(options.MaxFileSize > 0 && uint64(item.Size) > options.MaxFileSize) {
+			continue
+		}
+
+		upload := plannedUpload{
+			LocalPath:  absPath(item.LocalPath),
+			RemotePath: item.RemotePath,
+			Size:       item.Size,
+			Modified:   item.ModTime.UTC(),
+		}
+		if res, found := remote[diskPath(item.RemotePath)]; found {
+			upload.Replaces = &plannedFile{Size: res.Size, MD5: res.MD5}
+		}
+		plan.Uploads = append(plan.Uploads, upload)
+		plan.UploadSize += item.Size
+	}
+
+	if !options.Mirror {
+		return nil
+	}
+
+	keep := map[string]bool{}
+	for _, item := range queue {
+		keep[item.RemotePath] = true
+	}
+	for _, record := range skipped {
+		keep[record.RemotePath] = true
+	}
+	// the sources of moves are gone by the time extras are deleted
+	for _, move := range plan.Moves {
+		keep[move.From] = true
+	}
+
+	extras, total, err := findRemoteExtras(httpClient, plan.Target, token, keep, options.Excludes)
+	if isAPIError(err, errDiskPathDoesntExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	deleting := 0
+	for _, extra := range extras {
+		deleting += extra.Files
+		plan.DeleteSize += extra.Size
+		plan.Deletes = append(plan.Deletes, plannedDelete{
+			Path:  extra.Path,
+			Type:  extra.Type,
+			MD5:   extra.MD5,
+			Files: extra.Files,
+			Size:  extra.Size,
+		})
+	}
+	if options.DeleteLimit != nil {
+		return options.DeleteLimit.check(deleting, total)
+	}
+	return nil
+}
+
+// absPath returns p as an absolute path, so a plan can be applied from
+// another directory.
+func absPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+// logPlan logs the operations of plan.
+func logPlan(logger *slog.Logger, plan *uploadPlan) {
+	for _, move := range plan.Moves {
+		logger.Info(
+			"would move renamed file",
+			slog.String("file", move.LocalPath),
+			slog.String("from", move.From),
+			slog.String("to", move.To),
+		)
+	}
+	for _, upload := range plan.Uploads {
+		logger.Info(
+			"would upload",
+			slog.String("file", upload.LocalPath),
+			slog.String("size", humanize.Bytes(uint64(upload.Size))),
+			slog.String("target yandex disk path", upload.RemotePath),
+			slog.Bool("replaces", upload.Replaces != nil),
+		)
+	}
+	for _, del := range plan.Deletes {
+		logger.Info(
+			"would delete remote extra",
+			slog.String("path", del.Path),
+			slog.Int("files", del.Files),
+			slog.Bool("permanently", plan.Permanent),
+		)
+	}
+
+	logger.Info(
+		"dry run finished",
+		slog.Int("moves", len(plan.Moves)),
+		slog.Int("uploads", len(plan.Uploads)),
+		slog.String("upload size", humanize.Bytes(uint64(plan.UploadSize))),
+		slog.Int("deletes", len(plan.Deletes)),
+		slog.String("delete size", humanize.Bytes(uint64(plan.DeleteSize))),
+	)
+}
+
+// writePlan writes plan as indented JSON to planPath.
+func writePlan(planPath string, plan *uploadPlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(planPath, append(data, '\n'), 0o644)
+}
+
+// readPlan reads a plan written by --dry-run --output.
+func readPlan(planPath string) (*uploadPlan, error) {
+	data, err := os.ReadFile(planPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan uploadPlan
+	err = json.Unmarshal(data, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("plan %s is damaged: %w", planPath, err)
+	}
+	if plan.Version > planVersion {
+		return nil, fmt.Errorf("plan %s has version %d, update ydu", planPath, plan.Version)
+	}
+	if plan.Target == "" {
+		return nil, fmt.Errorf("plan %s has no target", planPath)
+	}
+	return &plan, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// stagingSuffix marks the staging copy of a protected remote path, which
+// uploads write to until it is promoted into place.
+const stagingSuffix = ".ydu-staging"
+
+// protectedPath returns the production path of target when it is a
+// protected path of c or lies below one, also when target is its staging
+// copy, and "" when target is not protected.
+func (c *config) protectedPath(target string) string {
+	target = strings.TrimSuffix(target, stagingSuffix)
+	for _, protected := range c.Protected {
+		protected = strings.TrimSuffix(protected, "/")
+		if target == protected || strings.HasPrefix(target, protected+"/") {
+			return target
+		}
+	}
+	return ""
+}
+
+// validateProtected checks the protected paths of the config.
+func validateProtected(protected []string) error {
+	for _, p := range protected {
+		if !strings.HasPrefix(p, "disk:/") && !strings.HasPrefix(p, "app:/") {
+			return fmt.Errorf("%q is not an absolute disk:/ or app:/ path", p)
+		}
+	}
+	return nil
+}
+
+// prepareStaging returns the staging copy of the protected path
+// production. A new staging folder starts as a server side copy of
+// production, so unchanged files are skipped and --delete compares with
+// the complete tree; an existing one is left as a previous run left it.
+func prepareStaging(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	production, token string,
+	folder bool,
+) (string, error) {
+	staging := production + stagingSuffix
+
+	_, err := getDiskResource(httpClient, staging, token)
+	if err == nil {
+		logger.Info(
+			"continuing staged upload",
+			slog.String("path", production),
+			slog.String("staging", staging),
+		)
+		return staging, nil
+	}
+	if !isAPIError(err, errDiskPathDoesntExists) {
+		return "", err
+	}
+
+	if folder {
+		res, err := getDiskResource(httpClient, production, token)
+		if err == nil && res.Type == "dir" {
+			err = copyResource(httpClient, production, staging, token, false)
+		} else if isAPIError(err, errDiskPathDoesntExists) {
+			err = nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	logger.Info(
+		"staging upload to protected path",
+		slog.String("path", production),
+		slog.String("staging", staging),
+	)
+	return staging, nil
+}
+
+// promoteStaging moves the staging copy of the protected path
+// production into place with a single server side move. An upload still
+// writing to the staging copy, from this machine or with --remote-lock
+// from another one, stops the promotion.
+func promoteStaging(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	production, token string,
+	locking lockOptions,
+) error {
+	staging := production + stagingSuffix
+
+	// the marker of --remote-lock lives in the staging folder and would
+	// be moved along
+	locking.Remote = false
+	lock, err := acquireLock(logger, httpClient, staging, token, locking)
+	if err != nil {
+		return err
+	}
+	defer lock.release(logger)
+
+	res, err := getDiskResource(httpClient, staging, token)
+	if isAPIError(err, errDiskPathDoesntExists) {
+		return fmt.Errorf("nothing staged for %s", production)
+	}
+	if err != nil {
+		return err
+	}
+	if res.Type == "dir" {
+		for _, item := range res.Embedded.Items {
+			if item.Name == remoteLockName {
+				return fmt.Errorf("%s is locked by an upload in progress", staging)
+			}
+		}
+	}
+
+	err = moveResource(httpClient, staging, production, token, true)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"staged upload promoted",
+		slog.String("path", production),
+		slog.String("staging", staging),
+	)
+	return nil
+}
+
+// runPromote implements `ydu promote <protected-path>` which moves the
+// staging copy of a protected path, written by uploads to it, into
+// place.
+func runPromote(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	locking := addLockFlags(flags, false)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: ydu promote <protected-path>")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	production, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+	production = strings.TrimSuffix(strings.TrimSuffix(production, "/"), stagingSuffix)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.protectedPath(production) == "" {
+		return fmt.Errorf("%s is not a protected path of the config", production)
+	}
+
+	return promoteStaging(logger, httpClient, production, token, *locking)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseAge parses durations like time.ParseDuration and additionally
+// accepts whole days and weeks, e.g. "30d" or "2w".
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	} {
+		if n, found := strings.CutSuffix(s, suffix); found {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	return time.ParseDuration(s)
+}
+
+// runPrune implements `ydu prune` which deletes old backups among the
+// direct children of a remote folder.
+func runPrune(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	keepLast := flags.Int(
+		"keep-last",
+		0,
+		"always keep this many newest resources",
+	)
+	olderThan := flags.String(
+		"older-than",
+		"",
+		"only delete resources modified longer ago than this, e.g. 30d, 2w or 12h",
+	)
+	var tags tagFilter
+	flags.Var(
+		&tags,
+		"tag",
+		"only consider resources with this custom property key=value, may be repeated",
+	)
+	permanently := flags.Bool(
+		"permanently",
+		false,
+		"delete permanently instead of moving to the trash",
+	)
+	dryRun := flags.Bool(
+		"dry-run",
+		false,
+		"only print what would be deleted",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: ydu prune [--keep-last n] [--older-than age] [--tag key=value] <remote-path>")
+	}
+	if *keepLast == 0 && *olderThan == "" {
+		return errors.New("set --keep-last and/or --older-than")
+	}
+
+	var maxAge time.Duration
+	if *olderThan != "" {
+		var err error
+		maxAge, err = parseAge(*olderThan)
+		if err != nil {
+			return err
+		}
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	root, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	dir, err := getDiskResource(httpClient, root, token)
+	if err != nil {
+		return err
+	}
+	if dir.Type != "dir" {
+		return fmt.Errorf("%s is not a folder", root)
+	}
+
+	var candidates []resource
+	for _, item := range dir.Embedded.Items {
+		// the lock and the staging folder of a running backup are not
+		// snapshots
+		if item.Name == remoteLockName || strings.HasSuffix(item.Name, partialSuffix) {
+			continue
+		}
+		if tags.matches(item) {
+			candidates = append(candidates, item)
+		}
+	}
+
+	// newest first
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Modified.After(candidates[j].Modified)
+	})
+
+	deleted := 0
+	for i, item := range candidates {
+		if i < *keepLast {
+			continue
+		}
+		if maxAge > 0 && time.Since(item.Modified) < maxAge {
+			continue
+		}
+
+		remotePath := path.Join(root, item.Name)
+		logger.Info(
+			"pruning",
+			slog.String("path", remotePath),
+			slog.Time("modified", item.Modified),
+			slog.Bool("dry run", *dryRun),
+		)
+
+		if !*dryRun {
+			err := deleteResource(httpClient, remotePath, token, *permanently)
+			if err != nil {
+				return err
+			}
+		}
+		deleted++
+	}
+
+	calls, limited := apiPacer.Stats()
+	logger.Info(
+		"prune finished",
+		slog.Int("candidates", len(candidates)),
+		slog.Int("deleted", deleted),
+		slog.Int("api calls", calls),
+		slog.Int("rate limited", limited),
+	)
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// safeLocalName rejects remote names that would escape the target
+// directory when joined to a local path.
+func safeLocalName(name string) error {
+	if name == "" ||
+		name == "." ||
+		name == ".." ||
+		strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("unsafe remote file name %q", name)
+	}
+	return nil
+}
+
+func getPublicResource(
+	httpClient *http.Client,
+	publicKey, resourcePath, token string,
+) (*resource, error) {
+	params := url.Values{}
+	params.Add("public_key", publicKey)
+	params.Add("path", resourcePath)
+	params.Add("fields", fieldsParam(resourceFields))
+
+	return getResource(
+		httpClient,
+		"/public/resources",
+		params,
+		token,
+	)
+}
+
+// downloadPublicFile downloads the public file res to localPath through
+// a partial file, renamed into place with the modification time of res
+// once it matches its size and md5.
+func downloadPublicFile(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	publicKey, resourcePath, localPath, token string,
+	res resource,
+) error {
+	params := url.Values{}
+	params.Add("public_key", publicKey)
+	params.Add("path", resourcePath)
+
+	var link apiLink
+	err := apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/public/resources/download",
+		params,
+		token,
+		&link,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"error during requesting download url for %s: %w",
+			resourcePath,
+			err,
+		)
+	}
+
+	partialPath := localPath + partialSuffix
+	err = downloadResumable(httpClient, link.Href, partialPath, res.Size, res.MD5, 1)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(partialPath, localPath)
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(localPath, res.Modified, res.Modified)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"file downloaded",
+		slog.String("path", resourcePath),
+		slog.String("local path", localPath),
+	)
+	return nil
+}
+
+// getPublicTree downloads the public resource at resourcePath to
+// localPath, folders are downloaded recursively.
+func getPublicTree(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	publicKey, resourcePath, localPath, token string,
+) error {
+	res, err := getPublicResource(
+		httpClient,
+		publicKey,
+		resourcePath,
+		token,
+	)
+	if err != nil {
+		return err
+	}
+
+	if res.Type != "dir" {
+		return downloadPublicFile(
+			logger,
+			httpClient,
+			publicKey,
+			resourcePath,
+			localPath,
+			token,
+			*res,
+		)
+	}
+
+	err = os.MkdirAll(localPath, 0o755)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range res.Embedded.Items {
+		err := safeLocalName(item.Name)
+		if err != nil {
+			return err
+		}
+
+		err = getPublicTree(
+			logger,
+			httpClient,
+			publicKey,
+			path.Join(resourcePath, item.Name),
+			filepath.Join(localPath, item.Name),
+			token,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runGetPublic implements `ydu get-public <public-url> [local-path]`.
+func runGetPublic(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("get-public", flag.ExitOnError)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: ydu get-public <public-url> [local-path]")
+	}
+	publicKey := flags.Arg(0)
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+
+	// the token is optional for public resources
+	token := os.Getenv("YANDEX_DISK_TOKEN")
+
+	res, err := getPublicResource(
+		httpClient,
+		publicKey,
+		"/",
+		token,
+	)
+	if err != nil {
+		return err
+	}
+
+	localPath := flags.Arg(1)
+	if info, err := os.Stat(localPath); localPath == "" ||
+		(err == nil && info.IsDir() && res.Type != "dir") {
+		err := safeLocalName(res.Name)
+		if err != nil {
+			return err
+		}
+		localPath = filepath.Join(localPath, res.Name)
+	}
+
+	logger.Info(
+		"downloading public resource",
+		slog.String("name", res.Name),
+		slog.String("type", res.Type),
+		slog.String("size", humanize.Bytes(uint64(res.Size))),
+		slog.String("local path", localPath),
+	)
+
+	return getPublicTree(
+		logger,
+		httpClient,
+		publicKey,
+		"/",
+		localPath,
+		token,
+	)
+}
+
+// runSavePublic implements `ydu save-public <public-url> <remote-path>`
+// which copies a public resource to the own disk on the server side.
+func runSavePublic(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("save-public", flag.ExitOnError)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	pollInterval := flags.Duration(
+		"poll-interval",
+		2*time.Second,
+		"how often to check the copy operation status",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: ydu save-public <public-url> <remote-path>")
+	}
+	publicKey := flags.Arg(0)
+
+	token := os.Getenv("YANDEX_DISK_TOKEN")
+	if token == "" {
+		return errors.New("pass ENV variable with yandex disk token YANDEX_DISK_TOKEN")
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	remotePath, err := resolveRemotePath(httpClient, flags.Arg(1), token)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Add("public_key", publicKey)
+	params.Add("save_path", path.Dir(remotePath))
+	params.Add("name", path.Base(remotePath))
+
+	var link apiLink
+	err = apiRequest(
+		httpClient,
+		http.MethodPost,
+		"/public/resources/save-to-disk",
+		params,
+		token,
+		&link,
+	)
+	if err != nil {
+		return err
+	}
+
+	if id := trackOperation(link, "save-public "+publicKey+" -> "+remotePath); id != "" {
+		logger.Info(
+			"waiting for copy operation",
+			slog.String("operation id", id),
+		)
+
+		err = waitOperation(httpClient, id, token, *pollInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info(
+		"public resource saved",
+		slog.String("public url", publicKey),
+		slog.String("path", remotePath),
+	)
+	return nil
+}
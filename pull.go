@@ -0,0 +1,542 @@
+package main
+
+import (
+	"cmp"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileMD5 returns the hex encoded md5 checksum of a local file.
+func fileMD5(localPath string) (string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// localMatches reports whether localPath already has the content of the
+// remote file res, compared as selected by mode.
+func localMatches(localPath string, res resource, mode compareMode) (bool, error) {
+	info, err := os.Stat(localPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	return mode.match(
+		info.Size(),
+		info.ModTime(),
+		res,
+		func() (string, error) { return localHashes.MD5(localPath) },
+	)
+}
+
+// runPull implements `ydu pull [--delete] <remote-dir> <local-dir>` which
+// downloads new and changed remote files, the reverse of a directory
+// upload.
+func runPull(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	deleteExtra := flags.Bool(
+		"delete",
+		false,
+		"delete local files that do not exist on yandex disk",
+	)
+	dryRun := flags.Bool(
+		"dry-run",
+		false,
+		"only print what would be downloaded and deleted",
+	)
+	rehash := flags.Bool(
+		"rehash",
+		false,
+		"ignore cached checksums of local files and hash them again",
+	)
+	maxDelete := deleteLimit{Percent: 50}
+	flags.Var(
+		&maxDelete,
+		"max-delete",
+		"abort --delete when it would remove more local files than this count or percentage",
+	)
+	forceDelete := flags.Bool(
+		"force-delete",
+		false,
+		"delete local extras even beyond --max-delete",
+	)
+	compare := compareSizeMtime
+	flags.Var(
+		&compare,
+		"compare",
+		"compare files by size, size+mtime or checksum",
+	)
+	unicodeNormalize := unicodeNone
+	flags.Var(
+		&unicodeNormalize,
+		"unicode-normalize",
+		"compare and create file names in this unicode form: nfc, nfd or none",
+	)
+	preservePerms := flags.Bool(
+		"preserve-perms",
+		false,
+		"restore the mode, and as root the owner and group, recorded by --preserve-perms uploads",
+	)
+	streams := flags.Int(
+		"streams",
+		defaultDownloadStreams,
+		"download files of 64 MiB and more in this many ranges at once",
+	)
+	concurrency := flags.Int(
+		"concurrency",
+		defaultTransferConcurrency,
+		"number of files downloaded at once, the upper bound with --adaptive",
+	)
+	adaptive := flags.Bool(
+		"adaptive",
+		false,
+		"adapt the number of files downloaded at once to the throughput and rate limiting",
+	)
+	var bwlimit bandwidthSchedule
+	flags.Var(
+		&bwlimit,
+		"bwlimit",
+		"limit transfer speed in bytes per second, e.g. 2M, or per time of day: 08:00-18:00=2M,18:00-08:00=unlimited",
+	)
+	locking := addLockFlags(flags, false)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: ydu pull [--delete] [--dry-run] <remote-dir> <local-dir>")
+	}
+	remoteDir, localDir := flags.Arg(0), flags.Arg(1)
+	runTarget = localDir
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+	bandwidth.SetSchedule(bwlimit)
+
+	remoteDir, err = resolveRemotePath(httpClient, remoteDir, token)
+	if err != nil {
+		return err
+	}
+
+	if !*dryRun {
+		absDir, err := filepath.Abs(localDir)
+		if err != nil {
+			return err
+		}
+		lock, err := acquireLock(logger, httpClient, absDir, "", *locking)
+		if err != nil {
+			return err
+		}
+		defer lock.release(logger)
+	}
+
+	err = localHashes.Open(*rehash)
+	if err != nil {
+		return err
+	}
+	defer saveHashCache(logger)
+
+	err = remoteRevisions.Open()
+	if err != nil {
+		return err
+	}
+	defer saveRemoteRevisions(logger)
+
+	result, err := mirrorRemote(
+		logger,
+		httpClient,
+		remoteDir,
+		localDir,
+		token,
+		compare,
+		unicodeNormalize,
+		*streams,
+		newConcurrencyLimiter(max(1, *concurrency), *adaptive),
+		*preservePerms,
+		*dryRun,
+	)
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	if *deleteExtra {
+		limit := &maxDelete
+		if *forceDelete {
+			limit = nil
+		}
+		deleted, err = deleteLocalExtras(
+			logger,
+			localDir,
+			result.Paths,
+			limit,
+			unicodeNormalize,
+			*dryRun,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info(
+		"pull finished",
+		slog.Int("downloaded", result.Downloaded),
+		slog.Int("unchanged", result.Unchanged),
+		slog.Int("linked", result.Linked),
+		slog.Int("deleted", deleted),
+	)
+	return nil
+}
+
+// mirrorResult summarizes a mirrorRemote run.
+type mirrorResult struct {
+	// Paths holds every local path that mirrors a remote file or folder.
+	Paths      map[string]bool
+	Downloaded int
+	Unchanged  int
+	// Linked counts the files restored as hard links.
+	Linked int
+}
+
+// mirrorRemote downloads the remote files below remoteDir that are
+// missing or differ in localDir, as many at once as limiter allows and
+// large files in up to streams ranges at once. With perms, local files
+// get the permissions recorded on the disk.
+func mirrorRemote(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	remoteDir, localDir, token string,
+	compare compareMode,
+	form unicodeForm,
+	streams int,
+	limiter *concurrencyLimiter,
+	perms bool,
+	dryRun bool,
+) (mirrorResult, error) {
+	result := mirrorResult{Paths: map[string]bool{}}
+
+	// matches reports whether localPath is already up to date, the
+	// remaining files are downloaded once the walk is complete
+	matches := func(res resource, localPath string) (bool, error) {
+		same, err := localMatches(localPath, logicalResource(res), compare)
+		if err != nil || !same {
+			return false, err
+		}
+
+		result.Unchanged++
+		recordPulledRevision(res, token)
+		if perms && !dryRun {
+			return true, applyPermProperties(localPath, res)
+		}
+		return true, nil
+	}
+
+	download := func(res resource, localPath string) error {
+		logger.Info(
+			"downloading",
+			slog.String("path", res.Path),
+			slog.String("local path", localPath),
+			slog.Bool("dry run", dryRun),
+		)
+		if dryRun {
+			return nil
+		}
+
+		err := downloadRemoteFile(httpClient, res, localPath, token, streams)
+		if err != nil {
+			return err
+		}
+		recordPulledRevision(res, token)
+		if perms {
+			return applyPermProperties(localPath, res)
+		}
+		return nil
+	}
+
+	mirrorFile := func(res resource, localPath string) error {
+		same, err := matches(res, localPath)
+		if err != nil || same {
+			return err
+		}
+		result.Downloaded++
+		return download(res, localPath)
+	}
+
+	type pendingDownload struct {
+		res       resource
+		localPath string
+	}
+	var downloads []pendingDownload
+
+	// hard links are restored once the files they link to are in place
+	type pendingLink struct {
+		res       resource
+		localPath string
+		primary   string
+	}
+	var links []pendingLink
+
+	err := walkRemote(
+		httpClient,
+		remoteDir,
+		token,
+		func(rel string, res resource) error {
+			for _, name := range strings.Split(rel, "/") {
+				err := safeLocalName(name)
+				if err != nil {
+					return err
+				}
+			}
+
+			localPath := filepath.Join(
+				localDir,
+				filepath.FromSlash(form.apply(rel)),
+			)
+			result.Paths[localPath] = true
+
+			if res.Type == "dir" {
+				if dryRun {
+					return nil
+				}
+				return os.MkdirAll(localPath, 0o755)
+			}
+
+			// the manifest of a snapshot describes it, it is not part
+			// of the restored files
+			if rel == manifestName {
+				return nil
+			}
+
+			if link := recordedHardLink(res); link != "" {
+				links = append(links, pendingLink{
+					res:       res,
+					localPath: localPath,
+					primary:   filepath.Join(localDir, filepath.FromSlash(form.apply(link))),
+				})
+				return nil
+			}
+			same, err := matches(res, localPath)
+			if err != nil || same {
+				return err
+			}
+			downloads = append(downloads, pendingDownload{res: res, localPath: localPath})
+			return nil
+		},
+	)
+	if err != nil {
+		return result, err
+	}
+
+	// the first failed download stops the others from starting
+	var mu sync.Mutex
+	var downloadErr error
+	runLimited(
+		limiter,
+		len(downloads),
+		func(i int) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return downloadErr == nil
+		},
+		func(i int) (int64, error) {
+			file := downloads[i]
+			err := download(file.res, file.localPath)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				downloadErr = cmp.Or(downloadErr, err)
+				return 0, err
+			}
+			result.Downloaded++
+			return file.res.Size, nil
+		},
+	)
+	if downloadErr != nil {
+		return result, downloadErr
+	}
+
+	for _, link := range links {
+		linked, err := restoreHardLink(
+			logger,
+			link.localPath,
+			link.primary,
+			logicalResource(link.res),
+			dryRun,
+		)
+		if err != nil {
+			return result, err
+		}
+		if !linked {
+			// the file it links to is missing or differs
+			err = mirrorFile(link.res, link.localPath)
+			if err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		result.Linked++
+		recordPulledRevision(link.res, token)
+		if perms && !dryRun {
+			err = applyPermProperties(link.localPath, link.res)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// downloadRemoteFile downloads the remote file res to localPath with its
+// modification time, the recorded one of --preserve-perms uploads, large
+// files in up to streams ranges at once.
+func downloadRemoteFile(
+	httpClient *http.Client,
+	res resource,
+	localPath, token string,
+	streams int,
+) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	href, err := downloadURL(httpClient, res.Path, token)
+	if err != nil {
+		return err
+	}
+
+	// a failed download never replaces the previous copy and is resumed
+	// by the next run
+	partialPath := localPath + partialSuffix
+	started := time.Now()
+	err = downloadResumable(httpClient, href, partialPath, res.Size, res.MD5, streams)
+	recordTransfer("download", res.Size, time.Since(started), err)
+	if err != nil {
+		return err
+	}
+
+	if _, sparse := res.CustomProperties[sparseSizeProperty]; sparse {
+		err = expandSparseFile(partialPath, localPath, res)
+	} else {
+		err = os.Rename(partialPath, localPath)
+	}
+	if err != nil {
+		return err
+	}
+	modified := recordedModTime(res)
+	return os.Chtimes(localPath, modified, modified)
+}
+
+// deleteLocalExtras removes files and folders below localDir that are
+// not in keep, also after normalizing their names to form, and returns
+// the number of removed files. Nothing is removed when that number
+// exceeds limit.
+func deleteLocalExtras(
+	logger *slog.Logger,
+	localDir string,
+	keep map[string]bool,
+	limit *deleteLimit,
+	form unicodeForm,
+	dryRun bool,
+) (int, error) {
+	var extras []string
+	total, deleting := 0, 0
+	err := filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if p == localDir && errors.Is(err, fs.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if p == localDir {
+			return nil
+		}
+
+		extra := !keep[p] && !keep[form.apply(p)]
+		if last := len(extras) - 1; last >= 0 &&
+			strings.HasPrefix(p, extras[last]+string(filepath.Separator)) {
+			// inside a folder that is deleted as a whole
+			extra = false
+			if !d.IsDir() {
+				deleting++
+			}
+		}
+
+		if !d.IsDir() {
+			total++
+		}
+		if !extra {
+			return nil
+		}
+
+		extras = append(extras, p)
+		if !d.IsDir() {
+			deleting++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if limit != nil {
+		err = limit.check(deleting, total)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, extra := range extras {
+		logger.Info(
+			"deleting local extra",
+			slog.String("local path", extra),
+			slog.Bool("dry run", dryRun),
+		)
+		if dryRun {
+			continue
+		}
+
+		err := os.RemoveAll(extra)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return deleting, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// uploadItem is a single file of the upload queue.
+type uploadItem struct {
+	LocalPath string
+	// RelPath is the slash separated path relative to the upload root.
+	RelPath    string
+	RemotePath string
+	Size       int64
+	ModTime    time.Time
+	// OriginalPath is the RelPath of an item whose remote name was
+	// changed by --sanitize or --case-collisions rename.
+	OriginalPath string
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// unreadableEntry is an entry below an uploaded directory that could
+// not be read, a dangling symlink or a folder without permission.
+type unreadableEntry struct {
+	LocalPath  string
+	RelPath    string
+	RemotePath string
+	Dir        bool
+	Err        error
+}
+
+// buildUploadQueue lists the files to upload. A directory is walked
+// recursively and mirrored below remoteRoot. Entries that cannot be read
+// are skipped and returned as unreadable, the rest of the directory is
+// still listed.
+func buildUploadQueue(localPath, remoteRoot string) ([]uploadItem, []unreadableEntry, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !info.IsDir() {
+		return []uploadItem{
+			{
+				LocalPath:  localPath,
+				RelPath:    filepath.Base(localPath),
+				RemotePath: remoteRoot,
+				Size:       info.Size(),
+				ModTime:    info.ModTime(),
+			},
+		}, nil, nil
+	}
+
+	var queue []uploadItem
+	var unreadable []unreadableEntry
+	err = filepath.WalkDir(localPath, func(p string, d fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(localPath, p)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+
+		skip := func(err error) error {
+			unreadable = append(unreadable, unreadableEntry{
+				LocalPath:  p,
+				RelPath:    rel,
+				RemotePath: path.Join(remoteRoot, rel),
+				Dir:        d != nil && d.IsDir(),
+				Err:        err,
+			})
+			return nil
+		}
+		if err != nil {
+			// a folder that cannot be listed is skipped as a whole
+			return skip(err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		// follow symlinks to regular files, skip everything else
+		info, err := os.Stat(p)
+		if err != nil {
+			return skip(err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		queue = append(queue, uploadItem{
+			LocalPath:  p,
+			RelPath:    rel,
+			RemotePath: path.Join(remoteRoot, rel),
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+		})
+		return nil
+	})
+
+	return queue, unreadable, err
+}
+
+// priorityRank returns the index of the first pattern matching the
+// item's base name or relative path, or len(patterns) when none match.
+func priorityRank(item uploadItem, patterns []string) int {
+	for i, pattern := range patterns {
+		if ok, _ := path.Match(pattern, path.Base(item.RelPath)); ok {
+			return i
+		}
+		if ok, _ := path.Match(pattern, item.RelPath); ok {
+			return i
+		}
+	}
+	return len(patterns)
+}
+
+// orderUploadQueue sorts the queue so files matching priority patterns
+// come first, in pattern order, followed by the rest sorted by order.
+func orderUploadQueue(
+	queue []uploadItem,
+	order string,
+	priorityPatterns []string,
+) error {
+	var less func(a, b uploadItem) bool
+
+	switch order {
+	case "alpha":
+		less = func(a, b uploadItem) bool {
+			return a.RelPath < b.RelPath
+		}
+	case "size-asc":
+		less = func(a, b uploadItem) bool {
+			return a.Size < b.Size
+		}
+	case "size-desc":
+		less = func(a, b uploadItem) bool {
+			return a.Size > b.Size
+		}
+	case "mtime":
+		less = func(a, b uploadItem) bool {
+			return a.ModTime.After(b.ModTime)
+		}
+	default:
+		return fmt.Errorf(
+			"unknown upload order %q, use size-asc, size-desc, mtime or alpha",
+			order,
+		)
+	}
+
+	for _, pattern := range priorityPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf(
+				"invalid priority pattern %q: %v",
+				pattern,
+				err,
+			)
+		}
+	}
+
+	sort.SliceStable(queue, func(i, j int) bool {
+		ri := priorityRank(queue[i], priorityPatterns)
+		rj := priorityRank(queue[j], priorityPatterns)
+		if ri != rj {
+			return ri < rj
+		}
+		return less(queue[i], queue[j])
+	})
+
+	return nil
+}
+
+// readFileList splits a --files-from list into paths. Empty entries are
+// ignored, with newline separation so is the trailing carriage return.
+func readFileList(r io.Reader, nul bool) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	separator := "\n"
+	if nul {
+		separator = "\x00"
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(data), separator) {
+		if !nul {
+			name = strings.TrimSuffix(name, "\r")
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// writeFileList writes the absolute local paths of queue to listPath in
+// the --files-from format, so an interrupted run can be continued.
+func writeFileList(listPath string, queue []uploadItem) error {
+	var list strings.Builder
+	for _, item := range queue {
+		localPath, err := filepath.Abs(item.LocalPath)
+		if err != nil {
+			return err
+		}
+		list.WriteString(localPath)
+		list.WriteString("\n")
+	}
+
+	return os.WriteFile(listPath, []byte(list.String()), 0o644)
+}
+
+// buildFilesFromQueue builds the upload queue from the list at listPath.
+// Files keep their path relative to baseDir (or to the current directory
+// for relative entries without a base) below remoteRoot.
+func buildFilesFromQueue(
+	listPath string,
+	nul bool,
+	baseDir, remoteRoot string,
+) ([]uploadItem, error) {
+	var list io.Reader = os.Stdin
+	if listPath != "-" {
+		file, err := os.Open(listPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		list = file
+	}
+
+	names, err := readFileList(list, nul)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := make([]uploadItem, 0, len(names))
+	for _, name := range names {
+		localPath := name
+		if baseDir != "" && !filepath.IsAbs(name) {
+			localPath = filepath.Join(baseDir, name)
+		}
+
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf(
+				"%s from --files-from is not a regular file",
+				localPath,
+			)
+		}
+
+		rel, err := listedRelPath(localPath, baseDir)
+		if err != nil {
+			return nil, err
+		}
+
+		queue = append(queue, uploadItem{
+			LocalPath:  localPath,
+			RelPath:    rel,
+			RemotePath: path.Join(remoteRoot, rel),
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+		})
+	}
+
+	return queue, nil
+}
+
+// listedRelPath returns the slash separated path a listed file is
+// uploaded under relative to the remote root.
+func listedRelPath(localPath, baseDir string) (string, error) {
+	rel := filepath.Clean(localPath)
+
+	if baseDir != "" {
+		absBase, err := filepath.Abs(baseDir)
+		if err != nil {
+			return "", err
+		}
+		absPath, err := filepath.Abs(localPath)
+		if err != nil {
+			return "", err
+		}
+		rel, err = filepath.Rel(absBase, absPath)
+		if err != nil {
+			return "", err
+		}
+	} else if filepath.IsAbs(rel) {
+		rel = strings.TrimPrefix(
+			rel[len(filepath.VolumeName(rel)):],
+			string(filepath.Separator),
+		)
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf(
+			"%s is outside of %s",
+			localPath,
+			baseDir,
+		)
+	}
+	return rel, nil
+}
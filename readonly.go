@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// readOnly is set by the read_only config option, YDU_READ_ONLY=1 or the
+// global --read-only flag, in increasing precedence, and readOnlySource
+// names the one that set it last. Every request that would modify the
+// disk is refused in read-only mode.
+var (
+	readOnly       bool
+	readOnlySource string
+)
+
+func setReadOnly(on bool, source string) {
+	readOnly = on
+	readOnlySource = source
+}
+
+var errReadOnly = errors.New("refusing to modify yandex disk in --read-only mode")
+
+// checkWritable returns errReadOnly for mutating requests in read-only
+// mode. what names the refused request.
+func checkWritable(method, what string) error {
+	if !readOnly || method == http.MethodGet || method == http.MethodHead {
+		return nil
+	}
+	return fmt.Errorf("%s %s: %w", method, what, errReadOnly)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// runRecent implements `ydu recent [--limit n]` listing the files
+// uploaded last.
+func runRecent(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("recent", flag.ExitOnError)
+	limit := flags.Int(
+		"limit",
+		20,
+		"number of files to show",
+	)
+	mediaType := flags.String(
+		"media-type",
+		"",
+		"comma separated media types, e.g. archive, video, document",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print files as JSON lines",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 0 || *limit < 1 {
+		return errors.New("usage: ydu recent [--limit n] [--media-type type]")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("limit", strconv.Itoa(*limit))
+	params.Set("fields", listFieldsParam(resourceFields))
+	if *mediaType != "" {
+		params.Set("media_type", *mediaType)
+	}
+
+	var recent resourceList
+	err = apiRequest(
+		newHTTPClient(*httpClientTimeout),
+		http.MethodGet,
+		"/resources/last-uploaded",
+		params,
+		token,
+		&recent,
+	)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, item := range recent.Items {
+			err := encoder.Encode(item)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, item := range recent.Items {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\n",
+			item.Modified.Local().Format(time.DateTime),
+			humanize.Bytes(uint64(item.Size)),
+			item.Path,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"path"
+)
+
+// renamedFile is a queue item missing on the remote whose content
+// exists below the upload root as From.
+type renamedFile struct {
+	Item uploadItem
+	From resource
+}
+
+// findRenamedFiles looks for queue items missing on the remote whose
+// content exists below root under a path that is not in the queue.
+// Remote files matching excludes are protected by --delete and never
+// taken as the source of a rename.
+func findRenamedFiles(
+	httpClient *http.Client,
+	root, token string,
+	queue []uploadItem,
+	excludes excludes,
+) ([]renamedFile, error) {
+	inQueue := map[string]bool{}
+	for _, item := range queue {
+		inQueue[item.RemotePath] = true
+	}
+
+	existing := map[string]bool{}
+	// remote files that are not in the queue, by size
+	candidates := map[int64][]resource{}
+	err := walkRemote(
+		httpClient,
+		root,
+		token,
+		func(rel string, res resource) error {
+			if res.Type == "dir" {
+				return nil
+			}
+
+			remotePath := path.Join(root, rel)
+			existing[remotePath] = true
+			if !inQueue[remotePath] && res.MD5 != "" && !excludes.match(rel) {
+				res = logicalResource(res)
+				res.Path = remotePath
+				candidates[res.Size] = append(candidates[res.Size], res)
+			}
+			return nil
+		},
+	)
+	if isAPIError(err, errDiskPathDoesntExists) {
+		// nothing uploaded yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var renamed []renamedFile
+	for _, item := range queue {
+		if existing[item.RemotePath] || len(candidates[item.Size]) == 0 {
+			continue
+		}
+
+		sum, err := localHashes.MD5(item.LocalPath)
+		if err != nil {
+			return renamed, err
+		}
+
+		sameSize := candidates[item.Size]
+		for i, candidate := range sameSize {
+			if candidate.MD5 == sum {
+				renamed = append(renamed, renamedFile{Item: item, From: candidate})
+				candidates[item.Size] = append(sameSize[:i:i], sameSize[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return renamed, nil
+}
+
+// moveRenamedFiles moves the remote files findRenamedFiles finds into
+// place. A local file that was renamed or moved thus costs a server side
+// move instead of a delete and a fresh upload. It returns the remote
+// paths of the moved items; items whose move fails are uploaded as
+// usual.
+func moveRenamedFiles(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	dirs *remoteDirs,
+	root, token string,
+	queue []uploadItem,
+	excludes excludes,
+) (map[string]bool, error) {
+	renamed, err := findRenamedFiles(httpClient, root, token, queue, excludes)
+
+	moved := map[string]bool{}
+	for _, file := range renamed {
+		item := file.Item
+		moveErr := dirs.ensure(path.Dir(item.RemotePath))
+		if moveErr == nil {
+			moveErr = moveResource(httpClient, file.From.Path, item.RemotePath, token, false)
+		}
+		if moveErr != nil {
+			logger.Warn(
+				"Error during moving renamed file, uploading it",
+				slog.String("file", item.LocalPath),
+				slog.String("from", file.From.Path),
+				slog.String("message", moveErr.Error()),
+			)
+			continue
+		}
+
+		logger.Info(
+			"renamed file moved",
+			slog.String("file", item.LocalPath),
+			slog.String("from", file.From.Path),
+			slog.String("to", item.RemotePath),
+		)
+		moved[item.RemotePath] = true
+	}
+
+	return moved, err
+}
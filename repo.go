@@ -0,0 +1,756 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// A repository stores deduplicated, encrypted chunks of files below
+// <repo>/chunks and one encrypted snapshot per backup below
+// <repo>/snapshots listing the chunks of every file. <repo>/config.json
+// holds the key derivation parameters.
+const (
+	repoVersion    = 1
+	repoIterations = 600000
+	// repoKeyCheck is encrypted into the config to detect a wrong
+	// password before anything is written.
+	repoKeyCheck = "ydu repository"
+)
+
+type repoConfig struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	KeyCheck   []byte `json:"key_check"`
+}
+
+// repoSnapshot is the decrypted content of a snapshot.
+type repoSnapshot struct {
+	Time     time.Time          `json:"time"`
+	Hostname string             `json:"hostname"`
+	Source   string             `json:"source"`
+	Files    []repoSnapshotFile `json:"files"`
+}
+
+type repoSnapshotFile struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Chunks  []string    `json:"chunks"`
+}
+
+// repo is an opened repository.
+type repo struct {
+	httpClient *http.Client
+	root       string
+	token      string
+
+	// encKey encrypts blobs, idKey derives chunk ids so they do not
+	// reveal the content hash.
+	encKey []byte
+	idKey  []byte
+}
+
+func repoPassword() (string, error) {
+	password := os.Getenv("YDU_REPO_PASSWORD")
+	if password == "" {
+		return "", errors.New("pass ENV variable with the repository password YDU_REPO_PASSWORD")
+	}
+	return password, nil
+}
+
+func (r *repo) deriveKeys(password string, config repoConfig) error {
+	key, err := pbkdf2.Key(
+		sha256.New,
+		password,
+		config.Salt,
+		config.Iterations,
+		64,
+	)
+	if err != nil {
+		return err
+	}
+	r.encKey, r.idKey = key[:32], key[32:]
+	return nil
+}
+
+func (r *repo) seal(plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(r.encKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (r *repo) open(blob []byte) ([]byte, error) {
+	block, err := aes.NewCipher(r.encKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blob) < gcm.NonceSize() {
+		return nil, errors.New("repository blob too short")
+	}
+	nonce, ciphertext := blob[:gcm.NonceSize()], blob[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func (r *repo) chunkID(chunk []byte) string {
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r *repo) chunkPath(id string) string {
+	return path.Join(r.root, "chunks", id[:2], id)
+}
+
+// uploadBlob writes data to remotePath, replacing an existing file.
+func uploadBlob(
+	httpClient *http.Client,
+	remotePath, token string,
+	data []byte,
+) error {
+	uploadURL, err := createRequestOnUpload(
+		httpClient,
+		remotePath,
+		token,
+		true,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"error during create upload request to yandex disk: %w",
+			err,
+		)
+	}
+
+	err = uploadStream(
+		httpClient,
+		uploadURL,
+		bytes.NewReader(data),
+		int64(len(data)),
+	)
+	memo.Invalidate(remotePath)
+	auditUpload(remotePath, token, int64(len(data)), err)
+	return err
+}
+
+// downloadBlob reads a remote file into memory.
+func downloadBlob(
+	httpClient *http.Client,
+	remotePath, token string,
+) ([]byte, error) {
+	href, err := downloadURL(httpClient, remotePath, token)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := openDownload(httpClient, href)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// openRepo reads the config of the repository at root and derives the
+// keys from password.
+func openRepo(
+	httpClient *http.Client,
+	root, token, password string,
+) (*repo, error) {
+	data, err := downloadBlob(
+		httpClient,
+		path.Join(root, "config.json"),
+		token,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository config: %w", err)
+	}
+
+	var config repoConfig
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Version != repoVersion {
+		return nil, fmt.Errorf(
+			"unsupported repository version %d",
+			config.Version,
+		)
+	}
+
+	r := &repo{
+		httpClient: httpClient,
+		root:       root,
+		token:      token,
+	}
+	err = r.deriveKeys(password, config)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := r.open(config.KeyCheck)
+	if err != nil || string(check) != repoKeyCheck {
+		return nil, errors.New("wrong repository password")
+	}
+
+	return r, nil
+}
+
+// initRepo creates a new repository at root.
+func initRepo(
+	httpClient *http.Client,
+	root, token, password string,
+) error {
+	exists, err := remoteExists(httpClient, path.Join(root, "config.json"), token)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%s already is a repository", root)
+	}
+
+	config := repoConfig{
+		Version:    repoVersion,
+		Salt:       make([]byte, 32),
+		Iterations: repoIterations,
+	}
+	_, err = rand.Read(config.Salt)
+	if err != nil {
+		return err
+	}
+
+	r := &repo{}
+	err = r.deriveKeys(password, config)
+	if err != nil {
+		return err
+	}
+	config.KeyCheck, err = r.seal([]byte(repoKeyCheck))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dirs := newRemoteDirs(httpClient, root, token)
+	for _, dir := range []string{"chunks", "snapshots"} {
+		err := dirs.ensure(path.Join(root, dir))
+		if err != nil {
+			return err
+		}
+	}
+
+	return uploadBlob(httpClient, path.Join(root, "config.json"), token, data)
+}
+
+// knownChunks lists the ids of the chunks stored in the repository.
+func (r *repo) knownChunks() (map[string]bool, error) {
+	known := map[string]bool{}
+	err := walkRemote(
+		r.httpClient,
+		path.Join(r.root, "chunks"),
+		r.token,
+		func(rel string, res resource) error {
+			if res.Type != "dir" {
+				known[res.Name] = true
+			}
+			return nil
+		},
+	)
+	return known, err
+}
+
+// snapshotNames returns the snapshot names of the repository, oldest
+// first.
+func (r *repo) snapshotNames() ([]string, error) {
+	dir, err := getDiskResource(
+		r.httpClient,
+		path.Join(r.root, "snapshots"),
+		r.token,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, item := range dir.Embedded.Items {
+		if name, found := strings.CutSuffix(item.Name, ".json"); found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *repo) readSnapshot(name string) (*repoSnapshot, error) {
+	blob, err := downloadBlob(
+		r.httpClient,
+		path.Join(r.root, "snapshots", name+".json"),
+		r.token,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := r.open(blob)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s is damaged: %v", name, err)
+	}
+
+	var snapshot repoSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	return &snapshot, err
+}
+
+// backup stores the files below localDir as a new snapshot and returns
+// its name. New chunks are uploaded by concurrency workers.
+func (r *repo) backup(
+	logger *slog.Logger,
+	localDir string,
+	concurrency int,
+) (string, error) {
+	known, err := r.knownChunks()
+	if err != nil {
+		return "", err
+	}
+
+	queue, unreadable, err := buildUploadQueue(localDir, "")
+	if err != nil {
+		return "", err
+	}
+	if len(unreadable) > 0 {
+		return "", unreadable[0].Err
+	}
+
+	hostname, _ := os.Hostname()
+	snapshot := repoSnapshot{
+		Time:     time.Now().UTC(),
+		Hostname: hostname,
+		Source:   localDir,
+		Files:    []repoSnapshotFile{},
+	}
+
+	dirs := newRemoteDirs(r.httpClient, path.Join(r.root, "chunks"), r.token)
+	uploads := r.startChunkUploads(dirs, concurrency)
+	var stored, deduplicated int64
+
+	for _, item := range queue {
+		info, err := os.Stat(item.LocalPath)
+		if err != nil {
+			return "", err
+		}
+
+		file := repoSnapshotFile{
+			Path:    item.RelPath,
+			Size:    info.Size(),
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime(),
+			Chunks:  []string{},
+		}
+
+		err = r.storeFile(item.LocalPath, &file, known, uploads, &stored, &deduplicated)
+		if err != nil {
+			uploads.wait()
+			return "", fmt.Errorf("%s: %w", item.LocalPath, err)
+		}
+		snapshot.Files = append(snapshot.Files, file)
+	}
+
+	// the snapshot must not reference chunks that are not stored yet
+	err = uploads.wait()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", err
+	}
+	blob, err := r.seal(data)
+	if err != nil {
+		return "", err
+	}
+
+	name := snapshot.Time.Format(snapshotTimeLayout)
+	err = uploadBlob(
+		r.httpClient,
+		path.Join(r.root, "snapshots", name+".json"),
+		r.token,
+		blob,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Info(
+		"repository snapshot created",
+		slog.String("snapshot", name),
+		slog.Int("files", len(snapshot.Files)),
+		slog.String("uploaded", humanize.Bytes(uint64(stored))),
+		slog.String("deduplicated", humanize.Bytes(uint64(deduplicated))),
+	)
+	return name, nil
+}
+
+func (r *repo) storeFile(
+	localPath string,
+	file *repoSnapshotFile,
+	known map[string]bool,
+	uploads *chunkUploads,
+	stored, deduplicated *int64,
+) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	chunks := newChunker(f)
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id := r.chunkID(chunk)
+		file.Chunks = append(file.Chunks, id)
+		if known[id] {
+			*deduplicated += int64(len(chunk))
+			continue
+		}
+
+		// the sealed chunk waits in memory until a worker uploads it
+		size := int64(len(chunk)) + repoBlobOverhead
+		bufferMemory.Acquire(size)
+		blob, err := r.seal(chunk)
+		if err != nil {
+			bufferMemory.Release(size)
+			return err
+		}
+
+		err = uploads.add(r.chunkPath(id), blob, size)
+		if err != nil {
+			return err
+		}
+
+		known[id] = true
+		*stored += int64(len(chunk))
+	}
+}
+
+// repoBlobOverhead is what sealing adds to a chunk: the nonce and the
+// authentication tag.
+const repoBlobOverhead = 12 + 16
+
+// sealedChunk is a chunk ready for upload, holding size bytes of
+// bufferMemory.
+type sealedChunk struct {
+	Path string
+	Blob []byte
+	Size int64
+}
+
+// chunkUploads uploads the new chunks of a backup with a pool of
+// workers while the next files are chunked.
+type chunkUploads struct {
+	chunks chan sealedChunk
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func (r *repo) startChunkUploads(dirs *remoteDirs, workers int) *chunkUploads {
+	u := &chunkUploads{chunks: make(chan sealedChunk)}
+	for range max(workers, 1) {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			for chunk := range u.chunks {
+				err := dirs.ensure(path.Dir(chunk.Path))
+				if err == nil {
+					err = uploadBlob(r.httpClient, chunk.Path, r.token, chunk.Blob)
+				}
+				bufferMemory.Release(chunk.Size)
+
+				if err != nil {
+					u.mu.Lock()
+					if u.err == nil {
+						u.err = err
+					}
+					u.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return u
+}
+
+// add queues blob for upload to chunkPath. It returns the error of an
+// earlier upload, the backup cannot complete then.
+func (u *chunkUploads) add(chunkPath string, blob []byte, size int64) error {
+	u.mu.Lock()
+	err := u.err
+	u.mu.Unlock()
+	if err != nil {
+		bufferMemory.Release(size)
+		return err
+	}
+
+	u.chunks <- sealedChunk{Path: chunkPath, Blob: blob, Size: size}
+	return nil
+}
+
+// wait stops the workers once the queued chunks are uploaded and
+// returns the first upload error.
+func (u *chunkUploads) wait() error {
+	close(u.chunks)
+	u.wg.Wait()
+	return u.err
+}
+
+// restore reassembles the files of snapshot below localDir.
+func (r *repo) restore(
+	logger *slog.Logger,
+	snapshot *repoSnapshot,
+	localDir string,
+) error {
+	for _, file := range snapshot.Files {
+		for _, name := range strings.Split(file.Path, "/") {
+			err := safeLocalName(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		localPath := filepath.Join(localDir, filepath.FromSlash(file.Path))
+		err := os.MkdirAll(filepath.Dir(localPath), 0o755)
+		if err != nil {
+			return err
+		}
+
+		err = r.restoreFile(file, localPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
+		}
+
+		logger.Info(
+			"file restored",
+			slog.String("path", file.Path),
+			slog.String("local path", localPath),
+		)
+	}
+	return nil
+}
+
+func (r *repo) restoreFile(file repoSnapshotFile, localPath string) error {
+	partialPath := localPath + partialSuffix
+	f, err := os.OpenFile(
+		partialPath,
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		file.Mode|0o200,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range file.Chunks {
+		blob, err := downloadBlob(r.httpClient, r.chunkPath(id), r.token)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		chunk, err := r.open(blob)
+		if err != nil || r.chunkID(chunk) != id {
+			f.Close()
+			return fmt.Errorf("chunk %s is damaged", id)
+		}
+
+		_, err = f.Write(chunk)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(partialPath, file.Mode)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(partialPath, localPath)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, file.ModTime, file.ModTime)
+}
+
+// runRepo implements `ydu repo init|backup|snapshots|restore`, backups
+// into a deduplicating, encrypted repository.
+func runRepo(logger *slog.Logger, args []string) error {
+	const usage = "usage: ydu repo init <repo> | backup <dir> <repo> | snapshots <repo> | restore <repo> <snapshot|latest> <target-dir>"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	flags := flag.NewFlagSet("repo "+args[0], flag.ExitOnError)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	concurrency := flags.Int(
+		"concurrency",
+		4,
+		"number of chunks uploaded in parallel by backup, buffered within --max-memory",
+	)
+	parseFlags(flags, args[1:])
+
+	argCount := map[string]int{
+		"init":      1,
+		"backup":    2,
+		"snapshots": 1,
+		"restore":   3,
+	}
+	if n, ok := argCount[args[0]]; !ok || flags.NArg() != n {
+		return errors.New(usage)
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	password, err := repoPassword()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+
+	repoArg := flags.Arg(0)
+	if args[0] == "backup" {
+		repoArg = flags.Arg(1)
+	}
+	root, err := resolveRemotePath(httpClient, repoArg, token)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "init" {
+		err = initRepo(httpClient, root, token, password)
+		if err != nil {
+			return err
+		}
+		logger.Info("repository created", slog.String("path", root))
+		return nil
+	}
+
+	r, err := openRepo(httpClient, root, token, password)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "backup":
+		_, err = r.backup(logger, flags.Arg(0), *concurrency)
+		return err
+	case "snapshots":
+		names, err := r.snapshotNames()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, name := range names {
+			snapshot, err := r.readSnapshot(name)
+			if err != nil {
+				return err
+			}
+
+			var size int64
+			for _, file := range snapshot.Files {
+				size += file.Size
+			}
+			fmt.Fprintf(
+				w,
+				"%s\t%s\t%d files\t%s\t%s\n",
+				name,
+				snapshot.Hostname,
+				len(snapshot.Files),
+				humanize.Bytes(uint64(size)),
+				snapshot.Source,
+			)
+		}
+		return w.Flush()
+	default:
+		name := flags.Arg(1)
+		if name == "latest" {
+			names, err := r.snapshotNames()
+			if err != nil {
+				return err
+			}
+			if len(names) == 0 {
+				return fmt.Errorf("no snapshots in %s", root)
+			}
+			name = names[len(names)-1]
+		}
+
+		snapshot, err := r.readSnapshot(name)
+		if err != nil {
+			return err
+		}
+		return r.restore(logger, snapshot, flags.Arg(2))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+)
+
+// version is the ydu release, set at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = ""
+
+// requestIDHeader carries the correlation id of every request.
+const requestIDHeader = "X-Request-Id"
+
+// runID identifies the process in logs and in the ids of its requests,
+// so a failure can be traced from the log to the requests of the run.
+// Jobs started by `ydu run` get theirs in YDU_RUN_ID, so the run can
+// find them in the history.
+var runID = cmp.Or(os.Getenv("YDU_RUN_ID"), newRunID())
+
+// userAgent is sent with every request, the global --user-agent flag
+// or YDU_USER_AGENT replace it.
+var userAgent = os.Getenv("YDU_USER_AGENT")
+
+var requestCount atomic.Uint64
+
+func newRunID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// defaultUserAgent returns "ydu/<version>", the version of a module
+// build is used when none was set at build time.
+func defaultUserAgent() string {
+	v := version
+	if v == "" {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			v = info.Main.Version
+		} else {
+			v = "dev"
+		}
+	}
+	return "ydu/" + v
+}
+
+// identifyingTransport sets the User-Agent and a request id of the form
+// <run id>-<sequence number> on every request.
+type identifyingTransport struct {
+	next http.RoundTripper
+}
+
+func (t identifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+
+	agent := userAgent
+	if agent == "" {
+		agent = defaultUserAgent()
+	}
+	req.Header.Set("User-Agent", agent)
+	req.Header.Set(
+		requestIDHeader,
+		runID+"-"+strconv.FormatUint(requestCount.Add(1), 10),
+	)
+
+	return t.next.RoundTrip(req)
+}
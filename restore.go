@@ -0,0 +1,344 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// runRestore implements `ydu restore <snapshot> <target-dir>` which
+// reconstructs a backup snapshot locally. A snapshot named "latest"
+// resolves to the newest complete snapshot of the backup root.
+func runRestore(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool(
+		"dry-run",
+		false,
+		"only print what would be restored",
+	)
+	rehash := flags.Bool(
+		"rehash",
+		false,
+		"ignore cached checksums of local files and hash them again",
+	)
+	compare := compareSizeMtime
+	flags.Var(
+		&compare,
+		"compare",
+		"compare files by size, size+mtime or checksum",
+	)
+	unicodeNormalize := unicodeNone
+	flags.Var(
+		&unicodeNormalize,
+		"unicode-normalize",
+		"compare and create file names in this unicode form: nfc, nfd or none",
+	)
+	preservePerms := flags.Bool(
+		"preserve-perms",
+		false,
+		"restore the mode, and as root the owner and group, recorded by --preserve-perms uploads",
+	)
+	plan := flags.Bool(
+		"plan",
+		false,
+		"read the manifest of the snapshot and download only the files missing or changed in the target directory",
+	)
+	streams := flags.Int(
+		"streams",
+		defaultDownloadStreams,
+		"download files of 64 MiB and more in this many ranges at once",
+	)
+	concurrency := flags.Int(
+		"concurrency",
+		defaultTransferConcurrency,
+		"number of files downloaded at once, the upper bound with --adaptive",
+	)
+	adaptive := flags.Bool(
+		"adaptive",
+		false,
+		"adapt the number of files downloaded at once to the throughput and rate limiting",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: ydu restore [--dry-run] [--plan] <snapshot> <target-dir>")
+	}
+	localDir := flags.Arg(1)
+	runTarget = localDir
+
+	snapshot, err := expandBackupRoot(strings.TrimSuffix(flags.Arg(0), "/"))
+	if err != nil {
+		return err
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+
+	snapshot, err = resolveRemotePath(httpClient, snapshot, token)
+	if err != nil {
+		return err
+	}
+
+	err = localHashes.Open(*rehash)
+	if err != nil {
+		return err
+	}
+	defer saveHashCache(logger)
+
+	if path.Base(snapshot) == "latest" {
+		root := path.Dir(snapshot)
+
+		snapshots, err := listSnapshots(httpClient, root, token)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("no snapshots found in %s", root)
+		}
+		snapshot = path.Join(root, snapshots[len(snapshots)-1])
+	}
+
+	if strings.HasSuffix(snapshot, partialSuffix) {
+		return fmt.Errorf("%s is an incomplete snapshot", snapshot)
+	}
+
+	logger.Info(
+		"restoring snapshot",
+		slog.String("path", snapshot),
+		slog.String("local path", localDir),
+	)
+
+	var result mirrorResult
+	if *plan {
+		result, err = restoreFromManifest(
+			logger,
+			httpClient,
+			snapshot,
+			localDir,
+			token,
+			unicodeNormalize,
+			*streams,
+			newConcurrencyLimiter(max(1, *concurrency), *adaptive),
+			*preservePerms,
+			*dryRun,
+		)
+	} else {
+		result, err = mirrorRemote(
+			logger,
+			httpClient,
+			snapshot,
+			localDir,
+			token,
+			compare,
+			unicodeNormalize,
+			*streams,
+			newConcurrencyLimiter(max(1, *concurrency), *adaptive),
+			*preservePerms,
+			*dryRun,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"restore finished",
+		slog.Int("downloaded", result.Downloaded),
+		slog.Int("unchanged", result.Unchanged),
+		slog.Int("linked", result.Linked),
+	)
+	return nil
+}
+
+// restoreFromManifest restores the snapshot folder snapshotDir to
+// localDir as planned from its manifest instead of listing it: files
+// whose size and md5 already match are kept, only missing and changed
+// files are downloaded and checked against the manifest.
+func restoreFromManifest(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	snapshotDir, localDir, token string,
+	form unicodeForm,
+	streams int,
+	limiter *concurrencyLimiter,
+	perms bool,
+	dryRun bool,
+) (mirrorResult, error) {
+	result := mirrorResult{Paths: map[string]bool{}}
+
+	manifest, err := readManifest(httpClient, snapshotDir, token)
+	if err != nil {
+		return result, err
+	}
+
+	// the plan lists the files that are missing or differ locally
+	var plan []manifestFile
+	var missing, changed int
+	var size int64
+	for _, file := range manifest.Files {
+		for _, name := range strings.Split(file.Path, "/") {
+			err := safeLocalName(name)
+			if err != nil {
+				return result, err
+			}
+		}
+		if file.LinkOf != "" {
+			for _, name := range strings.Split(file.LinkOf, "/") {
+				err := safeLocalName(name)
+				if err != nil {
+					return result, err
+				}
+			}
+		}
+
+		localPath := filepath.Join(localDir, filepath.FromSlash(form.apply(file.Path)))
+		result.Paths[localPath] = true
+
+		info, err := os.Stat(localPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			missing++
+		} else if err != nil {
+			return result, err
+		} else if sum, err := localHashes.MD5(localPath); err != nil {
+			return result, err
+		} else if info.Size() == file.Size && sum == file.MD5 {
+			result.Unchanged++
+			if perms && !dryRun {
+				err = applyPermProperties(localPath, file.permResource())
+				if err != nil {
+					return result, err
+				}
+			}
+			continue
+		} else {
+			changed++
+		}
+
+		plan = append(plan, file)
+		size += file.Size
+	}
+
+	logger.Info(
+		"restore plan",
+		slog.String("snapshot", manifest.Snapshot),
+		slog.Int("files", len(manifest.Files)),
+		slog.Int("missing", missing),
+		slog.Int("changed", changed),
+		slog.Int("unchanged", result.Unchanged),
+		slog.String("download size", humanize.Bytes(uint64(size))),
+	)
+
+	// files are downloaded first, so the files hard links link to are in
+	// place when the links are restored
+	var downloads, links []manifestFile
+	for _, file := range plan {
+		if file.LinkOf != "" {
+			links = append(links, file)
+		} else {
+			downloads = append(downloads, file)
+		}
+	}
+
+	download := func(file manifestFile) error {
+		localPath := filepath.Join(localDir, filepath.FromSlash(form.apply(file.Path)))
+		remotePath := path.Join(snapshotDir, file.Path)
+		logger.Info(
+			"downloading",
+			slog.String("path", remotePath),
+			slog.String("local path", localPath),
+			slog.Bool("dry run", dryRun),
+		)
+		if dryRun {
+			return nil
+		}
+
+		res, err := getDiskResource(httpClient, remotePath, token)
+		if err != nil {
+			return err
+		}
+		if logical := logicalResource(*res); logical.Size != file.Size || logical.MD5 != file.MD5 {
+			return fmt.Errorf("%s differs from the manifest of the snapshot", remotePath)
+		}
+
+		err = downloadRemoteFile(httpClient, *res, localPath, token, streams)
+		if err != nil {
+			return err
+		}
+		if perms {
+			return applyPermProperties(localPath, file.permResource())
+		}
+		return nil
+	}
+
+	// the first failed download stops the others from starting
+	var mu sync.Mutex
+	var downloadErr error
+	runLimited(
+		limiter,
+		len(downloads),
+		func(i int) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return downloadErr == nil
+		},
+		func(i int) (int64, error) {
+			file := downloads[i]
+			err := download(file)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				downloadErr = cmp.Or(downloadErr, err)
+				return 0, err
+			}
+			result.Downloaded++
+			return file.Size, nil
+		},
+	)
+	if downloadErr != nil {
+		return result, downloadErr
+	}
+
+	for _, file := range links {
+		localPath := filepath.Join(localDir, filepath.FromSlash(form.apply(file.Path)))
+		primaryPath := filepath.Join(localDir, filepath.FromSlash(form.apply(file.LinkOf)))
+		planned := resource{Size: file.Size, MD5: file.MD5}
+		linked, err := restoreHardLink(logger, localPath, primaryPath, planned, dryRun)
+		if err != nil {
+			return result, err
+		}
+		// a link shares the permissions of the file it links to
+		if linked {
+			result.Linked++
+			continue
+		}
+
+		// the file it links to is missing or differs
+		err = download(file)
+		if err != nil {
+			return result, err
+		}
+		result.Downloaded++
+	}
+	return result, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runResume implements `ydu resume [run-id]`. Without a run id it lists
+// the runs that were interrupted, stopped at their deadline or crashed,
+// with one it continues the run: files that reached yandex disk before
+// the run stopped are verified by size and md5 and dropped, the rest is
+// uploaded with the flags of the original run under the same run id.
+func runResume(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("resume", flag.ExitOnError)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() > 1 {
+		return errors.New("usage: ydu resume [run-id]")
+	}
+
+	if flags.NArg() == 0 {
+		return listInterruptedRuns()
+	}
+
+	id := flags.Arg(0)
+	journalPath, err := journalFile(id)
+	if err != nil {
+		return err
+	}
+	journal, err := readRunJournal(journalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no interrupted run %s, see ydu resume", id)
+	}
+	if err != nil {
+		return err
+	}
+	if journal.running() {
+		return fmt.Errorf("run %s is still running as pid %d", id, journal.PID)
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	var pending []failedUpload
+	for _, file := range journal.Failed {
+		uploaded, err := alreadyUploaded(httpClient, file, token)
+		if err != nil {
+			return err
+		}
+		if uploaded {
+			logger.Info(
+				"file already uploaded",
+				slog.String("file", file.LocalPath),
+				slog.String("path", file.RemotePath),
+			)
+			continue
+		}
+		pending = append(pending, file)
+	}
+
+	if len(pending) == 0 {
+		logger.Info(
+			"nothing left to upload",
+			slog.String("resumed run id", id),
+		)
+		return journal.remove()
+	}
+
+	journal.Failed = pending
+	err = journal.save()
+	if err != nil {
+		return err
+	}
+
+	// the upload takes over the journal as a run with the same id
+	rest, err := parseGlobalFlags(journal.Args)
+	if err != nil {
+		return err
+	}
+	err = os.Chdir(journal.Dir)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"resuming run",
+		slog.String("resumed run id", id),
+		slog.Int("files", len(pending)),
+	)
+	runID = id
+	originalArgs = journal.Args
+	os.Args = append(append(os.Args[:1:1], rest...), "--retry-failed", journalPath)
+	runUpload()
+	return nil
+}
+
+// alreadyUploaded reports whether file exists on the disk with the size
+// and md5 of the local file.
+func alreadyUploaded(
+	httpClient *http.Client,
+	file failedUpload,
+	token string,
+) (bool, error) {
+	res, err := getDiskResource(httpClient, file.RemotePath, token)
+	if isAPIError(err, errDiskPathDoesntExists) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	*res = logicalResource(*res)
+
+	info, err := os.Stat(file.LocalPath)
+	if err != nil {
+		return false, err
+	}
+	if res.Type == "dir" || res.Size != info.Size() || res.MD5 == "" {
+		return false, nil
+	}
+
+	sum, err := localHashes.MD5(file.LocalPath)
+	if err != nil {
+		return false, err
+	}
+	return sum == res.MD5, nil
+}
+
+// listInterruptedRuns prints the runs that can be resumed.
+func listInterruptedRuns() error {
+	journals, err := readRunJournals()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN ID\tSTARTED\tSTATE\tFILES LEFT\tTARGET")
+	for _, journal := range journals {
+		state := "crashed"
+		if !journal.Interrupted.IsZero() {
+			state = "interrupted " + journal.Interrupted.Local().Format(time.DateTime)
+		} else if !journal.Stopped.IsZero() {
+			state = "stopped " + journal.Stopped.Local().Format(time.DateTime)
+			if journal.StopReason != "" {
+				state += " (" + journal.StopReason + ")"
+			}
+		} else if journal.running() {
+			state = "running"
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%d\t%s\n",
+			journal.RunID,
+			journal.Started.Local().Format(time.DateTime),
+			state,
+			len(journal.Failed),
+			journal.Target,
+		)
+	}
+	return w.Flush()
+}
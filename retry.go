@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// retryRule is how a class of failures is retried: up to Attempts tries
+// in total, 1 disables retries, waiting Backoff before the first retry
+// and twice as long before every further one, at most MaxBackoff.
+type retryRule struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// retryRuleConfig is a retryRule of the config file, unset fields keep
+// their default. Backoff is a pointer since an explicit 0 retries right
+// away.
+type retryRuleConfig struct {
+	Attempts   int            `yaml:"attempts,omitempty"`
+	Backoff    *time.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff time.Duration  `yaml:"max_backoff,omitempty"`
+}
+
+// retryConfig is the retry policy of the config file, a rule per class
+// of failures:
+//
+//	retry:
+//	  network: {attempts: 10, backoff: 5s, max_backoff: 2m}
+//	  server: {attempts: 5}
+//	  rate_limit: {attempts: 8}
+//	  statuses: [429, 500, 502, 503, 504]
+type retryConfig struct {
+	// Network covers connection errors, timeouts and interrupted
+	// transfers.
+	Network *retryRuleConfig `yaml:"network,omitempty"`
+	// Server covers the retryable 5xx responses.
+	Server *retryRuleConfig `yaml:"server,omitempty"`
+	// RateLimit covers 429 responses, which are paced by the API pacer
+	// besides the backoff.
+	RateLimit *retryRuleConfig `yaml:"rate_limit,omitempty"`
+	// Statuses are the retryable HTTP status codes, by default 429 and
+	// every 5xx but 507, a full disk. 429 is retried as rate_limit, the
+	// other codes as server.
+	Statuses []int `yaml:"statuses,omitempty"`
+}
+
+// The defaults resume a transfer or retry a request twice after
+// network and server errors and try a rate limited API call four times.
+var (
+	defaultNetworkRetry   = retryRule{Attempts: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second}
+	defaultServerRetry    = retryRule{Attempts: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second}
+	defaultRateLimitRetry = retryRule{Attempts: 4, MaxBackoff: 30 * time.Second}
+)
+
+// validate reports the first invalid setting of c.
+func (c *retryConfig) validate() error {
+	rules := map[string]*retryRuleConfig{
+		"network":    c.Network,
+		"server":     c.Server,
+		"rate_limit": c.RateLimit,
+	}
+	for name, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		if rule.Attempts < 0 || (rule.Backoff != nil && *rule.Backoff < 0) || rule.MaxBackoff < 0 {
+			return fmt.Errorf("%s: attempts and backoffs must not be negative", name)
+		}
+	}
+
+	for _, status := range c.Statuses {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("statuses: %d is not an HTTP error status", status)
+		}
+	}
+	return nil
+}
+
+// merged returns r with the unset fields taken from def.
+func (r *retryRuleConfig) merged(def retryRule) retryRule {
+	if r == nil {
+		return def
+	}
+	merged := def
+	if r.Attempts != 0 {
+		merged.Attempts = r.Attempts
+	}
+	if r.Backoff != nil {
+		merged.Backoff = *r.Backoff
+	}
+	if r.MaxBackoff != 0 {
+		merged.MaxBackoff = r.MaxBackoff
+	}
+	return merged
+}
+
+// retryPolicy decides which failures are retried and how.
+type retryPolicy struct {
+	network, server, rateLimit retryRule
+	statuses                   []int
+}
+
+// retries returns the retry policy of the process, read from the config
+// file on first use. A config file that cannot be read leaves the
+// defaults, the command reports the error where it reads the file.
+var retries = sync.OnceValue(func() retryPolicy {
+	var c retryConfig
+	if cfg, err := loadConfig(); err == nil && cfg.Retry != nil && cfg.Retry.validate() == nil {
+		c = *cfg.Retry
+	}
+	return retryPolicy{
+		network:   c.Network.merged(defaultNetworkRetry),
+		server:    c.Server.merged(defaultServerRetry),
+		rateLimit: c.RateLimit.merged(defaultRateLimitRetry),
+		statuses:  c.Statuses,
+	}
+})
+
+// networkError reports whether err is a connection error, a timeout or
+// a connection closed in the middle of a response. Errors of the request
+// itself, e.g. refused in read-only mode, are not, even though the http
+// client reports them like connection errors.
+func networkError(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, errTransferTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// rule returns the rule of the class err belongs to, and false when err
+// is not retryable.
+func (p retryPolicy) rule(err error) (retryRule, bool) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return p.network, networkError(err)
+	}
+
+	status := apiErr.StatusCode
+	retryable := status == http.StatusTooManyRequests ||
+		(status >= 500 && status != http.StatusInsufficientStorage)
+	if p.statuses != nil {
+		retryable = slices.Contains(p.statuses, status)
+	}
+
+	switch {
+	case !retryable:
+		return retryRule{}, false
+	case status == http.StatusTooManyRequests:
+		return p.rateLimit, true
+	default:
+		return p.server, true
+	}
+}
+
+// next returns how long to wait before retrying after attempt failed
+// with err, and false when err is not retried or was the last attempt.
+func (p retryPolicy) next(err error, attempt int) (time.Duration, bool) {
+	rule, ok := p.rule(err)
+	if !ok || attempt >= rule.Attempts {
+		return 0, false
+	}
+
+	delay := rule.Backoff
+	for range attempt - 1 {
+		delay *= 2
+		if delay >= rule.MaxBackoff {
+			break
+		}
+	}
+	return min(delay, rule.MaxBackoff), true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// revisionEntry is the state of a remote file when ydu last wrote or
+// read it.
+type revisionEntry struct {
+	Revision   int64  `json:"revision"`
+	ResourceID string `json:"resource_id,omitempty"`
+}
+
+// revisionStore remembers the revisions of the remote files ydu
+// uploaded or downloaded, so a later upload notices when someone else
+// changed a file in between. Entries are kept per account.
+type revisionStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]map[string]revisionEntry
+	dirty   bool
+}
+
+// remoteRevisions is the revision store of the process. Nothing is
+// recorded or checked until Open is called.
+var remoteRevisions revisionStore
+
+// errChangedRemotely is returned for uploads that would overwrite a file
+// changed by someone else since ydu last saw it.
+var errChangedRemotely = errors.New("changed on yandex disk since the last run, use --force-overwrite to replace it")
+
+// accountKey identifies the account of token without storing the token.
+func accountKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Open loads the store from the user cache directory.
+func (s *revisionStore) Open() error {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = filepath.Join(cacheDir, "ydu", "revisions.json")
+	s.entries = map[string]map[string]revisionEntry{}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &s.entries)
+}
+
+// Lookup returns the recorded revision of remotePath.
+func (s *revisionStore) Lookup(remotePath, token string) (revisionEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, found := s.entries[accountKey(token)][diskPath(remotePath)]
+	return entry, found
+}
+
+// Record remembers the revision of remotePath.
+func (s *revisionStore) Record(remotePath, token string, entry revisionEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries == nil || entry.Revision == 0 {
+		return
+	}
+
+	account := accountKey(token)
+	if s.entries[account] == nil {
+		s.entries[account] = map[string]revisionEntry{}
+	}
+	s.entries[account][diskPath(remotePath)] = entry
+	s.dirty = true
+}
+
+// Save writes the store back when revisions were recorded.
+func (s *revisionStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + partialSuffix
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// saveRemoteRevisions saves remoteRevisions, a failure only loses the
+// protection of the next run and is logged.
+func saveRemoteRevisions(logger *slog.Logger) {
+	err := remoteRevisions.Save()
+	if err != nil {
+		logger.Warn(
+			"Error during saving remote revisions",
+			slog.String("message", err.Error()),
+		)
+	}
+}
+
+// getRevision fetches the current revision of the file at remotePath.
+// found is false when there is no such file.
+func getRevision(
+	httpClient *http.Client,
+	remotePath, token string,
+) (entry revisionEntry, found bool, err error) {
+	params := url.Values{}
+	params.Add("path", remotePath)
+	params.Add("fields", "revision,resource_id")
+
+	var res resource
+	err = apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/resources",
+		params,
+		token,
+		&res,
+	)
+	if isAPIError(err, errDiskPathDoesntExists) {
+		return revisionEntry{}, false, nil
+	}
+	if err != nil {
+		return revisionEntry{}, false, err
+	}
+
+	return revisionEntry{
+		Revision:   res.Revision,
+		ResourceID: res.ResourceID,
+	}, true, nil
+}
+
+// checkUnchangedRemotely returns errChangedRemotely when the file at
+// remotePath differs from the revision recorded for it. Files without a
+// recorded revision are not checked.
+func checkUnchangedRemotely(
+	httpClient *http.Client,
+	remotePath, token string,
+) error {
+	recorded, found := remoteRevisions.Lookup(remotePath, token)
+	if !found {
+		return nil
+	}
+
+	current, exists, err := getRevision(httpClient, remotePath, token)
+	if err != nil || !exists {
+		return err
+	}
+
+	if current != recorded {
+		return fmt.Errorf("%s %w", remotePath, errChangedRemotely)
+	}
+	return nil
+}
+
+// recordUploadedRevision records the revision of a file ydu just
+// uploaded.
+func recordUploadedRevision(
+	httpClient *http.Client,
+	remotePath, token string,
+) error {
+	remoteRevisions.mu.Lock()
+	opened := remoteRevisions.entries != nil
+	remoteRevisions.mu.Unlock()
+	if !opened {
+		return nil
+	}
+
+	entry, found, err := getRevision(httpClient, remotePath, token)
+	if err != nil || !found {
+		return err
+	}
+
+	remoteRevisions.Record(remotePath, token, entry)
+	return nil
+}
+
+// recordPulledRevision records the revision of a file the local copy
+// now matches, so uploading local changes later replaces this revision
+// only.
+func recordPulledRevision(res resource, token string) {
+	remoteRevisions.Record(res.Path, token, revisionEntry{
+		Revision:   res.Revision,
+		ResourceID: res.ResourceID,
+	})
+}
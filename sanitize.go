@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameBytes is the longest file name yandex disk accepts.
+const maxNameBytes = 255
+
+// originalPathProperty is the custom property that records the local
+// path of a file uploaded under a sanitized name.
+const originalPathProperty = "ydu_original_path"
+
+// validSanitizeStrategy reports whether s is a known --sanitize value:
+// replace forbidden characters with "_", percent-encode them, or skip
+// the file with a warning.
+func validSanitizeStrategy(s string) bool {
+	switch s {
+	case "replace", "encode", "skip":
+		return true
+	}
+	return false
+}
+
+// nameProblem describes why yandex disk rejects name, it is empty for
+// acceptable names.
+func nameProblem(name string) string {
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "contains control characters"
+	}
+	if len(name) > maxNameBytes {
+		return fmt.Sprintf("is longer than %d bytes", maxNameBytes)
+	}
+	return ""
+}
+
+// sanitizeName returns name with forbidden characters replaced or
+// percent-encoded as selected by strategy. Overlong names are shortened
+// keeping their extension, a hash of the full name keeps them distinct.
+func sanitizeName(name, strategy string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case !unicode.IsControl(r):
+			b.WriteRune(r)
+		case strategy == "encode":
+			for _, c := range []byte(string(r)) {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		default:
+			b.WriteByte('_')
+		}
+	}
+	sanitized := b.String()
+
+	if len(sanitized) <= maxNameBytes {
+		return sanitized
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4]) + path.Ext(sanitized)
+	if len(suffix) > maxNameBytes/2 {
+		suffix = "~" + hex.EncodeToString(sum[:4])
+	}
+
+	base := sanitized[:maxNameBytes-len(suffix)]
+	// never cut a multi-byte character in half
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + suffix
+}
+
+// sanitizeQueue checks the names of all queue items. With the skip
+// strategy items with forbidden names are removed and returned as
+// skipped, otherwise their remote paths are sanitized and OriginalPath
+// is set so the local name can be recorded after the upload.
+func sanitizeQueue(
+	queue []uploadItem,
+	strategy string,
+) (kept []uploadItem, skipped []transferRecord) {
+	for _, item := range queue {
+		var problem string
+		names := strings.Split(item.RelPath, "/")
+		for i, name := range names {
+			if p := nameProblem(name); p != "" {
+				problem = fmt.Sprintf("name %q %s", name, p)
+				names[i] = sanitizeName(name, strategy)
+			}
+		}
+
+		// a single file upload is stored under the given target name
+		prefix, isBelowRoot := strings.CutSuffix(item.RemotePath, item.RelPath)
+		if problem == "" || !isBelowRoot {
+			kept = append(kept, item)
+			continue
+		}
+
+		if strategy == "skip" {
+			skipped = append(skipped, transferRecord{
+				LocalPath:  item.LocalPath,
+				RemotePath: item.RemotePath,
+				Size:       item.Size,
+				SkipReason: problem + ", yandex disk rejects it",
+			})
+			continue
+		}
+
+		item.OriginalPath = item.RelPath
+		item.RemotePath = prefix + strings.Join(names, "/")
+		kept = append(kept, item)
+	}
+	return kept, skipped
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// secretCache keeps the secrets read by readSecret, so a password
+// manager is asked once per process.
+var secretCache struct {
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+// shellCommand returns command run by the shell of the platform.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// readSecret returns the secret in file or printed by the shell command
+// command, without surrounding white space. A relative file is relative
+// to the config file. The command may prompt on the terminal, e.g. for
+// the passphrase of a password manager.
+func readSecret(file, command string) (string, error) {
+	key := file + "\x00" + command
+
+	secretCache.mu.Lock()
+	defer secretCache.mu.Unlock()
+	if secret, ok := secretCache.secrets[key]; ok {
+		return secret, nil
+	}
+
+	var secret []byte
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			configPath, err := configFile()
+			if err != nil {
+				return "", err
+			}
+			file = filepath.Join(filepath.Dir(configPath), file)
+		}
+
+		var err error
+		secret, err = os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("token_file: %w", err)
+		}
+	} else {
+		var stdout bytes.Buffer
+		cmd := shellCommand(command)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("token_cmd %q: %w", command, err)
+		}
+		secret = stdout.Bytes()
+	}
+
+	value := strings.TrimSpace(string(secret))
+	if value == "" {
+		return "", fmt.Errorf("empty token from %s", strings.Trim(key, "\x00"))
+	}
+
+	if secretCache.secrets == nil {
+		secretCache.secrets = map[string]string{}
+	}
+	secretCache.secrets[key] = value
+	return value, nil
+}
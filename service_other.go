@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+func runService(logger *slog.Logger, args []string) error {
+	return errors.New("windows services are only supported on windows, use `ydu systemd install` instead")
+}
@@ -0,0 +1,347 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceUsage = "usage: ydu service install|start|stop|remove [flags] [-- <upload flags>]"
+
+// runService implements `ydu service` which manages ydu as a native
+// Windows service repeating an upload at a fixed interval.
+func runService(logger *slog.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New(serviceUsage)
+	}
+
+	flags := flag.NewFlagSet("service "+args[0], flag.ExitOnError)
+	name := flags.String(
+		"name",
+		"ydu",
+		"service name",
+	)
+	interval := flags.Duration(
+		"interval",
+		24*time.Hour,
+		"how often the service repeats the upload",
+	)
+	tokenFile := flags.String(
+		"token-file",
+		"",
+		`file with the yandex disk token (default %ProgramData%\ydu\<name>.token)`,
+	)
+	parseFlags(flags, args[1:])
+
+	if *tokenFile == "" {
+		*tokenFile = filepath.Join(
+			os.Getenv("ProgramData"),
+			"ydu",
+			*name+".token",
+		)
+	}
+
+	switch args[0] {
+	case "install":
+		return installService(logger, *name, *interval, *tokenFile, flags.Args())
+	case "start":
+		return controlService(logger, *name, true)
+	case "stop":
+		return controlService(logger, *name, false)
+	case "remove":
+		return removeService(logger, *name)
+	case "run":
+		return svc.Run(*name, &uploadService{
+			name:       *name,
+			interval:   *interval,
+			tokenFile:  *tokenFile,
+			uploadArgs: flags.Args(),
+		})
+	default:
+		return errors.New(serviceUsage)
+	}
+}
+
+func installService(
+	logger *slog.Logger,
+	name string,
+	interval time.Duration,
+	tokenFile string,
+	uploadArgs []string,
+) error {
+	if len(uploadArgs) == 0 {
+		return errors.New("pass upload flags after --")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to resolve ydu executable path: %v",
+			err,
+		)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to connect to service manager: %v",
+			err,
+		)
+	}
+	defer m.Disconnect()
+
+	serviceArgs := append(
+		[]string{
+			"service", "run",
+			"--name", name,
+			"--interval", interval.String(),
+			"--token-file", tokenFile,
+			"--",
+		},
+		uploadArgs...,
+	)
+
+	s, err := m.CreateService(
+		name,
+		executable,
+		mgr.Config{
+			DisplayName: "ydu upload job " + name,
+			Description: "Uploads files to Yandex Disk every " + interval.String(),
+			StartType:   mgr.StartAutomatic,
+		},
+		serviceArgs...,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to create service %s: %v",
+			name,
+			err,
+		)
+	}
+	defer s.Close()
+
+	err = eventlog.InstallAsEventCreate(
+		name,
+		eventlog.Error|eventlog.Warning|eventlog.Info,
+	)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf(
+			"failed to register event log source: %v",
+			err,
+		)
+	}
+
+	logger.Info(
+		"windows service installed",
+		slog.String("name", name),
+		slog.String("token file", tokenFile),
+	)
+	return nil
+}
+
+func controlService(logger *slog.Logger, name string, start bool) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to connect to service manager: %v",
+			err,
+		)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to open service %s: %v",
+			name,
+			err,
+		)
+	}
+	defer s.Close()
+
+	if start {
+		err = s.Start()
+	} else {
+		_, err = s.Control(svc.Stop)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"windows service control sent",
+		slog.String("name", name),
+		slog.Bool("start", start),
+	)
+	return nil
+}
+
+func removeService(logger *slog.Logger, name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to connect to service manager: %v",
+			err,
+		)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to open service %s: %v",
+			name,
+			err,
+		)
+	}
+	defer s.Close()
+
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+
+	eventlog.Remove(name)
+
+	logger.Info(
+		"windows service removed",
+		slog.String("name", name),
+	)
+	return nil
+}
+
+// uploadService runs the configured upload as a child process every
+// interval and forwards its log lines to the Windows event log.
+type uploadService struct {
+	name       string
+	interval   time.Duration
+	tokenFile  string
+	uploadArgs []string
+}
+
+func (s *uploadService) Execute(
+	_ []string,
+	requests <-chan svc.ChangeRequest,
+	status chan<- svc.Status,
+) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	events, err := eventlog.Open(s.name)
+	if err != nil {
+		return true, 1
+	}
+	defer events.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.upload(ctx, events)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	status <- svc.Status{
+		State:   svc.Running,
+		Accepts: svc.AcceptStop | svc.AcceptShutdown,
+	}
+
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			cancel()
+			<-done
+			return false, 0
+		}
+	}
+
+	return false, 0
+}
+
+func (s *uploadService) upload(ctx context.Context, events *eventlog.Log) {
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		events.Error(1, "failed to read token file: "+err.Error())
+		return
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		events.Error(1, "failed to resolve ydu executable path: "+err.Error())
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, executable, s.uploadArgs...)
+	cmd.Env = append(
+		os.Environ(),
+		"YANDEX_DISK_TOKEN="+strings.TrimSpace(string(token)),
+	)
+
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		events.Error(1, err.Error())
+		return
+	}
+	cmd.Stderr = cmd.Stdout
+
+	err = cmd.Start()
+	if err != nil {
+		events.Error(1, "failed to start upload: "+err.Error())
+		return
+	}
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		var entry struct {
+			Level string `json:"level"`
+		}
+		json.Unmarshal([]byte(line), &entry)
+
+		switch entry.Level {
+		case "ERROR":
+			events.Error(1, line)
+		case "WARN":
+			events.Warning(2, line)
+		default:
+			events.Info(3, line)
+		}
+	}
+
+	err = cmd.Wait()
+	if err != nil && ctx.Err() == nil {
+		events.Error(1, "upload failed: "+err.Error())
+	}
+}
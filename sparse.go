@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Sparse files, e.g. disk images, are uploaded with --sparse in an
+// encoding that leaves out their zero blocks: a header of sparseMagic
+// and the logical size, then one record per block holding data, made of
+// the offset, the length and the data. The logical size and md5 are
+// recorded in custom properties, pull and restore expand the file again
+// with holes.
+const (
+	sparseMagic     = "YDUSPRS1"
+	sparseBlockSize = 64 << 10
+	// sparseMinSize keeps small files, whose blocks may be stored
+	// inline with the metadata, out of the detection.
+	sparseMinSize = 1 << 20
+
+	sparseSizeProperty     = "ydu_sparse_size"
+	sparseMD5Property      = "ydu_sparse_md5"
+	sparsePhysicalProperty = "ydu_physical_size"
+)
+
+// isSparse reports whether less than half of the file at localPath is
+// allocated on disk, and returns the allocated bytes.
+func isSparse(localPath string) (bool, int64, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return false, 0, err
+	}
+
+	physical, ok := fileAllocated(info)
+	if !ok || info.Size() < sparseMinSize {
+		return false, 0, nil
+	}
+	return physical < info.Size()/2, physical, nil
+}
+
+// scanSparse returns the md5 of the content of r and the size of its
+// sparse encoding.
+func scanSparse(r io.Reader) (string, int64, error) {
+	hash := md5.New()
+	encoded := int64(len(sparseMagic) + 8)
+	err := sparseBlocks(io.TeeReader(r, hash), func(offset int64, block []byte) error {
+		encoded += 12 + int64(len(block))
+		return nil
+	})
+	return hex.EncodeToString(hash.Sum(nil)), encoded, err
+}
+
+// sparseBlocks calls data for every block of r that is not all zeros.
+func sparseBlocks(r io.Reader, data func(offset int64, block []byte) error) error {
+	buf := make([]byte, sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zeros[:n]) {
+			dataErr := data(offset, buf[:n])
+			if dataErr != nil {
+				return dataErr
+			}
+		}
+		offset += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// encodeSparse writes the sparse encoding of the size bytes of r to w.
+func encodeSparse(w io.Writer, r io.Reader, size int64) error {
+	bw := bufio.NewWriterSize(w, sparseBlockSize)
+	header := binary.BigEndian.AppendUint64([]byte(sparseMagic), uint64(size))
+	_, err := bw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	err = sparseBlocks(r, func(offset int64, block []byte) error {
+		record := binary.BigEndian.AppendUint64(nil, uint64(offset))
+		record = binary.BigEndian.AppendUint32(record, uint32(len(block)))
+		_, err := bw.Write(record)
+		if err == nil {
+			_, err = bw.Write(block)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// decodeSparse expands the sparse encoding read from r into f, leaving
+// holes where blocks were left out, and returns the md5 of the content.
+func decodeSparse(f *os.File, r io.Reader) (string, error) {
+	br := bufio.NewReaderSize(r, sparseBlockSize)
+	header := make([]byte, len(sparseMagic)+8)
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header[:len(sparseMagic)]) != sparseMagic {
+		return "", errors.New("not a sparse encoded file")
+	}
+	size := int64(binary.BigEndian.Uint64(header[len(sparseMagic):]))
+
+	err = f.Truncate(size)
+	if err != nil {
+		return "", err
+	}
+
+	// holes are hashed as the zeros they read as
+	hash := md5.New()
+	var hashed int64
+	record := make([]byte, 12)
+	for {
+		_, err := io.ReadFull(br, record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("truncated sparse encoding: %w", err)
+		}
+
+		offset := int64(binary.BigEndian.Uint64(record))
+		length := int64(binary.BigEndian.Uint32(record[8:]))
+		if offset < hashed || offset+length > size {
+			return "", errors.New("invalid block in sparse encoding")
+		}
+
+		_, err = io.CopyN(hash, zeroReader{}, offset-hashed)
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.CopyN(io.MultiWriter(f, hash), br, length)
+		if err != nil {
+			return "", fmt.Errorf("truncated sparse encoding: %w", err)
+		}
+		hashed = offset + length
+	}
+
+	_, err = io.CopyN(hash, zeroReader{}, size-hashed)
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// transferSparseFile uploads localPath like transferFile, sparse files
+// in the sparse encoding.
+func transferSparseFile(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	localPath, remotePath, token string,
+	overwrite bool,
+) error {
+	sparse, physical, err := isSparse(localPath)
+	if err != nil {
+		return err
+	}
+	if !sparse {
+		return transferFile(logger, httpClient, localPath, remotePath, token, overwrite)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	sum, encodedSize, err := scanSparse(file)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	uploadURL, err := requestUploadURL(httpClient, remotePath, token, overwrite)
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"upload url received",
+		slog.String("sparse", fmt.Sprintf("%d of %d bytes allocated", physical, info.Size())),
+	)
+
+	encoded, pw := io.Pipe()
+	defer encoded.Close()
+	go func() {
+		pw.CloseWithError(encodeSparse(pw, file, info.Size()))
+	}()
+
+	started := time.Now()
+	err = uploadStream(httpClient, uploadURL, encoded, encodedSize)
+	memo.Invalidate(remotePath)
+	auditUpload(remotePath, token, encodedSize, err)
+	recordTransfer("upload", encodedSize, time.Since(started), err)
+	if err != nil {
+		return err
+	}
+
+	// without them the uploaded file cannot be expanded
+	_, err = setCustomProperties(
+		httpClient,
+		remotePath,
+		token,
+		map[string]any{
+			sparseSizeProperty:     strconv.FormatInt(info.Size(), 10),
+			sparseMD5Property:      sum,
+			sparsePhysicalProperty: strconv.FormatInt(physical, 10),
+		},
+	)
+	return err
+}
+
+// logicalResource returns res with the size and md5 of the expanded
+// file when it was uploaded sparse encoded, for comparing with local
+// files.
+func logicalResource(res resource) resource {
+	size, err := strconv.ParseInt(fmt.Sprint(res.CustomProperties[sparseSizeProperty]), 10, 64)
+	sum, ok := res.CustomProperties[sparseMD5Property].(string)
+	if err != nil || !ok {
+		return res
+	}
+
+	res.Size = size
+	res.MD5 = sum
+	return res
+}
+
+// expandSparseFile decodes the downloaded encodedPath of res into
+// localPath and removes it.
+func expandSparseFile(encodedPath, localPath string, res resource) error {
+	encoded, err := os.Open(encodedPath)
+	if err != nil {
+		return err
+	}
+	defer encoded.Close()
+
+	expandedPath := localPath + ".ydu-sparse"
+	f, err := os.Create(expandedPath)
+	if err != nil {
+		return err
+	}
+
+	sum, err := decodeSparse(f, encoded)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && sum != logicalResource(res).MD5 {
+		err = fmt.Errorf("expanded %s does not match its checksum", res.Path)
+	}
+	if err != nil {
+		os.Remove(expandedPath)
+		return err
+	}
+
+	err = os.Rename(expandedPath, localPath)
+	if err != nil {
+		return err
+	}
+	encoded.Close()
+	return os.Remove(encodedPath)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileAllocated reports no allocation, sparse files are only detected
+// on unix systems.
+func fileAllocated(info fs.FileInfo) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileAllocated returns the bytes of disk space allocated to a file.
+func fileAllocated(info fs.FileInfo) (int64, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512, true
+	}
+	return 0, false
+}
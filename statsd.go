@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdClient pushes metrics to a StatsD or DogStatsD server over UDP.
+// Sending is fire and forget, a missing server never fails a run.
+type statsdClient struct {
+	conn net.Conn
+	// tags are appended to every metric in the DogStatsD format
+	tags string
+}
+
+// statsd receives the metrics of the process, set by the global
+// --statsd-addr flag. A nil client drops them.
+var statsd *statsdClient
+
+// setStatsD configures statsd from the value of --statsd-addr, e.g.
+// "localhost:8125" or "localhost:8125,env:prod,team:infra" with tags
+// for DogStatsD.
+func setStatsD(value string) error {
+	addr, tags, _ := strings.Cut(value, ",")
+	if addr == "" {
+		return fmt.Errorf("invalid --statsd-addr %q", value)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("invalid --statsd-addr %q: %w", value, err)
+	}
+
+	statsd = &statsdClient{conn: conn}
+	if tags != "" {
+		statsd.tags = "|#" + tags
+	}
+	return nil
+}
+
+func (s *statsdClient) send(name, value, kind string) {
+	if s == nil {
+		return
+	}
+	fmt.Fprintf(s.conn, "ydu.%s:%s|%s%s", name, value, kind, s.tags)
+}
+
+// count adds value to the counter name.
+func (s *statsdClient) count(name string, value int64) {
+	s.send(name, strconv.FormatInt(value, 10), "c")
+}
+
+// timing records the duration d of name in milliseconds.
+func (s *statsdClient) timing(name string, d time.Duration) {
+	s.send(name, strconv.FormatInt(d.Milliseconds(), 10), "ms")
+}
+
+// metricsTransport counts requests by status class and records their
+// latency, e.g. ydu.http.2xx and ydu.http.latency.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	statsd.timing("http.latency", time.Since(started))
+
+	if err != nil {
+		statsd.count("http.error", 1)
+		return nil, err
+	}
+	statsd.count(fmt.Sprintf("http.%dxx", resp.StatusCode/100), 1)
+	return resp, nil
+}
+
+// recordTransfer records a file transfer in runTotals and in the
+// metrics, direction is "upload" or "download": ydu.<direction>.files,
+// .bytes and .duration on success and ydu.<direction>.failed otherwise.
+func recordTransfer(direction string, size int64, d time.Duration, err error) {
+	if err != nil {
+		runTotals.Failed.Add(1)
+		statsd.count(direction+".failed", 1)
+		return
+	}
+	runTotals.Files.Add(1)
+	runTotals.Bytes.Add(size)
+	statsd.count(direction+".files", 1)
+	statsd.count(direction+".bytes", size)
+	statsd.timing(direction+".duration", d)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/dustin/go-humanize"
+)
+
+// exitInsufficientStorage is the exit code of an upload run stopped
+// because the disk is full.
+const exitInsufficientStorage = 3
+
+// insufficientStorage reports whether err is a 507 response of the API
+// or the upload server.
+func insufficientStorage(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) &&
+		apiErr.StatusCode == http.StatusInsufficientStorage
+}
+
+// reportInsufficientStorage logs the free space of the disk compared to
+// the bytes still required to complete the run and how to make room.
+func reportInsufficientStorage(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	token string,
+	required int64,
+) {
+	attrs := []any{
+		slog.String("required", humanize.Bytes(uint64(required))),
+	}
+
+	info, err := getDiskInfo(httpClient, token)
+	if err == nil {
+		attrs = append(
+			attrs,
+			slog.String("free", humanize.Bytes(uint64(max(info.TotalSpace-info.UsedSpace, 0)))),
+			slog.String("used", humanize.Bytes(uint64(info.UsedSpace))),
+			slog.String("total", humanize.Bytes(uint64(info.TotalSpace))),
+			slog.String("trash", humanize.Bytes(uint64(info.TrashSize))),
+		)
+	}
+
+	attrs = append(
+		attrs,
+		slog.String("hint", "free space with `ydu trash empty`, find large folders with `ydu du`"),
+	)
+
+	logger.Error("not enough space on yandex disk", attrs...)
+}
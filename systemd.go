@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends state to the service manager when ydu runs as a
+// systemd Type=notify unit. It is a no-op outside of systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// abstract namespace sockets are passed with a leading "@"
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix(
+		"unixgram",
+		nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"},
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to connect to notify socket: %v",
+			err,
+		)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval the systemd watchdog expects
+// keep-alive pings at, or zero when the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings the systemd watchdog at half of the configured
+// interval until the returned stop function is called.
+func startWatchdog(logger *slog.Logger) func() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := sdNotify("WATCHDOG=1")
+				if err != nil {
+					logger.Warn(
+						"Error during systemd watchdog ping",
+						slog.String("message", err.Error()),
+					)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// quoteSystemdArg quotes an ExecStart argument so systemd passes it to
+// ydu verbatim.
+func quoteSystemdArg(arg string) string {
+	escaped := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"%", "%%",
+		"$", "$$",
+	).Replace(arg)
+
+	if escaped == "" || strings.ContainsAny(escaped, " \t\n\"'\\;") {
+		return `"` + escaped + `"`
+	}
+	return escaped
+}
+
+func systemdServiceUnit(
+	name, executable, environmentFile string,
+	watchdog time.Duration,
+	args []string,
+) string {
+	execStart := []string{quoteSystemdArg(executable)}
+	for _, arg := range args {
+		execStart = append(execStart, quoteSystemdArg(arg))
+	}
+
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "[Unit]\n")
+	fmt.Fprintf(&unit, "Description=ydu upload job %s\n", name)
+	fmt.Fprintf(&unit, "Wants=network-online.target\n")
+	fmt.Fprintf(&unit, "After=network-online.target\n")
+	fmt.Fprintf(&unit, "\n[Service]\n")
+	fmt.Fprintf(&unit, "Type=notify\n")
+	fmt.Fprintf(&unit, "NotifyAccess=main\n")
+	fmt.Fprintf(&unit, "EnvironmentFile=-%s\n", environmentFile)
+	fmt.Fprintf(&unit, "ExecStart=%s\n", strings.Join(execStart, " "))
+	if watchdog > 0 {
+		fmt.Fprintf(&unit, "WatchdogSec=%d\n", int(watchdog.Seconds()))
+	}
+	return unit.String()
+}
+
+func systemdTimerUnit(name, onCalendar string) string {
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "[Unit]\n")
+	fmt.Fprintf(&unit, "Description=Run ydu upload job %s\n", name)
+	fmt.Fprintf(&unit, "\n[Timer]\n")
+	fmt.Fprintf(&unit, "OnCalendar=%s\n", onCalendar)
+	fmt.Fprintf(&unit, "Persistent=true\n")
+	fmt.Fprintf(&unit, "\n[Install]\n")
+	fmt.Fprintf(&unit, "WantedBy=timers.target\n")
+	return unit.String()
+}
+
+// runSystemd implements `ydu systemd install [flags] -- <upload flags>`
+// which generates a service and timer unit running the given upload, or
+// with --job a job of the config file.
+func runSystemd(logger *slog.Logger, args []string) error {
+	if len(args) == 0 || args[0] != "install" {
+		return errors.New("usage: ydu systemd install [flags] -- <upload flags>")
+	}
+
+	flags := flag.NewFlagSet("systemd install", flag.ExitOnError)
+	name := flags.String(
+		"name",
+		"ydu",
+		"unit name",
+	)
+	onCalendar := flags.String(
+		"on-calendar",
+		"daily",
+		"timer schedule in systemd OnCalendar format",
+	)
+	unitDir := flags.String(
+		"dir",
+		"/etc/systemd/system",
+		"directory to write units to",
+	)
+	environmentFile := flags.String(
+		"env-file",
+		"",
+		"environment file with YANDEX_DISK_TOKEN (default /etc/ydu/<name>.env)",
+	)
+	watchdog := flags.Duration(
+		"watchdog",
+		time.Minute,
+		"systemd watchdog interval, 0 disables it",
+	)
+	dryRun := flags.Bool(
+		"dry-run",
+		false,
+		"print units instead of writing them",
+	)
+	job := flags.String(
+		"job",
+		"",
+		"run this job of the config file, on its schedule (name defaults to ydu-<job>)",
+	)
+	parseFlags(flags, args[1:])
+
+	uploadArgs := flags.Args()
+	if *job != "" {
+		if len(uploadArgs) != 0 {
+			return errors.New("pass either --job or upload flags after --")
+		}
+
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		jobConfig, ok := cfg.Jobs[*job]
+		if !ok {
+			return fmt.Errorf("unknown job %s, see ydu run --list", *job)
+		}
+
+		given := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		if !given["name"] {
+			*name = "ydu-" + *job
+		}
+		if !given["on-calendar"] && jobConfig.Schedule != "" {
+			*onCalendar = jobConfig.Schedule
+		}
+		uploadArgs = []string{"run", *job}
+	}
+	if len(uploadArgs) == 0 {
+		return errors.New("pass upload flags after -- or --job")
+	}
+
+	if *environmentFile == "" {
+		*environmentFile = filepath.Join("/etc/ydu", *name+".env")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to resolve ydu executable path: %v",
+			err,
+		)
+	}
+
+	units := []struct {
+		file    string
+		content string
+	}{
+		{
+			file: *name + ".service",
+			content: systemdServiceUnit(
+				*name,
+				executable,
+				*environmentFile,
+				*watchdog,
+				uploadArgs,
+			),
+		},
+		{
+			file:    *name + ".timer",
+			content: systemdTimerUnit(*name, *onCalendar),
+		},
+	}
+
+	for _, unit := range units {
+		if *dryRun {
+			fmt.Printf("# %s\n%s\n", unit.file, unit.content)
+			continue
+		}
+
+		path := filepath.Join(*unitDir, unit.file)
+		err := os.WriteFile(path, []byte(unit.content), 0o644)
+		if err != nil {
+			return fmt.Errorf(
+				"failed to write unit %s: %v",
+				path,
+				err,
+			)
+		}
+
+		logger.Info(
+			"systemd unit written",
+			slog.String("path", path),
+		)
+	}
+
+	if !*dryRun {
+		logger.Info(
+			"enable the job with systemctl",
+			slog.String("command", "systemctl daemon-reload && systemctl enable --now "+*name+".timer"),
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+)
+
+// Small files are dominated by the round trips around them and large
+// ones by bandwidth, so uploads route them to separate pools: many small
+// files in parallel and few large ones that get the bandwidth.
+const (
+	defaultSmallFileSize        = "8MB"
+	defaultSmallFileConcurrency = 8
+	defaultLargeFileConcurrency = 1
+)
+
+// transferTier is the part of the upload queue uploaded with its own
+// concurrency.
+type transferTier struct {
+	// Items are indexes into the queue, in queue order.
+	Items   []int
+	Limiter *concurrencyLimiter
+}
+
+// splitTiers splits queue into the files smaller than smallSize and the
+// rest. A smallSize of 0 puts every file into the large tier. With
+// adaptive the concurrencies are the upper bounds of adaptive limiters.
+func splitTiers(
+	queue []uploadItem,
+	smallSize uint64,
+	smallConcurrency, largeConcurrency int,
+	adaptive bool,
+) []transferTier {
+	small := transferTier{Limiter: newConcurrencyLimiter(max(1, smallConcurrency), adaptive)}
+	large := transferTier{Limiter: newConcurrencyLimiter(max(1, largeConcurrency), adaptive)}
+	for i, item := range queue {
+		if uint64(item.Size) < smallSize {
+			small.Items = append(small.Items, i)
+		} else {
+			large.Items = append(large.Items, i)
+		}
+	}
+	return []transferTier{small, large}
+}
+
+// runTiers uploads the queue items of all tiers at the same time, each
+// tier with the concurrency its limiter allows. A free worker asks start
+// before taking the next item of its tier, in queue order, and the tier
+// stops once start refuses. It returns the items that were never
+// started, in queue order, after the started ones completed.
+func runTiers(
+	queue []uploadItem,
+	tiers []transferTier,
+	start func(item uploadItem) bool,
+	upload func(item uploadItem) error,
+) []uploadItem {
+	started := make([]bool, len(queue))
+
+	var wg sync.WaitGroup
+	for _, tier := range tiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runLimited(
+				tier.Limiter,
+				len(tier.Items),
+				func(k int) bool {
+					i := tier.Items[k]
+					started[i] = start(queue[i])
+					return started[i]
+				},
+				func(k int) (int64, error) {
+					item := queue[tier.Items[k]]
+					err := upload(item)
+					if err != nil {
+						return 0, err
+					}
+					return item.Size, nil
+				},
+			)
+		}()
+	}
+	wg.Wait()
+
+	var remaining []uploadItem
+	for i, item := range queue {
+		if !started[i] {
+			remaining = append(remaining, item)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+)
+
+// runTrash implements `ydu trash empty` which permanently deletes
+// everything in the trash.
+func runTrash(logger *slog.Logger, args []string) error {
+	if len(args) == 0 || args[0] != "empty" {
+		return errors.New("usage: ydu trash empty")
+	}
+
+	flags := flag.NewFlagSet("trash empty", flag.ExitOnError)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args[1:])
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: ydu trash empty")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	var link apiLink
+	err = apiRequest(
+		httpClient,
+		http.MethodDelete,
+		"/trash/resources",
+		nil,
+		token,
+		&link,
+	)
+	if err != nil {
+		return err
+	}
+
+	if id := trackOperation(link, "trash empty"); id != "" {
+		logger.Info(
+			"waiting for the trash to be emptied",
+			slog.String("operation id", id),
+		)
+
+		err = waitOperation(httpClient, id, token, operationPollInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info("trash emptied")
+	return nil
+}
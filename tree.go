@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// treeNode is a resource of a remote hierarchy.
+type treeNode struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"`
+	Type     string      `json:"type"`
+	Size     int64       `json:"size,omitempty"`
+	Children []*treeNode `json:"children,omitempty"`
+}
+
+// treeBuilder lists folders concurrently with the requests in flight
+// bounded by limiter and remembers the first error.
+type treeBuilder struct {
+	httpClient *http.Client
+	token      string
+	maxDepth   int
+	limiter    *concurrencyLimiter
+
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+func (b *treeBuilder) fail(err error) {
+	b.errOnce.Do(func() {
+		b.err = err
+	})
+}
+
+// fill lists node and schedules listings of its subfolders.
+func (b *treeBuilder) fill(node *treeNode, depth int) {
+	defer b.wg.Done()
+
+	var res *resource
+	err := b.limiter.Do(func() error {
+		var err error
+		res, err = getDiskResource(b.httpClient, node.Path, b.token)
+		return err
+	})
+	if err != nil {
+		b.fail(err)
+		return
+	}
+
+	node.Type = res.Type
+	node.Size = res.Size
+	if res.Type != "dir" || res.Embedded == nil {
+		return
+	}
+
+	for _, item := range res.Embedded.Items {
+		child := &treeNode{
+			Name: item.Name,
+			Path: path.Join(node.Path, item.Name),
+			Type: item.Type,
+			Size: item.Size,
+		}
+		node.Children = append(node.Children, child)
+
+		if item.Type == "dir" && (b.maxDepth < 0 || depth+1 < b.maxDepth) {
+			b.wg.Add(1)
+			go b.fill(child, depth+1)
+		}
+	}
+}
+
+// buildRemoteTree lists remotePath up to maxDepth levels deep, a
+// negative maxDepth lists the whole hierarchy.
+func buildRemoteTree(
+	httpClient *http.Client,
+	remotePath, token string,
+	maxDepth int,
+	limiter *concurrencyLimiter,
+) (*treeNode, error) {
+	b := &treeBuilder{
+		httpClient: httpClient,
+		token:      token,
+		maxDepth:   maxDepth,
+		limiter:    limiter,
+	}
+
+	root := &treeNode{
+		Name: path.Base(remotePath),
+		Path: remotePath,
+	}
+
+	b.wg.Add(1)
+	go b.fill(root, 0)
+	b.wg.Wait()
+
+	return root, b.err
+}
+
+func printTree(w io.Writer, node *treeNode, prefix string) {
+	for i, child := range node.Children {
+		branch, indent := "├── ", "│   "
+		if i == len(node.Children)-1 {
+			branch, indent = "└── ", "    "
+		}
+
+		if child.Type == "dir" {
+			fmt.Fprintf(w, "%s%s%s/\n", prefix, branch, child.Name)
+		} else {
+			fmt.Fprintf(
+				w,
+				"%s%s%s (%s)\n",
+				prefix,
+				branch,
+				child.Name,
+				humanize.Bytes(uint64(child.Size)),
+			)
+		}
+
+		printTree(w, child, prefix+indent)
+	}
+}
+
+// runTree implements `ydu tree [--depth n] [--json] <remote-path>`.
+func runTree(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("tree", flag.ExitOnError)
+	maxDepth := flags.Int(
+		"depth",
+		3,
+		"list at most this many levels, -1 for all",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print the tree as JSON",
+	)
+	concurrency := flags.Int(
+		"concurrency",
+		8,
+		"number of concurrent listing requests, the upper bound with --adaptive",
+	)
+	adaptive := flags.Bool(
+		"adaptive",
+		false,
+		"ramp concurrency up while it raises the listing rate and back off on rate limiting",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 || *concurrency < 1 {
+		return errors.New("usage: ydu tree [--depth n] [--json] <remote-path>")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+
+	httpClient := newHTTPClient(*httpClientTimeout)
+
+	remotePath, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	root, err := buildRemoteTree(
+		httpClient,
+		remotePath,
+		token,
+		*maxDepth,
+		newConcurrencyLimiter(*concurrency, *adaptive),
+	)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(root)
+	}
+
+	fmt.Println(root.Path)
+	printTree(os.Stdout, root, "")
+	return nil
+}
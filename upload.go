@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+)
+
+// partialSuffix marks temporary remote objects of uploads in progress.
+const partialSuffix = ".ydu-partial"
+
+// uploadOptions controls how queue items are written to yandex disk.
+type uploadOptions struct {
+	Overwrite  bool
+	OnConflict string
+	// Atomic uploads to a temporary name first and moves the file into
+	// place once it is complete.
+	Atomic bool
+	// CleanupFailed deletes what a failed upload left on the disk.
+	CleanupFailed bool
+	// ForceOverwrite overwrites files even when they were changed on the
+	// disk since ydu last uploaded or downloaded them.
+	ForceOverwrite bool
+	// Versions receives the previous version of overwritten files.
+	Versions *versionsDir
+	// Sparse uploads sparse files in the sparse encoding.
+	Sparse bool
+}
+
+// cleanupFailedUpload permanently deletes the remote object a failed
+// upload wrote to. A missing object is not an error.
+func cleanupFailedUpload(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	remotePath, token string,
+) {
+	err := deleteResource(httpClient, remotePath, token, true)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return
+	}
+	if err != nil {
+		logger.Warn(
+			"Error during cleanup of failed upload",
+			slog.String("path", remotePath),
+			slog.String("message", err.Error()),
+		)
+		return
+	}
+
+	logger.Info(
+		"removed failed upload",
+		slog.String("path", remotePath),
+	)
+}
+
+// uploadQueueItem uploads a single queue item. item.RemotePath is
+// updated when the conflict strategy picks another name.
+func uploadQueueItem(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	dirs *remoteDirs,
+	item *uploadItem,
+	token string,
+	options uploadOptions,
+) error {
+	if options.Overwrite && !options.ForceOverwrite {
+		err := checkUnchangedRemotely(httpClient, item.RemotePath, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.Overwrite && options.Versions != nil {
+		err := options.Versions.keep(logger, httpClient, item.RemotePath, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writeQueueItem(logger, httpClient, dirs, item, token, options)
+	if err != nil {
+		return err
+	}
+
+	err = recordUploadedRevision(httpClient, item.RemotePath, token)
+	if err != nil {
+		logger.Warn(
+			"Error during recording remote revision",
+			slog.String("path", item.RemotePath),
+			slog.String("message", err.Error()),
+		)
+	}
+	return nil
+}
+
+func writeQueueItem(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	dirs *remoteDirs,
+	item *uploadItem,
+	token string,
+	options uploadOptions,
+) error {
+	err := dirs.ensure(path.Dir(item.RemotePath))
+	if err != nil {
+		return err
+	}
+
+	transfer := transferFile
+	if options.Sparse {
+		transfer = transferSparseFile
+	}
+
+	if !options.Overwrite {
+		target, err := resolveConflict(
+			httpClient,
+			item.RemotePath,
+			token,
+			options.OnConflict,
+		)
+		if err != nil {
+			return err
+		}
+
+		if target != item.RemotePath {
+			logger.Info(
+				"target exists, uploading under a new name",
+				slog.String("target yandex disk path", target),
+			)
+			item.RemotePath = target
+		}
+	}
+
+	if !options.Atomic {
+		// only an object the failed upload created itself is removed,
+		// never a file that existed before
+		cleanup := false
+		if options.CleanupFailed && !options.Overwrite {
+			exists, err := remoteExists(httpClient, item.RemotePath, token)
+			if err != nil {
+				return err
+			}
+			cleanup = !exists
+		}
+
+		err := transfer(
+			logger,
+			httpClient,
+			item.LocalPath,
+			item.RemotePath,
+			token,
+			options.Overwrite,
+		)
+		if err != nil && cleanup {
+			cleanupFailedUpload(logger, httpClient, item.RemotePath, token)
+		}
+		return err
+	}
+
+	// fail before uploading instead of when moving into place
+	if !options.Overwrite && options.OnConflict == "fail" {
+		exists, err := remoteExists(httpClient, item.RemotePath, token)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errors.New("target already exists, use --overwrite or --on-conflict")
+		}
+	}
+
+	partialPath := item.RemotePath + partialSuffix
+
+	// a leftover from an interrupted run is replaced
+	err = transfer(
+		logger,
+		httpClient,
+		item.LocalPath,
+		partialPath,
+		token,
+		true,
+	)
+	if err != nil {
+		if options.CleanupFailed {
+			cleanupFailedUpload(logger, httpClient, partialPath, token)
+		}
+		return err
+	}
+
+	return moveResource(
+		httpClient,
+		partialPath,
+		item.RemotePath,
+		token,
+		options.Overwrite,
+	)
+}
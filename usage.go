@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// transferUsage counts the bytes the process sent and received in file
+// transfers, see recordUsage.
+var transferUsage struct {
+	Uploaded   atomic.Int64
+	Downloaded atomic.Int64
+}
+
+// countingReader adds the bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// usageEntry is an entry of the usage file, the bytes transferred by a
+// run of a profile in a month.
+type usageEntry struct {
+	Month      string `json:"month"`
+	Profile    string `json:"profile"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloaded int64  `json:"downloaded"`
+}
+
+// usageFile returns the path of the usage file, YDU_USAGE or
+// usage.jsonl in the ydu config directory.
+func usageFile() (string, error) {
+	if p := os.Getenv("YDU_USAGE"); p != "" {
+		return p, nil
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "ydu", "usage.jsonl"), nil
+}
+
+// usageProfile returns the profile the transfers of the process are
+// accounted to: YDU_PROFILE, which `ydu run` sets to the name of the
+// job, or default.
+func usageProfile() string {
+	return cmp.Or(os.Getenv("YDU_PROFILE"), "default")
+}
+
+// usageRecorded is set once the usage of the process was recorded.
+// ydu resume runs an upload, which records its own.
+var usageRecorded bool
+
+// recordUsage appends the bytes transferred by the process to the usage
+// file, only the first time it is called. Every process appends its own
+// entry, so parallel jobs do not overwrite each other's. Failing to
+// write it is reported on stderr but does not fail the run.
+func recordUsage() {
+	if usageRecorded {
+		return
+	}
+	usageRecorded = true
+
+	entry := usageEntry{
+		Month:      time.Now().Format("2006-01"),
+		Profile:    usageProfile(),
+		Uploaded:   transferUsage.Uploaded.Load(),
+		Downloaded: transferUsage.Downloaded.Load(),
+	}
+	if entry.Uploaded == 0 && entry.Downloaded == 0 {
+		return
+	}
+
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+
+	usagePath, err := usageFile()
+	if err == nil {
+		err = appendLine(usagePath, line)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ydu: error during writing usage: %v\n", err)
+	}
+}
+
+// readUsage returns the usage file summed up per month and profile,
+// ordered by month and profile.
+func readUsage() ([]usageEntry, error) {
+	usagePath, err := usageFile()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(usagePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	totals := map[[2]string]*usageEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry usageEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+
+		key := [2]string{entry.Month, entry.Profile}
+		total, ok := totals[key]
+		if !ok {
+			total = &usageEntry{Month: entry.Month, Profile: entry.Profile}
+			totals[key] = total
+		}
+		total.Uploaded += entry.Uploaded
+		total.Downloaded += entry.Downloaded
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]usageEntry, 0, len(totals))
+	for _, total := range totals {
+		entries = append(entries, *total)
+	}
+	slices.SortFunc(entries, func(a, b usageEntry) int {
+		return cmp.Or(cmp.Compare(a.Month, b.Month), cmp.Compare(a.Profile, b.Profile))
+	})
+	return entries, nil
+}
+
+// runUsage implements `ydu usage` which prints the bytes uploaded and
+// downloaded per month and profile.
+func runUsage(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	month := flags.String(
+		"month",
+		"",
+		"only show this month, e.g. 2024-05, or current",
+	)
+	profile := flags.String(
+		"profile",
+		"",
+		"only show this profile",
+	)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print the usage as JSON lines",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: ydu usage [--month 2024-05|current] [--profile name] [--json]")
+	}
+	if *month == "current" {
+		*month = time.Now().Format("2006-01")
+	}
+	if *month != "" {
+		_, err := time.Parse("2006-01", *month)
+		if err != nil {
+			return fmt.Errorf("invalid month %q, expected e.g. 2024-05", *month)
+		}
+	}
+
+	entries, err := readUsage()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !*jsonOutput {
+		fmt.Fprintln(w, "MONTH\tPROFILE\tUPLOADED\tDOWNLOADED\tTOTAL")
+	}
+	for _, entry := range entries {
+		if (*month != "" && entry.Month != *month) ||
+			(*profile != "" && entry.Profile != *profile) {
+			continue
+		}
+
+		if *jsonOutput {
+			err := encoder.Encode(entry)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\n",
+			entry.Month,
+			entry.Profile,
+			humanize.Bytes(uint64(entry.Uploaded)),
+			humanize.Bytes(uint64(entry.Downloaded)),
+			humanize.Bytes(uint64(entry.Uploaded+entry.Downloaded)),
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// verifyWorkers is how many uploaded files are verified at once.
+const verifyWorkers = 8
+
+// verifyMode is the value of --verify: off, all or sample:<percent>%,
+// the share of the uploaded files checked after the upload.
+type verifyMode struct {
+	Percent float64
+}
+
+func (m *verifyMode) String() string {
+	switch m.Percent {
+	case 0:
+		return "off"
+	case 100:
+		return "all"
+	}
+	return "sample:" + strconv.FormatFloat(m.Percent, 'f', -1, 64) + "%"
+}
+
+func (m *verifyMode) Set(value string) error {
+	switch value {
+	case "off":
+		m.Percent = 0
+		return nil
+	case "all":
+		m.Percent = 100
+		return nil
+	}
+
+	share, found := strings.CutPrefix(value, "sample:")
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(share, "%"), 64)
+	if !found || !strings.HasSuffix(share, "%") || err != nil || percent <= 0 || percent > 100 {
+		return fmt.Errorf("expected off, all or sample:<percent>%%, e.g. sample:5%%, got %q", value)
+	}
+	m.Percent = percent
+	return nil
+}
+
+// sample returns the indexes of a random m.Percent of n files, at least
+// one when any is to be verified.
+func (m verifyMode) sample(n int) []int {
+	if m.Percent == 0 || n == 0 {
+		return nil
+	}
+
+	count := int(math.Ceil(float64(n) * m.Percent / 100))
+	return rand.Perm(n)[:min(count, n)]
+}
+
+// verifyUpload checks that the file uploaded from localPath to
+// remotePath has the size and md5 of the local file. With download the
+// file is downloaded again and hashed instead of trusting the md5 the
+// API reports.
+func verifyUpload(
+	httpClient *http.Client,
+	localPath, remotePath, token string,
+	size int64,
+	download bool,
+) error {
+	localMD5, err := localHashes.MD5(localPath)
+	if err != nil {
+		return err
+	}
+
+	stored, err := getDiskResource(httpClient, remotePath, token)
+	if err != nil {
+		return err
+	}
+	res := logicalResource(*stored)
+	if res.Size != size {
+		return fmt.Errorf("size %d on yandex disk differs from the local %d", res.Size, size)
+	}
+	if res.MD5 != localMD5 {
+		return fmt.Errorf("md5 %s on yandex disk differs from the local %s", res.MD5, localMD5)
+	}
+
+	if !download {
+		return nil
+	}
+
+	href, err := downloadURL(httpClient, remotePath, token)
+	if err != nil {
+		return err
+	}
+	body, err := openDownload(httpClient, href)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// a sparse upload is stored encoded, its stored md5 covers that
+	hash := md5.New()
+	_, err = io.Copy(hash, body)
+	if err != nil {
+		return err
+	}
+	if downloaded := hex.EncodeToString(hash.Sum(nil)); downloaded != stored.MD5 {
+		return fmt.Errorf("downloaded md5 %s differs from the stored %s", downloaded, stored.MD5)
+	}
+	return nil
+}
+
+// verifyUploads checks a sample of the uploaded files of records after
+// the run, the records of files that fail the check get its error. It
+// returns the number of checked and failed files.
+func verifyUploads(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	records []transferRecord,
+	token string,
+	mode verifyMode,
+	download bool,
+) (int, int) {
+	var uploaded []int
+	for i, record := range records {
+		if record.Err == nil && record.SkipReason == "" {
+			uploaded = append(uploaded, i)
+		}
+	}
+
+	sample := mode.sample(len(uploaded))
+	if len(sample) == 0 {
+		return 0, 0
+	}
+	logger.Info(
+		"verifying uploads",
+		slog.Int("files", len(sample)),
+		slog.Int("uploaded", len(uploaded)),
+		slog.Bool("download", download),
+	)
+
+	var mu sync.Mutex
+	failed := 0
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(verifyWorkers, len(sample)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				record := &records[i]
+				err := verifyUpload(httpClient, record.LocalPath, record.RemotePath, token, record.Size, download)
+				if err == nil {
+					continue
+				}
+
+				logger.Error(
+					"Error during verifying upload",
+					slog.String("file", record.LocalPath),
+					slog.String("path", record.RemotePath),
+					slog.String("message", err.Error()),
+				)
+				mu.Lock()
+				record.Err = fmt.Errorf("verification failed: %w", err)
+				failed++
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, j := range sample {
+		next <- uploaded[j]
+	}
+	close(next)
+	wg.Wait()
+
+	return len(sample), failed
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionsDir is the --backup-dir folder that overwritten files are
+// moved into, keeping their full path below it. "{date}" in the folder
+// is replaced by the date of the run, so every day gets its own point
+// in time to recover from.
+type versionsDir struct {
+	root string
+
+	mu   sync.Mutex
+	dirs map[string]*remoteDirs
+}
+
+func newVersionsDir(root string, now time.Time) *versionsDir {
+	return &versionsDir{
+		root: strings.ReplaceAll(root, "{date}", now.Format(snapshotLayout)),
+		dirs: map[string]*remoteDirs{},
+	}
+}
+
+// keep moves the file at remotePath into the versions folder of the
+// account of token. A missing file has nothing to keep.
+func (v *versionsDir) keep(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	remotePath, token string,
+) error {
+	root, err := resolveRemotePath(httpClient, v.root, token)
+	if err != nil {
+		return err
+	}
+
+	exists, err := remoteExists(httpClient, remotePath, token)
+	if err != nil || !exists {
+		return err
+	}
+
+	_, rel, _ := strings.Cut(diskPath(remotePath), ":")
+	target := path.Join(root, rel)
+
+	err = v.remoteDirs(httpClient, root, token).ensure(path.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	err = moveResource(httpClient, remotePath, target, token, true)
+	if err != nil {
+		return fmt.Errorf("failed to keep previous version: %w", err)
+	}
+
+	logger.Info(
+		"previous version kept",
+		slog.String("path", remotePath),
+		slog.String("version path", target),
+	)
+	return nil
+}
+
+// remoteDirs returns the folder cache of the account of token.
+func (v *versionsDir) remoteDirs(
+	httpClient *http.Client,
+	root, token string,
+) *remoteDirs {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	dirs, found := v.dirs[token]
+	if !found {
+		// the versions root and its parents are created on demand
+		accountRoot, _, _ := strings.Cut(root, ":")
+		dirs = &remoteDirs{
+			httpClient: httpClient,
+			token:      token,
+			known:      map[string]bool{accountRoot + ":": true},
+		}
+		v.dirs[token] = dirs
+	}
+	return dirs
+}
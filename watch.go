@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// remoteVersion identifies the content of a remote file between polls.
+func remoteVersion(res resource) string {
+	return fmt.Sprintf("%d:%s:%d", res.Revision, res.MD5, res.Size)
+}
+
+// pollRemoteFolder returns the files below remoteDir by relative path.
+func pollRemoteFolder(
+	httpClient *http.Client,
+	remoteDir, token string,
+) (map[string]resource, error) {
+	files := map[string]resource{}
+	err := walkRemote(
+		httpClient,
+		remoteDir,
+		token,
+		func(rel string, res resource) error {
+			if res.Type != "dir" && !strings.HasSuffix(res.Name, partialSuffix) {
+				files[rel] = res
+			}
+			return nil
+		},
+	)
+	return files, err
+}
+
+// hookCommand returns the shell command running hook for a file. {} in
+// hook stands for the file, which is passed in the environment so it
+// never needs quoting.
+func hookCommand(hook, file, remotePath string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", strings.ReplaceAll(hook, "{}", `"%YDU_FILE%"`))
+	} else {
+		cmd = exec.Command("sh", "-c", strings.ReplaceAll(hook, "{}", `"$YDU_FILE"`))
+	}
+	cmd.Env = append(
+		os.Environ(),
+		"YDU_FILE="+file,
+		"YDU_REMOTE_PATH="+remotePath,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// runWatchRemote implements `ydu watch-remote` which polls a remote
+// folder and downloads new and changed files or runs a hook for them.
+func runWatchRemote(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("watch-remote", flag.ExitOnError)
+	interval := flags.Duration(
+		"interval",
+		time.Minute,
+		"time between polls of the folder",
+	)
+	download := flags.String(
+		"download",
+		"",
+		"download new and changed files into this directory, keeping their paths below the folder",
+	)
+	hook := flags.String(
+		"exec",
+		"",
+		"run this shell command for every new and changed file, {} is the downloaded file or else the remote path",
+	)
+	initial := flags.Bool(
+		"initial",
+		false,
+		"also handle the files present at the first poll",
+	)
+	streams := flags.Int(
+		"streams",
+		defaultDownloadStreams,
+		"download files of 64 MiB and more in this many ranges at once",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 1 || (*download == "" && *hook == "") || *interval <= 0 {
+		return errors.New("usage: ydu watch-remote [--interval 1m] [--download <dir>] [--exec 'cmd {}'] <remote-dir>")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+
+	remoteDir, err := resolveRemotePath(httpClient, flags.Arg(0), token)
+	if err != nil {
+		return err
+	}
+
+	// a listing cache would hide new files until it expires
+	listings.TTL = 0
+	memo.disabled = true
+
+	logger.Info(
+		"watching",
+		slog.String("path", remoteDir),
+		slog.String("interval", interval.String()),
+	)
+
+	// known is nil until the first poll succeeded
+	var known map[string]string
+	for {
+		files, err := pollRemoteFolder(httpClient, remoteDir, token)
+		if err != nil {
+			// the next poll may succeed, a watcher should keep running
+			logger.Warn(
+				"Error during polling remote folder",
+				slog.String("path", remoteDir),
+				slog.String("message", err.Error()),
+			)
+			time.Sleep(*interval)
+			continue
+		}
+
+		current := map[string]string{}
+		for rel, res := range files {
+			current[rel] = remoteVersion(res)
+			if known[rel] == current[rel] || (known == nil && !*initial) {
+				continue
+			}
+
+			// a failed file is handled again by the next poll
+			if !handleRemoteFile(logger, httpClient, res, rel, token, *download, *hook, *streams) {
+				delete(current, rel)
+			}
+		}
+		known = current
+
+		time.Sleep(*interval)
+	}
+}
+
+// handleRemoteFile downloads the new or changed file res and runs the
+// hook for it. It reports whether that succeeded.
+func handleRemoteFile(
+	logger *slog.Logger,
+	httpClient *http.Client,
+	res resource,
+	rel, token, download, hook string,
+	streams int,
+) bool {
+	file := res.Path
+	if download != "" {
+		for _, name := range strings.Split(rel, "/") {
+			if err := safeLocalName(name); err != nil {
+				logger.Error(
+					"Error during downloading file",
+					slog.String("path", res.Path),
+					slog.String("message", err.Error()),
+				)
+				return false
+			}
+		}
+
+		file = filepath.Join(download, filepath.FromSlash(rel))
+		logger.Info(
+			"downloading",
+			slog.String("path", res.Path),
+			slog.String("local path", file),
+		)
+		err := downloadRemoteFile(httpClient, res, file, token, streams)
+		if err != nil {
+			logger.Error(
+				"Error during downloading file",
+				slog.String("path", res.Path),
+				slog.String("message", err.Error()),
+			)
+			return false
+		}
+	}
+
+	if hook == "" {
+		return true
+	}
+
+	logger.Info(
+		"running hook",
+		slog.String("path", res.Path),
+		slog.String("file", file),
+	)
+	err := hookCommand(hook, file, res.Path).Run()
+	if err != nil {
+		logger.Error(
+			"Error during running hook",
+			slog.String("path", res.Path),
+			slog.String("message", err.Error()),
+		)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+)
+
+// diskInfo is the account and quota information of /v1/disk.
+type diskInfo struct {
+	User struct {
+		Login       string `json:"login"`
+		DisplayName string `json:"display_name"`
+		UID         string `json:"uid"`
+	} `json:"user"`
+	TotalSpace      int64 `json:"total_space"`
+	UsedSpace       int64 `json:"used_space"`
+	TrashSize       int64 `json:"trash_size"`
+	MaxFileSize     int64 `json:"max_file_size"`
+	PaidMaxFileSize int64 `json:"paid_max_file_size"`
+	IsPaid          bool  `json:"is_paid"`
+
+	// Access is "full" when the token may use the whole disk and
+	// "app" when it is restricted to the application folder.
+	Access string `json:"access"`
+}
+
+func getDiskInfo(httpClient *http.Client, token string) (*diskInfo, error) {
+	var info diskInfo
+	err := apiRequest(
+		httpClient,
+		http.MethodGet,
+		"",
+		nil,
+		token,
+		&info,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := tokenAccess(httpClient, token)
+	if err != nil {
+		return nil, err
+	}
+	info.Access = "full"
+	if access == "app" {
+		info.Access = "app"
+	}
+
+	return &info, nil
+}
+
+// tokenAccesses caches the result of tokenAccess per token.
+var tokenAccesses sync.Map
+
+// tokenAccess probes whether token may read the disk root and returns
+// "disk" or "app" for tokens of apps restricted to the application
+// folder, which are refused with 403.
+func tokenAccess(httpClient *http.Client, token string) (string, error) {
+	if access, ok := tokenAccesses.Load(token); ok {
+		return access.(string), nil
+	}
+
+	params := url.Values{}
+	params.Add("path", "disk:/")
+	params.Add("fields", "path")
+	params.Add("limit", "0")
+
+	err := apiRequest(
+		httpClient,
+		http.MethodGet,
+		"/resources",
+		params,
+		token,
+		nil,
+	)
+
+	access := "disk"
+	if apiErr, ok := err.(*apiError); ok &&
+		apiErr.StatusCode == http.StatusForbidden {
+		access = "app"
+	} else if err != nil {
+		return "", err
+	}
+
+	tokenAccesses.Store(token, access)
+	return access, nil
+}
+
+// runWhoami implements `ydu whoami` which verifies the token and prints
+// the account it belongs to together with its disk limits.
+func runWhoami(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("whoami", flag.ExitOnError)
+	jsonOutput := flags.Bool(
+		"json",
+		false,
+		"print the account information as JSON",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 0 {
+		return errors.New("usage: ydu whoami [--json]")
+	}
+
+	token, err := diskToken()
+	if err != nil {
+		return err
+	}
+
+	info, err := getDiskInfo(newHTTPClient(*httpClientTimeout), token)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+
+	access := "full disk"
+	if info.Access == "app" {
+		access = "app folder only (app:/)"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "login:\t%s\n", info.User.Login)
+	fmt.Fprintf(w, "name:\t%s\n", info.User.DisplayName)
+	fmt.Fprintf(w, "access:\t%s\n", access)
+	fmt.Fprintf(w, "paid:\t%t\n", info.IsPaid)
+	fmt.Fprintf(
+		w,
+		"used:\t%s of %s (trash %s)\n",
+		humanize.Bytes(uint64(info.UsedSpace)),
+		humanize.Bytes(uint64(info.TotalSpace)),
+		humanize.Bytes(uint64(info.TrashSize)),
+	)
+	fmt.Fprintf(
+		w,
+		"max file size:\t%s (paid plans %s)\n",
+		humanize.Bytes(uint64(info.MaxFileSize)),
+		humanize.Bytes(uint64(info.PaidMaxFileSize)),
+	)
+	return w.Flush()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// accountToken returns the token of a named account from
+// YANDEX_DISK_TOKEN_<NAME>, an empty name is the default account of
+// YANDEX_DISK_TOKEN.
+func accountToken(name string) (string, error) {
+	if name == "" {
+		return diskToken()
+	}
+
+	variable := "YANDEX_DISK_TOKEN_" + strings.ToUpper(
+		strings.ReplaceAll(name, "-", "_"),
+	)
+	token := os.Getenv(variable)
+	if token == "" {
+		return "", fmt.Errorf(
+			"pass ENV variable with the token of account %s %s",
+			name,
+			variable,
+		)
+	}
+	return token, nil
+}
+
+// xcopyFile streams a file of the source account into an upload to the
+// target account without a local copy.
+func xcopyFile(
+	httpClient *http.Client,
+	res resource,
+	target, fromToken, toToken string,
+) error {
+	href, err := downloadURL(httpClient, res.Path, fromToken)
+	if err != nil {
+		return err
+	}
+
+	uploadURL, err := createRequestOnUpload(
+		httpClient,
+		target,
+		toToken,
+		true,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"error during create upload request to yandex disk: %w",
+			err,
+		)
+	}
+
+	body, err := openDownload(httpClient, href)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	err = uploadStream(httpClient, uploadURL, body, res.Size)
+	memo.Invalidate(target)
+	auditUpload(target, toToken, res.Size, err)
+	return err
+}
+
+// runXcopy implements `ydu xcopy --from-account a --to-account b <src>
+// <dst>` which copies files between two yandex accounts. Files already
+// at the target with the same md5 are skipped, so an interrupted copy
+// continues where it stopped when run again.
+func runXcopy(logger *slog.Logger, args []string) error {
+	flags := flag.NewFlagSet("xcopy", flag.ExitOnError)
+	fromAccount := flags.String(
+		"from-account",
+		"",
+		"source account, its token is read from YANDEX_DISK_TOKEN_<NAME>",
+	)
+	toAccount := flags.String(
+		"to-account",
+		"",
+		"target account, its token is read from YANDEX_DISK_TOKEN_<NAME>",
+	)
+	httpClientTimeout := flags.Int(
+		"timeout",
+		900,
+		"http client timeout (sec)",
+	)
+	parseFlags(flags, args)
+
+	if flags.NArg() != 2 || *fromAccount == *toAccount {
+		return errors.New("usage: ydu xcopy --from-account name --to-account name <src> <dst>")
+	}
+
+	fromToken, err := accountToken(*fromAccount)
+	if err != nil {
+		return err
+	}
+	toToken, err := accountToken(*toAccount)
+	if err != nil {
+		return err
+	}
+	httpClient := newHTTPClient(*httpClientTimeout)
+	handlePauseSignals(logger)
+
+	src, err := resolveRemotePath(httpClient, flags.Arg(0), fromToken)
+	if err != nil {
+		return err
+	}
+	dst, err := resolveRemotePath(httpClient, flags.Arg(1), toToken)
+	if err != nil {
+		return err
+	}
+
+	srcRes, err := getDiskResource(httpClient, src, fromToken)
+	if err != nil {
+		return err
+	}
+
+	dirs := newRemoteDirs(httpClient, dst, toToken)
+	copied, skipped := 0, 0
+
+	copyItem := func(target string, res resource) error {
+		existing, err := getDiskResource(httpClient, target, toToken)
+		if err == nil && existing.Type != "dir" &&
+			existing.Size == res.Size && existing.MD5 == res.MD5 {
+			skipped++
+			return nil
+		}
+		if apiErr, ok := err.(*apiError); err != nil &&
+			(!ok || apiErr.StatusCode != http.StatusNotFound) {
+			return err
+		}
+
+		err = dirs.ensure(path.Dir(target))
+		if err != nil {
+			return err
+		}
+
+		logger.Info(
+			"copying",
+			slog.String("path", res.Path),
+			slog.String("target", target),
+			slog.String("size", humanize.Bytes(uint64(res.Size))),
+		)
+
+		err = xcopyFile(httpClient, res, target, fromToken, toToken)
+		if err != nil {
+			return err
+		}
+		copied++
+		return nil
+	}
+
+	if srcRes.Type != "dir" {
+		err = copyItem(dst, *srcRes)
+	} else {
+		err = walkRemote(
+			httpClient,
+			src,
+			fromToken,
+			func(rel string, res resource) error {
+				target := path.Join(dst, rel)
+				if res.Type == "dir" {
+					return dirs.ensure(target)
+				}
+				return copyItem(target, res)
+			},
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info(
+		"xcopy finished",
+		slog.Int("copied", copied),
+		slog.Int("skipped", skipped),
+	)
+	return nil
+}